@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/selfdriving"
+)
+
+// callbackURLHeader is the Process webhook request header with the
+// URL the engine should send callbacks to, if it processes the chunk
+// asynchronously.
+const callbackURLHeader = "X-Veritone-Callback-Url"
+
+// callbackPath is the path of the callback endpoint, which is
+// followed by the callback ID.
+const callbackPath = "/callback/"
+
+// Callback statuses.
+const (
+	callbackStatusProgress = "progress"
+	callbackStatusComplete = "complete"
+	callbackStatusIgnored  = "ignored"
+	callbackStatusFailed   = "failed"
+)
+
+// asyncCallback is a callback from an engine that is processing a
+// chunk asynchronously.
+type asyncCallback struct {
+	// Status is progress, complete, ignored or failed.
+	Status string `json:"status"`
+	// Message is an optional progress message.
+	Message string `json:"message"`
+	// Output is the engine output, or the new series items so far
+	// for progress callbacks.
+	Output json.RawMessage `json:"output"`
+	// Error is the error message for failed callbacks.
+	Error string `json:"error"`
+	// StatusCode is the equivalent HTTP status code for the error,
+	// which decides whether it is retried. Defaults to 500.
+	StatusCode int `json:"statusCode"`
+}
+
+// output gets the engine output from the callback, or an empty
+// string if there isn't any.
+func (c asyncCallback) output() string {
+	output := bytes.TrimSpace(c.Output)
+	if bytes.Equal(output, []byte("null")) {
+		return ""
+	}
+	return string(output)
+}
+
+// err gets the error for a failed callback, treating it like a
+// webhook response with the status code.
+func (c asyncCallback) err() error {
+	statusCode := c.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusInternalServerError
+	}
+	return newWebhookError(statusCode, http.Header{}, []byte(c.Error))
+}
+
+// asyncCallbacks receives callbacks from engines that process chunks
+// asynchronously.
+type asyncCallbacks struct {
+	// baseURL is the URL of the callback endpoint.
+	baseURL string
+	lis     net.Listener
+
+	lock    sync.Mutex
+	waiting map[string]*callbackWaiter
+}
+
+// callbackWaiter waits for the callbacks for one Process webhook
+// call.
+type callbackWaiter struct {
+	// id is random, so the URL can't be guessed by anyone else
+	// who can reach the callback endpoint.
+	id string
+	// url is where the engine sends the callbacks.
+	url       string
+	callbacks chan asyncCallback
+	// done is closed when the callbacks are no longer wanted.
+	done chan struct{}
+}
+
+// listenAsyncCallbacks listens for callbacks on addr.
+// If addr has no host (like ":9091"), it listens on the loopback
+// interface only.
+// Callbacks are not received until serve is called.
+func listenAsyncCallbacks(addr string) (*asyncCallbacks, error) {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(lis.Addr().String())
+	if err != nil {
+		lis.Close()
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		// listening on all interfaces; the engine is local
+		host = "127.0.0.1"
+	}
+	return &asyncCallbacks{
+		baseURL: "http://" + net.JoinHostPort(host, port) + callbackPath,
+		lis:     lis,
+		waiting: make(map[string]*callbackWaiter),
+	}, nil
+}
+
+// serve receives callbacks until the context is done.
+func (a *asyncCallbacks) serve(ctx context.Context) error {
+	srv := &http.Server{Handler: a}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(a.lis); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// register makes a callbackWaiter for a Process webhook call.
+// Returns nil if the asyncCallbacks is nil, so async mode is
+// disabled.
+// The waiter must be removed when it is finished with.
+func (a *asyncCallbacks) register() (*callbackWaiter, error) {
+	if a == nil {
+		return nil, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(err, "callback ID")
+	}
+	id := hex.EncodeToString(b)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	w := &callbackWaiter{
+		id:        id,
+		url:       a.baseURL + id,
+		callbacks: make(chan asyncCallback),
+		done:      make(chan struct{}),
+	}
+	a.waiting[id] = w
+	return w, nil
+}
+
+// remove removes the waiter, so any more callbacks for it are
+// rejected. Does nothing if w is nil.
+func (a *asyncCallbacks) remove(w *callbackWaiter) {
+	if a == nil || w == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.waiting, w.id)
+	close(w.done)
+}
+
+// ServeHTTP receives a callback, and passes it to the waiter.
+func (a *asyncCallbacks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, callbackPath) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "callbacks must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.lock.Lock()
+	waiter, ok := a.waiting[strings.TrimPrefix(r.URL.Path, callbackPath)]
+	a.lock.Unlock()
+	if !ok {
+		http.Error(w, "unknown callback", http.StatusNotFound)
+		return
+	}
+	var callback asyncCallback
+	if err := json.NewDecoder(r.Body).Decode(&callback); err != nil {
+		http.Error(w, "decode callback: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch callback.Status {
+	case callbackStatusProgress, callbackStatusComplete, callbackStatusIgnored, callbackStatusFailed:
+	default:
+		http.Error(w, "unknown status "+strconv.Quote(callback.Status), http.StatusBadRequest)
+		return
+	}
+	select {
+	case waiter.callbacks <- callback:
+	case <-waiter.done:
+		http.Error(w, "chunk is no longer being processed", http.StatusGone)
+	case <-r.Context().Done():
+	}
+}
+
+// waitForCallback waits for the final callback after the Process
+// webhook accepted the chunk, and gets the engine output.
+// Progress callbacks are passed to progress.
+// If no final callback arrives before the async timeout, the chunk
+// times out. The async timeout replaces the chunk timeout, so ctx
+// should not carry the chunk deadline.
+func (e *Engine) waitForCallback(ctx context.Context, waiter *callbackWaiter, progress func(asyncCallback)) (ignored bool, content string, err error) {
+	timeout := time.NewTimer(e.Config.Async.Timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case callback := <-waiter.callbacks:
+			switch callback.Status {
+			case callbackStatusProgress:
+				progress(callback)
+				continue
+			case callbackStatusFailed:
+				return false, "", callback.err()
+			case callbackStatusIgnored:
+				return true, "", nil
+			}
+			output := callback.output()
+			return output == "", output, nil
+		case <-timeout.C:
+			return false, "", newChunkError(failureReasonTimeout, errors.Errorf("no callback from the engine after %s", e.Config.Async.Timeout))
+		case <-ctx.Done():
+			return false, "", newChunkError(failureReasonTimeout, ctx.Err())
+		}
+	}
+}
+
+// acceptedJobHandle gets the job handle from a 202 Accepted Process
+// webhook response, if there is one.
+func acceptedJobHandle(body io.Reader) string {
+	var accepted struct {
+		JobHandle string `json:"jobHandle"`
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(body, 64*1024))
+	json.Unmarshal(b, &accepted)
+	return accepted.JobHandle
+}
+
+// waitForSelfDrivingCallback waits for the final callback for a file
+// the Process webhook accepted, and writes the output to outputDir.
+func (e *Engine) waitForSelfDrivingCallback(ctx context.Context, outputDir string, file selfdriving.File, waiter *callbackWaiter) error {
+	ignored, content, err := e.waitForCallback(ctx, waiter, func(callback asyncCallback) {
+		e.logDebug("progress for file", file.Path+":", callback.Message)
+	})
+	if err != nil {
+		return err
+	}
+	if ignored {
+		e.logDebug("ignoring chunk:", file.Path)
+		return nil
+	}
+	outputFile := filepath.Join(outputDir, filepath.Base(file.Path)+".json")
+	return writeOutputFile(outputFile, strings.NewReader(content))
+}
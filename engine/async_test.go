@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+	"github.com/veritone/realtime/modules/engines/toolkit/selfdriving"
+)
+
+// sendCallbacks POSTs the callbacks to the URL, one at a time.
+func sendCallbacks(t *testing.T, url string, callbacks ...string) {
+	for _, callback := range callbacks {
+		resp, err := http.Post(url, "application/json", strings.NewReader(callback))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("callback: %s", resp.Status)
+		}
+	}
+}
+
+// newAsyncServer makes a Process webhook that accepts each chunk, and
+// sends callbacks to the callback URL.
+// Chunks starting at 2000ms are accepted but never called back.
+func newAsyncServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		callbackURL := r.Header.Get(callbackURLHeader)
+		if callbackURL == "" {
+			http.Error(w, "missing callback URL", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, `{"jobHandle":"job-1"}`)
+		if r.FormValue("startOffsetMS") == "2000" {
+			return
+		}
+		go sendCallbacks(t, callbackURL,
+			`{"status":"progress","message":"half way","output":{"series":[{"label":"a"}]}}`,
+			`{"status":"complete","output":{"series":[{"label":"a"},{"label":"b"}]}}`,
+		)
+	}))
+}
+
+func TestAsyncCallbacks(t *testing.T) {
+	is := is.New(t)
+	callbacks, err := listenAsyncCallbacks("0.0.0.0:0")
+	is.NoErr(err)
+	is.True(strings.HasPrefix(callbacks.baseURL, "http://127.0.0.1:"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go callbacks.serve(ctx)
+
+	post := func(url, body string) int {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		is.NoErr(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waiter, err := callbacks.register()
+	is.NoErr(err)
+	is.Equal(post(waiter.url, `{"status":"unknown"}`), http.StatusBadRequest)
+	is.Equal(post(waiter.url, `not json`), http.StatusBadRequest)
+	is.Equal(post(callbacks.baseURL+"123", `{"status":"complete"}`), http.StatusNotFound)
+	callbacks.remove(waiter)
+	is.Equal(post(waiter.url, `{"status":"complete"}`), http.StatusNotFound)
+}
+
+func TestAsyncCallbacksLoopback(t *testing.T) {
+	is := is.New(t)
+	callbacks, err := listenAsyncCallbacks(":0")
+	is.NoErr(err)
+	defer callbacks.lis.Close()
+	host, _, err := net.SplitHostPort(callbacks.lis.Addr().String())
+	is.NoErr(err)
+	is.Equal(host, "127.0.0.1")
+
+	w1, err := callbacks.register()
+	is.NoErr(err)
+	w2, err := callbacks.register()
+	is.NoErr(err)
+	is.Equal(len(w1.id), 32)
+	is.True(w1.id != w2.id)
+}
+
+func TestProcessingChunkAsync(t *testing.T) {
+	is := is.New(t)
+	processSrv := newAsyncServer(t)
+	defer processSrv.Close()
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Async.CallbackAddr = "127.0.0.1:0"
+	engine.Config.Async.Timeout = 100 * time.Millisecond
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	send := func(offset int64, chunkUUID string, startOffsetMS int) {
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: offset,
+			Key:    sarama.StringEncoder("task1"),
+			Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+				Type:          processing.MessageTypeMediaChunk,
+				TaskID:        "task1",
+				ChunkUUID:     chunkUUID,
+				StartOffsetMS: startOffsetMS,
+				EndOffsetMS:   startOffsetMS + 1000,
+			}),
+		})
+		is.NoErr(err)
+	}
+	receive := func() []byte {
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			return outputMsg.Value
+		case <-time.After(1 * time.Second):
+			is.Fail() // timed out
+		}
+		return nil
+	}
+
+	send(1, "chunk1", 1000)
+	var interim processing.MediaChunkMessage
+	is.NoErr(json.Unmarshal(receive(), &interim))
+	is.Equal(interim.Type, processing.MessageTypeEngineOutput)
+	is.Equal(interim.ChunkUUID, "chunk1")
+	is.Equal(interim.Content, `{"series":[{"label":"a"}]}`)
+	var result chunkResult
+	is.NoErr(json.Unmarshal(receive(), &result))
+	is.Equal(result.ChunkUUID, "chunk1")
+	is.Equal(result.Status, processing.ChunkStatusSuccess)
+	is.Equal(result.EngineOutput.Content, `{"series":[{"label":"a"},{"label":"b"}]}`)
+
+	send(2, "chunk2", 2000)
+	result = chunkResult{}
+	is.NoErr(json.Unmarshal(receive(), &result))
+	is.Equal(result.ChunkUUID, "chunk2")
+	is.Equal(result.Status, processing.ChunkStatusError)
+	is.Equal(result.FailureReason, failureReasonTimeout)
+	is.True(strings.Contains(result.FailureMsg, "no callback"))
+}
+
+func TestProcessingSelfDrivingFileAsync(t *testing.T) {
+	is := is.New(t)
+	processSrv := newAsyncServer(t)
+	defer processSrv.Close()
+	outputDir, err := ioutil.TempDir("", "engine-toolkit")
+	is.NoErr(err)
+	defer os.RemoveAll(outputDir)
+
+	engine := NewEngine()
+	engine.Config.Async.Timeout = 1 * time.Second
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+	engine.logDebug = func(args ...interface{}) {}
+	engine.callbacks, err = listenAsyncCallbacks("127.0.0.1:0")
+	is.NoErr(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.callbacks.serve(ctx)
+
+	inputFile := filepath.Join(outputDir, "image.png")
+	is.NoErr(ioutil.WriteFile(inputFile, []byte("image"), 0644))
+	err = engine.processSelfDrivingFile(outputDir, selfdriving.File{Path: inputFile})
+	is.NoErr(err)
+	b, err := ioutil.ReadFile(filepath.Join(outputDir, "image.png.json"))
+	is.NoErr(err)
+	is.True(bytes.Equal(b, []byte(`{"series":[{"label":"a"},{"label":"b"}]}`)))
+}
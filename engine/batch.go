@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// Batch result statuses.
+const (
+	batchStatusSuccess = "success"
+	batchStatusError   = "error"
+	batchStatusIgnored = "ignored"
+)
+
+// batchItem is a chunk waiting to be sent to the Process webhook
+// as part of a batch.
+type batchItem struct {
+	ctx   context.Context
+	chunk processing.MediaChunkMessage
+	// hold is the memory held for the chunk.
+	hold   *memoryHold
+	result chan batchItemResult
+}
+
+// batchItemResult is the outcome for a single chunk in a batch.
+type batchItemResult struct {
+	// statusCode is the status code of the batch response.
+	statusCode int
+	// ignored is true if the engine ignored the chunk.
+	ignored bool
+	// content is the engine output.
+	content string
+	err     error
+}
+
+// batchResponse is the response from the Process webhook in batch mode.
+type batchResponse struct {
+	// Results holds a result for each chunk, in the order they
+	// were sent.
+	Results []batchResult `json:"results"`
+}
+
+// batchResult is the result for one chunk in a batchResponse.
+type batchResult struct {
+	// Status is "success" (default), "error" or "ignored".
+	Status string `json:"status"`
+	// Output is the engine output for successful chunks.
+	Output json.RawMessage `json:"output"`
+	// StatusCode optionally describes failed chunks as if
+	// they had been sent alone. Defaults to 500.
+	StatusCode    int    `json:"statusCode"`
+	FailureReason string `json:"failureReason"`
+	Message       string `json:"message"`
+}
+
+// processBatched queues the chunk to be sent to the Process webhook as
+// part of a batch, and waits for its result.
+func (e *Engine) processBatched(ctx context.Context, chunk processing.MediaChunkMessage, hold *memoryHold) batchItemResult {
+	item := &batchItem{
+		ctx:    ctx,
+		chunk:  chunk,
+		hold:   hold,
+		result: make(chan batchItemResult, 1),
+	}
+	select {
+	case e.batches <- item:
+	case <-ctx.Done():
+		return batchItemResult{err: newChunkError(failureReasonTimeout, ctx.Err())}
+	}
+	select {
+	case result := <-item.result:
+		return result
+	case <-ctx.Done():
+		return batchItemResult{err: newChunkError(failureReasonTimeout, ctx.Err())}
+	}
+}
+
+// runBatches gathers queued chunks into batches of up to Batch.Size,
+// waiting no longer than Batch.Wait after the first chunk arrives,
+// and sends them to the Process webhook.
+// Blocks until the context is cancelled.
+func (e *Engine) runBatches(ctx context.Context) {
+	for {
+		var items []*batchItem
+		select {
+		case item := <-e.batches:
+			items = append(items, item)
+		case <-ctx.Done():
+			return
+		}
+		timer := time.NewTimer(e.Config.Batch.Wait)
+	collect:
+		for len(items) < e.Config.Batch.Size {
+			select {
+			case item := <-e.batches:
+				items = append(items, item)
+			case <-timer.C:
+				break collect
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		timer.Stop()
+		go e.sendBatch(ctx, items)
+	}
+}
+
+// sendBatch makes a single request to the Process webhook for all
+// the items, and delivers each item its own result.
+//
+// Each chunk is sent as indexed fields, for example the first chunk
+// is in chunk[0] with its details in chunkUUID[0], startOffsetMS[0] etc.
+func (e *Engine) sendBatch(ctx context.Context, items []*batchItem) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	var batch []*batchItem
+	for _, item := range items {
+		if err := item.ctx.Err(); err != nil {
+			item.result <- batchItemResult{err: newChunkError(failureReasonTimeout, err)}
+			continue
+		}
+		if err := e.writeBatchChunk(w, len(batch), item); err != nil {
+			item.result <- batchItemResult{err: err}
+			continue
+		}
+		batch = append(batch, item)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := batchContext(ctx, batch)
+	defer cancel()
+	fail := func(result batchItemResult) {
+		for _, item := range batch {
+			item.result <- result
+		}
+	}
+	if err := w.WriteField("batchSize", strconv.Itoa(len(batch))); err != nil {
+		fail(batchItemResult{err: newChunkError(failureReasonInternalError, err)})
+		return
+	}
+	if err := w.Close(); err != nil {
+		fail(batchItemResult{err: newChunkError(failureReasonInternalError, err)})
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.Config.Webhooks.Process.URL, &buf)
+	if err != nil {
+		fail(batchItemResult{err: newChunkError(failureReasonInternalError, errors.Wrap(err, "new request"))})
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	e.logDebug(fmt.Sprintf("sending batch of %d chunk(s)", len(batch)))
+	sent := time.Now()
+	resp, err := e.webhookClient.Do(req)
+	if err != nil {
+		if ctx.Err() == nil {
+			e.concurrency.observe(time.Since(sent), true)
+		}
+		fail(batchItemResult{err: newChunkError(failureReasonEngineUnavailable, err)})
+		return
+	}
+	defer resp.Body.Close()
+	e.concurrency.observe(time.Since(sent), isOverloaded(resp.StatusCode))
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, resp.Body); err != nil {
+		fail(batchItemResult{
+			statusCode: resp.StatusCode,
+			err:        newChunkError(failureReasonEngineError, errors.Wrap(err, "read body")),
+		})
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		fail(batchItemResult{
+			statusCode: resp.StatusCode,
+			err:        newWebhookError(resp.StatusCode, resp.Header, body.Bytes()),
+		})
+		return
+	}
+	var batchResp batchResponse
+	if err := json.Unmarshal(body.Bytes(), &batchResp); err != nil {
+		fail(batchItemResult{
+			statusCode: resp.StatusCode,
+			err:        newChunkError(failureReasonEngineError, errors.Wrap(err, "decode batch response")),
+		})
+		return
+	}
+	if len(batchResp.Results) != len(batch) {
+		fail(batchItemResult{
+			statusCode: resp.StatusCode,
+			err:        newChunkError(failureReasonEngineError, errors.Errorf("expected %d result(s) but got %d", len(batch), len(batchResp.Results))),
+		})
+		return
+	}
+	for i, item := range batch {
+		item.result <- newBatchItemResult(resp.StatusCode, batchResp.Results[i])
+	}
+}
+
+// writeBatchChunk writes the fields describing the chunk at index i.
+// The chunk media is sent too if it has any (see sendsChunkMedia).
+// The media is read before anything is written, so a failed download
+// doesn't leave a partial chunk in the batch.
+func (e *Engine) writeBatchChunk(w *multipart.Writer, i int, item *batchItem) error {
+	chunk := item.chunk
+	fields, err := e.chunkFields(chunk)
+	if err != nil {
+		return newChunkError(failureReasonInternalError, err)
+	}
+	var media []byte
+	if e.sendsChunkMedia(chunk) {
+		r, err := e.openMedia(item.ctx, chunk)
+		if err != nil {
+			return newChunkError(failureReasonDownloadFailed, errors.Wrap(err, "download chunk"))
+		}
+		media, err = ioutil.ReadAll(item.hold.reader(r))
+		r.Close()
+		if err != nil {
+			return newChunkError(failureReasonDownloadFailed, errors.Wrap(err, "download chunk"))
+		}
+	}
+	for _, field := range fields {
+		if err := w.WriteField(fmt.Sprintf("%s[%d]", field.name, i), field.value); err != nil {
+			return newChunkError(failureReasonInternalError, err)
+		}
+	}
+	if media == nil {
+		return nil
+	}
+	part, err := w.CreateFormFile(fmt.Sprintf("chunk[%d]", i), chunk.ChunkUUID)
+	if err != nil {
+		return newChunkError(failureReasonInternalError, err)
+	}
+	if _, err := part.Write(media); err != nil {
+		return newChunkError(failureReasonInternalError, err)
+	}
+	return nil
+}
+
+// batchContext gets the context for the batch request, which is
+// cancelled once every chunk in the batch has timed out or been
+// cancelled (so nothing is waiting for the results), or when ctx
+// is done.
+func batchContext(ctx context.Context, items []*batchItem) (context.Context, context.CancelFunc) {
+	batchCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		for _, item := range items {
+			select {
+			case <-item.ctx.Done():
+			case <-batchCtx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return batchCtx, cancel
+}
+
+// newBatchItemResult turns the result for a single chunk into a
+// batchItemResult.
+func newBatchItemResult(statusCode int, result batchResult) batchItemResult {
+	switch result.Status {
+	case batchStatusIgnored:
+		return batchItemResult{statusCode: statusCode, ignored: true}
+	case batchStatusError:
+		code := result.StatusCode
+		if code == 0 {
+			code = http.StatusInternalServerError
+		}
+		// with no details, the error is described by the
+		// status code alone.
+		header := make(http.Header)
+		var body []byte
+		if result.FailureReason != "" || result.Message != "" {
+			body, _ = json.Marshal(webhookErrorBody{
+				FailureReason: result.FailureReason,
+				Message:       result.Message,
+			})
+			header.Set("Content-Type", "application/json")
+		}
+		return batchItemResult{
+			statusCode: code,
+			err:        newWebhookError(code, header, body),
+		}
+	}
+	if len(result.Output) == 0 || string(result.Output) == "null" {
+		return batchItemResult{statusCode: statusCode, ignored: true}
+	}
+	return batchItemResult{statusCode: statusCode, content: string(result.Output)}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestProcessingChunkBatch(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Processing.Concurrency = 3
+	engine.Config.Batch.Size = 3
+	engine.Config.Batch.Wait = 1 * time.Second
+	engine.Config.Webhooks.Backoff.MaxRetries = 0
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	var calls int32
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		is.Equal(r.FormValue("batchSize"), "3")
+		var resp batchResponse
+		for i := 0; i < 3; i++ {
+			switch r.FormValue(fmt.Sprintf("chunkUUID[%d]", i)) {
+			case "chunk1":
+				resp.Results = append(resp.Results, batchResult{
+					Output: json.RawMessage(`{"series":[]}`),
+				})
+			case "chunk2":
+				resp.Results = append(resp.Results, batchResult{
+					Status:        batchStatusError,
+					StatusCode:    http.StatusBadRequest,
+					FailureReason: "wrong_type",
+					Message:       "expected an image",
+				})
+			case "chunk3":
+				resp.Results = append(resp.Results, batchResult{
+					Status: batchStatusIgnored,
+				})
+			default:
+				is.Fail() // unexpected chunk
+			}
+		}
+		err := json.NewEncoder(w).Encode(resp)
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	for i, chunkUUID := range []string{"chunk1", "chunk2", "chunk3"} {
+		inputMessage := processing.MediaChunkMessage{
+			TimestampUTC:  time.Now().Unix(),
+			ChunkUUID:     chunkUUID,
+			Type:          processing.MessageTypeMediaChunk,
+			StartOffsetMS: 1000 * i,
+			EndOffsetMS:   1000 * (i + 1),
+			JobID:         "job1",
+			TDOID:         "tdo1",
+			TaskID:        "task1",
+		}
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: int64(i),
+			Key:    sarama.StringEncoder(inputMessage.TaskID),
+			Value:  processing.NewJSONEncoder(inputMessage),
+		})
+		is.NoErr(err)
+	}
+
+	results := make(map[string]chunkResult)
+	for len(results) < 3 {
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			var result chunkResult
+			err := json.Unmarshal(outputMsg.Value, &result)
+			is.NoErr(err)
+			results[result.ChunkUUID] = result
+		case <-time.After(3 * time.Second):
+			is.Fail() // timed out
+			return
+		}
+	}
+	is.Equal(atomic.LoadInt32(&calls), int32(1)) // one request for the batch
+	is.Equal(results["chunk1"].Status, processing.ChunkStatusSuccess)
+	is.True(results["chunk1"].EngineOutput != nil)
+	is.Equal(results["chunk1"].EngineOutput.Content, `{"series":[]}`)
+	is.Equal(results["chunk2"].Status, processing.ChunkStatusError)
+	is.Equal(results["chunk2"].FailureReason, "wrong_type")
+	is.Equal(results["chunk2"].FailureMsg, "expected an image")
+	is.Equal(results["chunk3"].Status, processing.ChunkStatusIgnored)
+}
+
+func TestNewBatchItemResult(t *testing.T) {
+	is := is.New(t)
+
+	result := newBatchItemResult(http.StatusOK, batchResult{Output: json.RawMessage(`{}`)})
+	is.NoErr(result.err)
+	is.Equal(result.content, `{}`)
+	is.Equal(result.ignored, false)
+
+	result = newBatchItemResult(http.StatusOK, batchResult{})
+	is.NoErr(result.err)
+	is.Equal(result.ignored, true) // no output
+
+	result = newBatchItemResult(http.StatusOK, batchResult{Status: batchStatusError, Message: "boom"})
+	is.Equal(result.statusCode, http.StatusInternalServerError)
+	reason, msg := failureDetails(result.err)
+	is.Equal(reason, failureReasonEngineError)
+	is.Equal(msg, "boom")
+
+	// errors without details fall back to the status text
+	result = newBatchItemResult(http.StatusOK, batchResult{Status: batchStatusError, StatusCode: http.StatusBadRequest})
+	is.Equal(result.statusCode, http.StatusBadRequest)
+	is.Equal(result.err.Error(), "400: Bad Request")
+	reason, _ = failureDetails(result.err)
+	is.Equal(reason, failureReasonBadInput)
+}
+
+func TestWriteBatchChunkDownloadFailed(t *testing.T) {
+	is := is.New(t)
+	engine := NewEngine()
+	engine.Config.Processing.DisableChunkDownload = false
+	mediaSrv := httptest.NewServer(http.NotFoundHandler())
+	defer mediaSrv.Close()
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	item := &batchItem{
+		ctx:   context.Background(),
+		chunk: processing.MediaChunkMessage{ChunkUUID: "chunk1", CacheURI: mediaSrv.URL},
+	}
+	err := engine.writeBatchChunk(w, 0, item)
+	reason, _ := failureDetails(err)
+	is.Equal(reason, failureReasonDownloadFailed)
+	is.Equal(buf.Len(), 0) // nothing written for the failed chunk
+}
+
+func TestBatchContext(t *testing.T) {
+	is := is.New(t)
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	batchCtx, cancel := batchContext(context.Background(), []*batchItem{{ctx: ctx1}, {ctx: ctx2}})
+	defer cancel()
+	cancel1()
+	select {
+	case <-batchCtx.Done():
+		is.Fail() // cancelled while a chunk is still waiting
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel2()
+	select {
+	case <-batchCtx.Done():
+	case <-time.After(1 * time.Second):
+		is.Fail() // not cancelled after every chunk was
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// adaptiveConcurrency grows and shrinks the number of chunks processed
+// at once based on the latency and error rate of the Process webhook,
+// using additive-increase/multiplicative-decrease (AIMD).
+//
+// The processing semaphore is made with room for max chunks, and the
+// limit is lowered by holding the slots that are not allowed to be used.
+type adaptiveConcurrency struct {
+	semaphore chan struct{}
+	min, max  int
+	// latencyTolerance is how many times slower than the baseline
+	// latency responses can get before the limit is decreased.
+	latencyTolerance float64
+	// maxErrorRate is the fraction of calls that may fail before
+	// the limit is decreased.
+	maxErrorRate float64
+	logDebug     func(args ...interface{})
+
+	// changed is signalled when the limit changes.
+	changed chan struct{}
+
+	lock  sync.Mutex
+	limit int
+	// baseline is the smoothed lowest average latency seen.
+	baseline time.Duration
+	// the current window of observations
+	samples int
+	errs    int
+	total   time.Duration
+	// backedOffUntil is when the limit may grow again after the
+	// engine asked the toolkit to back off.
+	backedOffUntil time.Time
+}
+
+// newAdaptiveConcurrency makes an adaptiveConcurrency that starts
+// at initial, and is kept between min and max.
+func newAdaptiveConcurrency(initial, min, max int, latencyTolerance, maxErrorRate float64, logDebug func(args ...interface{})) *adaptiveConcurrency {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	if initial < min {
+		initial = min
+	}
+	if initial > max {
+		initial = max
+	}
+	return &adaptiveConcurrency{
+		semaphore:        make(chan struct{}, max),
+		min:              min,
+		max:              max,
+		latencyTolerance: latencyTolerance,
+		maxErrorRate:     maxErrorRate,
+		logDebug:         logDebug,
+		changed:          make(chan struct{}, 1),
+		limit:            initial,
+	}
+}
+
+// Limit gets the current concurrency limit.
+// Nil-safe: returns zero if adaptive concurrency is disabled.
+func (a *adaptiveConcurrency) Limit() int {
+	if a == nil {
+		return 0
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.limit
+}
+
+// observe records the outcome of a call to the Process webhook.
+// overloaded is true if the call failed in a way that suggests the
+// engine is struggling (5xx, 429, or no response at all).
+// Once a full window of calls has been observed, the limit
+// is adjusted.
+// Nil-safe.
+func (a *adaptiveConcurrency) observe(latency time.Duration, overloaded bool) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.samples++
+	a.total += latency
+	if overloaded {
+		a.errs++
+	}
+	if a.samples < a.limit {
+		return
+	}
+	avg := a.total / time.Duration(a.samples)
+	errorRate := float64(a.errs) / float64(a.samples)
+	a.samples, a.errs, a.total = 0, 0, 0
+	if a.baseline == 0 || avg < a.baseline {
+		a.baseline = avg
+	} else {
+		// drift slowly towards the current latency so the baseline
+		// follows genuine changes in the workload.
+		a.baseline += (avg - a.baseline) / 20
+	}
+	limit := a.limit
+	switch {
+	case errorRate > a.maxErrorRate:
+		limit = limit * 3 / 4
+	case float64(avg) > float64(a.baseline)*a.latencyTolerance:
+		limit = limit * 3 / 4
+	case time.Now().Before(a.backedOffUntil):
+		// hold steady while backing off
+	default:
+		limit++
+	}
+	if limit < a.min {
+		limit = a.min
+	}
+	if limit > a.max {
+		limit = a.max
+	}
+	if limit == a.limit {
+		return
+	}
+	a.logDebug(fmt.Sprintf("concurrency limit %d -> %d (latency %s, baseline %s, error rate %.2f)", a.limit, limit, avg, a.baseline, errorRate))
+	a.limit = limit
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+}
+
+// backOff halves the limit (keeping it at least min), and stops it
+// growing again for d.
+// Backing off again before d has passed does nothing, so a burst of
+// throttled responses only lowers the limit once.
+// Nil-safe.
+func (a *adaptiveConcurrency) backOff(d time.Duration) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	if now.Before(a.backedOffUntil) {
+		return
+	}
+	a.backedOffUntil = now.Add(d)
+	limit := a.limit / 2
+	if limit < a.min {
+		limit = a.min
+	}
+	if limit == a.limit {
+		return
+	}
+	a.logDebug(fmt.Sprintf("concurrency limit %d -> %d (backing off for %s)", a.limit, limit, d))
+	a.limit = limit
+	select {
+	case a.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run holds the semaphore slots above the current limit so they
+// cannot be used for processing.
+// Blocks until the context is cancelled.
+func (a *adaptiveConcurrency) run(ctx context.Context) {
+	var held int
+	defer func() {
+		for ; held > 0; held-- {
+			<-a.semaphore
+		}
+	}()
+	for {
+		want := a.max - a.Limit()
+		switch {
+		case held < want:
+			select {
+			case a.semaphore <- struct{}{}:
+				held++
+			case <-a.changed:
+			case <-ctx.Done():
+				return
+			}
+		case held > want:
+			<-a.semaphore
+			held--
+		default:
+			select {
+			case <-a.changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// isOverloaded gets whether a Process webhook response suggests the
+// engine is overloaded.
+func isOverloaded(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestAdaptiveConcurrency(t *testing.T) {
+	is := is.New(t)
+	a := newAdaptiveConcurrency(2, 1, 4, 2, 0.1, func(args ...interface{}) {})
+	is.Equal(a.Limit(), 2)
+	is.Equal(cap(a.semaphore), 4)
+
+	// healthy windows increase the limit by one
+	a.observe(100*time.Millisecond, false)
+	is.Equal(a.Limit(), 2) // window not full yet
+	a.observe(100*time.Millisecond, false)
+	is.Equal(a.Limit(), 3)
+	for i := 0; i < 3; i++ {
+		a.observe(100*time.Millisecond, false)
+	}
+	is.Equal(a.Limit(), 4)
+	for i := 0; i < 4; i++ {
+		a.observe(100*time.Millisecond, false)
+	}
+	is.Equal(a.Limit(), 4) // capped at max
+
+	// slow responses decrease the limit
+	for i := 0; i < 4; i++ {
+		a.observe(time.Second, false)
+	}
+	is.Equal(a.Limit(), 3)
+
+	// errors decrease the limit
+	a.observe(100*time.Millisecond, true)
+	a.observe(100*time.Millisecond, false)
+	a.observe(100*time.Millisecond, false)
+	is.Equal(a.Limit(), 2)
+	a.observe(100*time.Millisecond, true)
+	a.observe(100*time.Millisecond, true)
+	is.Equal(a.Limit(), 1)
+	a.observe(100*time.Millisecond, true)
+	is.Equal(a.Limit(), 1) // kept at min
+
+	var nilConcurrency *adaptiveConcurrency
+	nilConcurrency.observe(time.Second, true)
+	is.Equal(nilConcurrency.Limit(), 0)
+}
+
+func TestAdaptiveConcurrencyRun(t *testing.T) {
+	is := is.New(t)
+	a := newAdaptiveConcurrency(1, 1, 3, 2, 0.1, func(args ...interface{}) {})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.run(ctx)
+
+	for len(a.semaphore) < 2 {
+		time.Sleep(10 * time.Millisecond) // wait for the unused slots to be held
+	}
+	// only one slot is available
+	a.semaphore <- struct{}{}
+	select {
+	case a.semaphore <- struct{}{}:
+		is.Fail() // should be limited to one
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// raising the limit frees a slot
+	a.observe(10*time.Millisecond, false)
+	is.Equal(a.Limit(), 2)
+	select {
+	case a.semaphore <- struct{}{}:
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out waiting for slot
+	}
+}
+
+func TestAdaptiveConcurrencyBackOff(t *testing.T) {
+	is := is.New(t)
+	a := newAdaptiveConcurrency(4, 1, 4, 2, 0.1, func(args ...interface{}) {})
+	a.backOff(time.Hour)
+	is.Equal(a.Limit(), 2)
+	a.backOff(time.Hour)
+	is.Equal(a.Limit(), 2) // only once while backing off
+	// the limit doesn't grow while backing off
+	for i := 0; i < 2; i++ {
+		a.observe(100*time.Millisecond, false)
+	}
+	is.Equal(a.Limit(), 2)
+
+	a.lock.Lock()
+	a.backedOffUntil = time.Now()
+	a.lock.Unlock()
+	for i := 0; i < 2; i++ {
+		a.observe(100*time.Millisecond, false)
+	}
+	is.Equal(a.Limit(), 3)
+	a.backOff(time.Hour)
+	is.Equal(a.Limit(), 1)
+
+	var nilConcurrency *adaptiveConcurrency
+	nilConcurrency.backOff(time.Hour)
+}
+
+func TestIsOverloaded(t *testing.T) {
+	is := is.New(t)
+	is.Equal(isOverloaded(200), false)
+	is.Equal(isOverloaded(400), false)
+	is.Equal(isOverloaded(429), true)
+	is.Equal(isOverloaded(500), true)
+	is.Equal(isOverloaded(503), true)
+}
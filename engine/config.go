@@ -7,6 +7,7 @@ import (
 
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
@@ -31,14 +32,219 @@ type Config struct {
 	Subprocess processing.Subprocess
 	// Kafka holds Kafka configuration.
 	Kafka processing.Kafka
+	// KafkaSecurity holds TLS and SASL settings for Kafka.
+	KafkaSecurity kafkaSecurity
+	// Producer holds settings for the Kafka producer.
+	Producer producerSettings
+	// Inputs holds the input topics when consuming from more than
+	// one, in which case Kafka.InputTopic is not used.
+	Inputs struct {
+		// Topics are the input topics, highest priority first.
+		Topics []inputTopic
+		// Strict is whether messages from higher priority topics
+		// always go first, rather than sharing processing between
+		// the topics by weight.
+		Strict bool
+	}
 	// Webhooks holds webhook addresses.
 	Webhooks processing.Webhooks
+	// GRPC holds the settings for calling the engine over gRPC
+	// instead of the webhooks.
+	GRPC struct {
+		// Address is the address of the engine's gRPC server
+		// (host:port). If set, it is used instead of the Ready,
+		// Process and Finalize webhooks.
+		Address string
+	}
+	// Stdio holds the settings for calling the engine over the
+	// subprocess's stdin and stdout instead of the webhooks.
+	Stdio struct {
+		// Enabled is whether to use the stdio protocol. Lines the
+		// subprocess writes to stdout that aren't responses are
+		// treated as logs.
+		Enabled bool
+	}
+	// Async holds the settings for engines that process chunks
+	// asynchronously, by responding to the Process webhook with
+	// 202 Accepted and sending the output to a callback URL later.
+	Async struct {
+		// CallbackAddr is the address to listen on for callbacks.
+		// If empty, the Process webhook must respond with the output.
+		CallbackAddr string
+		// Timeout is how long to wait for the final callback after
+		// the Process webhook has accepted a chunk.
+		Timeout time.Duration
+	}
+	// Finalize holds the optional Finalize webhook, which is called
+	// with the TaskID once all chunks for a task have been sent.
+	Finalize struct {
+		URL string
+	}
+	// Retry contains configuration about how failed Process webhook
+	// calls are retried, in addition to Webhooks.Backoff.
+	Retry struct {
+		// RetryableStatusCodes are the response status codes that will be
+		// retried. If empty, any status code not in NonRetryableStatusCodes
+		// will be retried.
+		RetryableStatusCodes []int
+		// NonRetryableStatusCodes are the response status codes that
+		// fail immediately.
+		NonRetryableStatusCodes []int
+		// MaxThrottledRetries is the maximum number of retries after the
+		// engine responds with 429 or 503. These do not count
+		// towards Webhooks.Backoff.MaxRetries.
+		MaxThrottledRetries int
+		// MaxThrottleDuration is the longest the toolkit will wait
+		// when honoring a Retry-After header.
+		MaxThrottleDuration time.Duration
+	}
+	// AdaptiveConcurrency contains configuration for adjusting the
+	// processing concurrency based on how the Process webhook performs.
+	AdaptiveConcurrency struct {
+		// Enabled is whether adaptive concurrency is enabled. If enabled,
+		// Processing.Concurrency is the initial limit.
+		Enabled bool
+		// MinConcurrency is the lowest the limit will go.
+		MinConcurrency int
+		// MaxConcurrency is the highest the limit will go.
+		// Zero means Processing.Concurrency.
+		MaxConcurrency int
+		// LatencyTolerance is how many times slower than the baseline
+		// the webhook may respond before the limit is decreased.
+		LatencyTolerance float64
+		// MaxErrorRate is the fraction of webhook calls that may fail
+		// (with 5xx, 429 or no response) before the limit is decreased.
+		MaxErrorRate float64
+	}
+	// MediaCache contains configuration for the local disk cache
+	// of chunk media.
+	MediaCache struct {
+		// MaxBytes is the most media to keep in the cache.
+		// Zero disables the cache.
+		MaxBytes int64
+		// Dir is where the cache is kept. If empty, a temporary
+		// directory is used.
+		Dir string
+		// DownloadAttempts is how many times to try downloading
+		// media. Partial downloads are resumed where possible.
+		DownloadAttempts int
+		// IdleTimeout is how long an attempt may go without
+		// receiving any data before it is given up on.
+		IdleTimeout time.Duration
+	}
+	// Prefetch contains configuration for downloading chunk media
+	// ahead of processing.
+	Prefetch struct {
+		// Count is how many chunks to read ahead. Zero disables
+		// prefetching.
+		Count int
+		// Dir is where prefetched media is kept. If empty, a
+		// temporary directory is used.
+		Dir string
+		// MaxBytes is the most prefetched media to keep on disk.
+		// Zero means no limit.
+		MaxBytes int64
+	}
+	// Memory contains configuration for limiting memory use.
+	Memory struct {
+		// BudgetBytes is the maximum total size of the chunks in
+		// flight. Consuming pauses when it is reached.
+		// Zero means no limit.
+		BudgetBytes int64
+		// DefaultChunkBytes is the size held for a chunk whose size
+		// isn't known until it is downloaded.
+		DefaultChunkBytes int64
+	}
+	// Fairness contains configuration for sharing processing
+	// between tasks.
+	Fairness struct {
+		// Enabled is whether chunks are scheduled fairly between
+		// tasks rather than in the order they were consumed.
+		// Setting MaxPerTask also enables it.
+		Enabled bool
+		// MaxPerTask is the maximum number of chunks processed at
+		// the same time for each task. Zero means no limit.
+		MaxPerTask int
+		// MaxQueued is the maximum number of consumed chunks waiting
+		// to be scheduled.
+		MaxQueued int
+	}
+	// Batch contains configuration for sending several chunks to
+	// the Process webhook in a single request.
+	Batch struct {
+		// Size is the maximum number of chunks in each batch.
+		// Batching is enabled if this is greater than one.
+		Size int
+		// Wait is the longest to wait for a batch to fill up
+		// before sending it anyway.
+		Wait time.Duration
+	}
+	// Chunk contains configuration about how each chunk is processed.
+	Chunk struct {
+		// Timeout is the maximum time allowed to process a chunk, shared
+		// by all attempts. Zero means no limit.
+		// Tasks may override this with "chunkTimeout" in the task payload.
+		Timeout time.Duration
+	}
+	// Output contains configuration about engine output.
+	Output struct {
+		// MaxContentBytes is the largest engine output that will be sent
+		// through Kafka. Zero means no limit.
+		MaxContentBytes int
+		// Offload is whether output larger than MaxContentBytes is
+		// stored as an asset instead. If false, the chunk fails.
+		Offload bool
+		// MaxStreamedBytes is the largest engine output that will be
+		// read from a streamed (NDJSON) Process webhook response.
+		// Zero means no limit.
+		MaxStreamedBytes int
+		// InterimInterval is how often series items from a streamed
+		// response are sent as interim engine output messages while
+		// it is read. Zero means no interim outputs are sent.
+		InterimInterval time.Duration
+	}
+	// Ordering contains configuration for producing each task's
+	// ChunkResults in chunk offset order.
+	Ordering struct {
+		// Enabled is whether ChunkResults are produced in order.
+		Enabled bool
+		// Timeout is the longest a completed chunk will wait for
+		// earlier chunks before its result is produced anyway.
+		Timeout time.Duration
+		// MaxBuffered is the maximum number of completed chunks per
+		// task that may wait for earlier chunks.
+		MaxBuffered int
+	}
 	// Events contains system event configuration.
 	Events struct {
 		// PeriodicUpdateDuration is the interval at which to
 		// send periodic updates during processing.
 		PeriodicUpdateDuration time.Duration
 	}
+	// DeadLetter contains configuration for the dead-letter topic.
+	DeadLetter struct {
+		// Topic is the Kafka topic to which chunks that exhaust all
+		// webhook retries are sent. If empty, no dead letters are sent.
+		Topic string
+	}
+	// Journal contains configuration for the local journal of
+	// in-flight chunks.
+	Journal struct {
+		// Dir is the directory in which the journal is kept.
+		// If empty, no journal is kept.
+		Dir string
+	}
+	// Dedupe contains configuration for remembering completed chunks
+	// so redelivered chunks are not processed again.
+	Dedupe struct {
+		// Size is the number of completed chunks to remember.
+		// Zero disables deduplication.
+		Size int
+		// Dir is the directory in which completed chunks are kept so they
+		// are remembered after a restart. If empty, they are only
+		// kept in memory.
+		Dir string
+	}
 	// SelfDriving contains configuration related to running the engine in
 	// self driving mode, drawing input from a directory and writing output to another.
 	SelfDriving struct {
@@ -94,9 +300,288 @@ func NewConfig(engineInstanceId string, logFileName string, logWriter io.WriteCl
 	c.Webhooks.Ready.PollDuration = 1 * time.Second
 	c.Webhooks.Ready.MaximumPollDuration = 1 * time.Minute
 	c.Webhooks.Process.URL = os.Getenv("VERITONE_WEBHOOK_PROCESS")
+	c.GRPC.Address = os.Getenv("VERITONE_GRPC_ADDRESS")
+	c.Async.CallbackAddr = os.Getenv("VERITONE_ASYNC_CALLBACK_ADDR")
+	c.Async.Timeout = 30 * time.Minute
+	if timeoutStr := os.Getenv("VERITONE_ASYNC_TIMEOUT"); timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			log.Printf("VERITONE_ASYNC_TIMEOUT %q: %v", timeoutStr, err)
+		} else {
+			c.Async.Timeout = timeout
+		}
+	}
+	switch protocol := os.Getenv("VERITONE_SUBPROCESS_PROTOCOL"); protocol {
+	case "", "http":
+	case "stdio":
+		c.Stdio.Enabled = true
+	default:
+		log.Printf("VERITONE_SUBPROCESS_PROTOCOL %q: should be http or stdio", protocol)
+	}
 	c.Webhooks.Backoff.MaxRetries = 3
 	c.Webhooks.Backoff.InitialBackoffDuration = 100 * time.Millisecond
 	c.Webhooks.Backoff.MaxBackoffDuration = 1 * time.Second
+	c.KafkaSecurity.TLS.Enabled = os.Getenv("KAFKA_TLS") == "true"
+	c.KafkaSecurity.TLS.CAFile = os.Getenv("KAFKA_TLS_CA_FILE")
+	c.KafkaSecurity.TLS.CertFile = os.Getenv("KAFKA_TLS_CERT_FILE")
+	c.KafkaSecurity.TLS.KeyFile = os.Getenv("KAFKA_TLS_KEY_FILE")
+	c.KafkaSecurity.TLS.InsecureSkipVerify = os.Getenv("KAFKA_TLS_INSECURE_SKIP_VERIFY") == "true"
+	c.KafkaSecurity.SASL.Mechanism = os.Getenv("KAFKA_SASL_MECHANISM")
+	c.KafkaSecurity.SASL.Username = os.Getenv("KAFKA_SASL_USERNAME")
+	c.KafkaSecurity.SASL.Password = os.Getenv("KAFKA_SASL_PASSWORD")
+
+	c.Producer.Version = os.Getenv("KAFKA_VERSION")
+	c.Producer.RecordHeaders = os.Getenv("KAFKA_RECORD_HEADERS") == "true"
+	c.Producer.Compression = os.Getenv("KAFKA_PRODUCER_COMPRESSION")
+	c.Producer.RequiredAcks = os.Getenv("KAFKA_PRODUCER_ACKS")
+	if lingerStr := os.Getenv("KAFKA_PRODUCER_LINGER"); lingerStr != "" {
+		linger, err := time.ParseDuration(lingerStr)
+		if err != nil {
+			log.Printf("KAFKA_PRODUCER_LINGER %q: %v", lingerStr, err)
+		} else {
+			c.Producer.Linger = linger
+		}
+	}
+	if sizeStr := os.Getenv("KAFKA_PRODUCER_BATCH_SIZE"); sizeStr != "" {
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil {
+			log.Printf("KAFKA_PRODUCER_BATCH_SIZE %q: %v", sizeStr, err)
+		} else {
+			c.Producer.BatchSize = size
+		}
+	}
+
+	c.Finalize.URL = os.Getenv("VERITONE_WEBHOOK_FINALIZE")
+	c.AdaptiveConcurrency.Enabled = os.Getenv("VERITONE_ADAPTIVE_CONCURRENCY") == "true"
+	c.AdaptiveConcurrency.MinConcurrency = 1
+	c.AdaptiveConcurrency.LatencyTolerance = 2
+	c.AdaptiveConcurrency.MaxErrorRate = 0.1
+	if minStr := os.Getenv("VERITONE_ADAPTIVE_CONCURRENCY_MIN"); minStr != "" {
+		min, err := strconv.Atoi(minStr)
+		if err != nil {
+			log.Printf("VERITONE_ADAPTIVE_CONCURRENCY_MIN %q: %v", minStr, err)
+		} else {
+			c.AdaptiveConcurrency.MinConcurrency = min
+		}
+	}
+	if maxStr := os.Getenv("VERITONE_ADAPTIVE_CONCURRENCY_MAX"); maxStr != "" {
+		max, err := strconv.Atoi(maxStr)
+		if err != nil {
+			log.Printf("VERITONE_ADAPTIVE_CONCURRENCY_MAX %q: %v", maxStr, err)
+		} else {
+			c.AdaptiveConcurrency.MaxConcurrency = max
+		}
+	}
+	if toleranceStr := os.Getenv("VERITONE_ADAPTIVE_CONCURRENCY_LATENCY_TOLERANCE"); toleranceStr != "" {
+		tolerance, err := strconv.ParseFloat(toleranceStr, 64)
+		if err != nil {
+			log.Printf("VERITONE_ADAPTIVE_CONCURRENCY_LATENCY_TOLERANCE %q: %v", toleranceStr, err)
+		} else {
+			c.AdaptiveConcurrency.LatencyTolerance = tolerance
+		}
+	}
+	if rateStr := os.Getenv("VERITONE_ADAPTIVE_CONCURRENCY_MAX_ERROR_RATE"); rateStr != "" {
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil {
+			log.Printf("VERITONE_ADAPTIVE_CONCURRENCY_MAX_ERROR_RATE %q: %v", rateStr, err)
+		} else {
+			c.AdaptiveConcurrency.MaxErrorRate = rate
+		}
+	}
+	c.MediaCache.Dir = os.Getenv("VERITONE_CHUNK_CACHE_DIR")
+	c.MediaCache.DownloadAttempts = 3
+	c.MediaCache.IdleTimeout = 30 * time.Second
+	if maxStr := os.Getenv("VERITONE_CHUNK_CACHE_MAX_BYTES"); maxStr != "" {
+		max, err := strconv.ParseInt(maxStr, 10, 64)
+		if err != nil {
+			log.Printf("VERITONE_CHUNK_CACHE_MAX_BYTES %q: %v", maxStr, err)
+		} else {
+			c.MediaCache.MaxBytes = max
+		}
+	}
+	if attemptsStr := os.Getenv("VERITONE_DOWNLOAD_ATTEMPTS"); attemptsStr != "" {
+		attempts, err := strconv.Atoi(attemptsStr)
+		if err != nil {
+			log.Printf("VERITONE_DOWNLOAD_ATTEMPTS %q: %v", attemptsStr, err)
+		} else {
+			c.MediaCache.DownloadAttempts = attempts
+		}
+	}
+	if timeoutStr := os.Getenv("VERITONE_DOWNLOAD_IDLE_TIMEOUT"); timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			log.Printf("VERITONE_DOWNLOAD_IDLE_TIMEOUT %q: %v", timeoutStr, err)
+		} else {
+			c.MediaCache.IdleTimeout = timeout
+		}
+	}
+	c.Prefetch.Dir = os.Getenv("VERITONE_PREFETCH_DIR")
+	c.Prefetch.MaxBytes = 1 << 30
+	if countStr := os.Getenv("VERITONE_PREFETCH_CHUNKS"); countStr != "" {
+		count, err := strconv.Atoi(countStr)
+		if err != nil {
+			log.Printf("VERITONE_PREFETCH_CHUNKS %q: %v", countStr, err)
+		} else {
+			c.Prefetch.Count = count
+		}
+	}
+	if maxStr := os.Getenv("VERITONE_PREFETCH_MAX_BYTES"); maxStr != "" {
+		max, err := strconv.ParseInt(maxStr, 10, 64)
+		if err != nil {
+			log.Printf("VERITONE_PREFETCH_MAX_BYTES %q: %v", maxStr, err)
+		} else {
+			c.Prefetch.MaxBytes = max
+		}
+	}
+	if budgetStr := os.Getenv("VERITONE_MEMORY_BUDGET_BYTES"); budgetStr != "" {
+		budget, err := strconv.ParseInt(budgetStr, 10, 64)
+		if err != nil {
+			log.Printf("VERITONE_MEMORY_BUDGET_BYTES %q: %v", budgetStr, err)
+		} else {
+			c.Memory.BudgetBytes = budget
+		}
+	}
+	c.Memory.DefaultChunkBytes = 10 * 1024 * 1024
+	if defaultStr := os.Getenv("VERITONE_MEMORY_DEFAULT_CHUNK_BYTES"); defaultStr != "" {
+		size, err := strconv.ParseInt(defaultStr, 10, 64)
+		if err != nil {
+			log.Printf("VERITONE_MEMORY_DEFAULT_CHUNK_BYTES %q: %v", defaultStr, err)
+		} else {
+			c.Memory.DefaultChunkBytes = size
+		}
+	}
+	c.Fairness.Enabled = os.Getenv("VERITONE_TASK_FAIRNESS") == "true"
+	c.Fairness.MaxQueued = 1000
+	if maxStr := os.Getenv("VERITONE_TASK_MAX_CONCURRENCY"); maxStr != "" {
+		max, err := strconv.Atoi(maxStr)
+		if err != nil {
+			log.Printf("VERITONE_TASK_MAX_CONCURRENCY %q: %v", maxStr, err)
+		} else {
+			c.Fairness.MaxPerTask = max
+		}
+	}
+	if maxStr := os.Getenv("VERITONE_TASK_QUEUE_SIZE"); maxStr != "" {
+		max, err := strconv.Atoi(maxStr)
+		if err != nil {
+			log.Printf("VERITONE_TASK_QUEUE_SIZE %q: %v", maxStr, err)
+		} else {
+			c.Fairness.MaxQueued = max
+		}
+	}
+	c.Ordering.Enabled = os.Getenv("VERITONE_ORDERED_OUTPUT") == "true"
+	c.Ordering.Timeout = 30 * time.Second
+	c.Ordering.MaxBuffered = 100
+	if timeoutStr := os.Getenv("VERITONE_ORDERED_OUTPUT_TIMEOUT"); timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			log.Printf("VERITONE_ORDERED_OUTPUT_TIMEOUT %q: %v", timeoutStr, err)
+		} else {
+			c.Ordering.Timeout = timeout
+		}
+	}
+	if maxStr := os.Getenv("VERITONE_ORDERED_OUTPUT_MAX_BUFFERED"); maxStr != "" {
+		max, err := strconv.Atoi(maxStr)
+		if err != nil {
+			log.Printf("VERITONE_ORDERED_OUTPUT_MAX_BUFFERED %q: %v", maxStr, err)
+		} else {
+			c.Ordering.MaxBuffered = max
+		}
+	}
+	// leave headroom under the default Kafka max message size (1MB)
+	// for the rest of the message.
+	c.Output.MaxContentBytes = 900 * 1024
+	if maxStr := os.Getenv("VERITONE_MAX_OUTPUT_BYTES"); maxStr != "" {
+		max, err := strconv.Atoi(maxStr)
+		if err != nil {
+			log.Printf("VERITONE_MAX_OUTPUT_BYTES %q: %v", maxStr, err)
+		} else {
+			c.Output.MaxContentBytes = max
+		}
+	}
+	c.Output.Offload = os.Getenv("VERITONE_OFFLOAD_LARGE_OUTPUT") == "true"
+	c.Output.MaxStreamedBytes = 100 * 1024 * 1024
+	if maxStr := os.Getenv("VERITONE_MAX_STREAMED_OUTPUT_BYTES"); maxStr != "" {
+		max, err := strconv.Atoi(maxStr)
+		if err != nil {
+			log.Printf("VERITONE_MAX_STREAMED_OUTPUT_BYTES %q: %v", maxStr, err)
+		} else {
+			c.Output.MaxStreamedBytes = max
+		}
+	}
+	if intervalStr := os.Getenv("VERITONE_INTERIM_OUTPUT_INTERVAL"); intervalStr != "" {
+		interval, err := time.ParseDuration(intervalStr)
+		if err != nil {
+			log.Printf("VERITONE_INTERIM_OUTPUT_INTERVAL %q: %v", intervalStr, err)
+		} else {
+			c.Output.InterimInterval = interval
+		}
+	}
+	if sizeStr := os.Getenv("VERITONE_DEDUPE_CACHE_SIZE"); sizeStr != "" {
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil {
+			log.Printf("VERITONE_DEDUPE_CACHE_SIZE %q: %v", sizeStr, err)
+		} else {
+			c.Dedupe.Size = size
+		}
+	}
+	c.Dedupe.Dir = os.Getenv("VERITONE_DEDUPE_DIR")
+	c.Batch.Wait = 100 * time.Millisecond
+	if sizeStr := os.Getenv("VERITONE_BATCH_SIZE"); sizeStr != "" {
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil {
+			log.Printf("VERITONE_BATCH_SIZE %q: %v", sizeStr, err)
+		} else {
+			c.Batch.Size = size
+		}
+	}
+	if waitStr := os.Getenv("VERITONE_BATCH_WAIT_MS"); waitStr != "" {
+		waitMS, err := strconv.Atoi(waitStr)
+		if err != nil {
+			log.Printf("VERITONE_BATCH_WAIT_MS %q: %v", waitStr, err)
+		} else {
+			c.Batch.Wait = time.Duration(waitMS) * time.Millisecond
+		}
+	}
+	c.Retry.NonRetryableStatusCodes = []int{http.StatusBadRequest}
+	c.Retry.MaxThrottledRetries = 10
+	c.Retry.MaxThrottleDuration = 1 * time.Minute
+	if codes := os.Getenv("VERITONE_WEBHOOK_RETRY_STATUS_CODES"); codes != "" {
+		var err error
+		c.Retry.RetryableStatusCodes, err = parseStatusCodes(codes)
+		if err != nil {
+			log.Printf("VERITONE_WEBHOOK_RETRY_STATUS_CODES %q: %v", codes, err)
+		}
+	}
+	if codes := os.Getenv("VERITONE_WEBHOOK_NO_RETRY_STATUS_CODES"); codes != "" {
+		var err error
+		c.Retry.NonRetryableStatusCodes, err = parseStatusCodes(codes)
+		if err != nil {
+			log.Printf("VERITONE_WEBHOOK_NO_RETRY_STATUS_CODES %q: %v", codes, err)
+		}
+	}
+	if maxStr := os.Getenv("VERITONE_WEBHOOK_MAX_THROTTLED_RETRIES"); maxStr != "" {
+		max, err := strconv.Atoi(maxStr)
+		if err != nil {
+			log.Printf("VERITONE_WEBHOOK_MAX_THROTTLED_RETRIES %q: %v", maxStr, err)
+		} else {
+			c.Retry.MaxThrottledRetries = max
+		}
+	}
+	if maxStr := os.Getenv("VERITONE_WEBHOOK_MAX_THROTTLE_DURATION"); maxStr != "" {
+		max, err := time.ParseDuration(maxStr)
+		if err != nil {
+			log.Printf("VERITONE_WEBHOOK_MAX_THROTTLE_DURATION %q: %v", maxStr, err)
+		} else {
+			c.Retry.MaxThrottleDuration = max
+		}
+	}
+	if timeout := os.Getenv("VERITONE_CHUNK_TIMEOUT"); timeout != "" {
+		var err error
+		c.Chunk.Timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			log.Printf("VERITONE_CHUNK_TIMEOUT %q: %v", timeout, err)
+		}
+	}
 
 	// veritone platform configuration
 	if endSecs := os.Getenv("END_IF_IDLE_SECS"); endSecs != "" {
@@ -113,12 +598,25 @@ func NewConfig(engineInstanceId string, logFileName string, logWriter io.WriteCl
 	c.Kafka.Brokers = strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
 	c.Kafka.ConsumerGroup = os.Getenv("KAFKA_CONSUMER_GROUP")
 	c.Kafka.InputTopic = os.Getenv("KAFKA_INPUT_TOPIC")
+	if topicsStr := os.Getenv("KAFKA_INPUT_TOPICS"); topicsStr != "" {
+		topics, err := parseInputTopics(topicsStr)
+		if err != nil {
+			log.Printf("KAFKA_INPUT_TOPICS %q: %v", topicsStr, err)
+		} else {
+			c.Inputs.Topics = topics
+		}
+	}
+	c.Inputs.Strict = os.Getenv("VERITONE_INPUT_PRIORITY") == "strict"
 	c.Kafka.ChunkTopic = os.Getenv("KAFKA_CHUNK_TOPIC")
+	c.DeadLetter.Topic = os.Getenv("KAFKA_DLQ_TOPIC")
 
 	// fixed parameters for event info
 	c.Kafka.EventTopic = "events"
 	c.Events.PeriodicUpdateDuration = 1 * time.Minute
 
+	// journal of in-flight chunks
+	c.Journal.Dir = os.Getenv("VERITONE_JOURNAL_DIR")
+
 	// self driving mode
 	c.SelfDriving.SelfDrivingMode = os.Getenv("VERITONE_SELFDRIVING") == "true"
 	c.SelfDriving.WaitForReadyFiles = os.Getenv("VERITONE_SELFDRIVING_WAITREADYFILES") == "true"
@@ -153,6 +651,8 @@ func NewConfig(engineInstanceId string, logFileName string, logWriter io.WriteCl
 		// with the exception of kafka brokers we want to pick up AIWARE_KAFKA_BROKERS
 
 		c.ControllerConfig.Kafka.Brokers = strings.Split(os.Getenv("AIWARE_KAFKA_BROKERS"), ",")
+		// note: processing.Kafka has no TLS or SASL settings, so
+		// KafkaSecurity cannot be passed on to the controller.
 
 		c.ControllerConfig.Webhooks = c.Webhooks
 		c.ControllerConfig.ProcessingOptions = c.Processing
@@ -18,6 +18,8 @@ func TestNewConfig(t *testing.T) {
 	os.Setenv("KAFKA_BROKERS", "0.0.0.0:9092,1.1.1.1:9092")
 	os.Setenv("KAFKA_INPUT_TOPIC", "input-topic")
 	os.Setenv("KAFKA_CONSUMER_GROUP", "consumer-group")
+	os.Setenv("KAFKA_DLQ_TOPIC", "dlq-topic")
+	defer os.Setenv("KAFKA_DLQ_TOPIC", "")
 	os.Setenv("END_IF_IDLE_SECS", "60")
 	os.Setenv("VERITONE_CONCURRENT_TASKS", "10")
 
@@ -31,17 +33,147 @@ func TestNewConfig(t *testing.T) {
 	os.Setenv("VERITONE_SELFDRIVING_OUTPUT_DIR_PATTERN", "yyyy/mm/dd")
 	os.Setenv("VERITONE_SELFDRIVING_WAITREADYFILES", "true")
 	os.Setenv("VERITONE_DISABLE_CHUNK_DOWNLOAD", "true")
+	os.Setenv("VERITONE_CHUNK_TIMEOUT", "2m")
+	defer os.Setenv("VERITONE_CHUNK_TIMEOUT", "")
+	os.Setenv("VERITONE_JOURNAL_DIR", "/cache/journal")
+	defer os.Setenv("VERITONE_JOURNAL_DIR", "")
+	os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY", "true")
+	defer os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY", "")
+	os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY_MIN", "2")
+	defer os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY_MIN", "")
+	os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY_MAX", "20")
+	defer os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY_MAX", "")
+	os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY_LATENCY_TOLERANCE", "1.5")
+	defer os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY_LATENCY_TOLERANCE", "")
+	os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY_MAX_ERROR_RATE", "0.25")
+	defer os.Setenv("VERITONE_ADAPTIVE_CONCURRENCY_MAX_ERROR_RATE", "")
+	os.Setenv("VERITONE_WEBHOOK_FINALIZE", "http://0.0.0.0:8080/finalize")
+	defer os.Setenv("VERITONE_WEBHOOK_FINALIZE", "")
+	os.Setenv("VERITONE_GRPC_ADDRESS", "localhost:50051")
+	defer os.Setenv("VERITONE_GRPC_ADDRESS", "")
+	os.Setenv("VERITONE_ASYNC_CALLBACK_ADDR", "127.0.0.1:9091")
+	defer os.Setenv("VERITONE_ASYNC_CALLBACK_ADDR", "")
+	os.Setenv("VERITONE_ASYNC_TIMEOUT", "5m")
+	defer os.Setenv("VERITONE_ASYNC_TIMEOUT", "")
+	os.Setenv("VERITONE_SUBPROCESS_PROTOCOL", "stdio")
+	defer os.Setenv("VERITONE_SUBPROCESS_PROTOCOL", "")
+	os.Setenv("KAFKA_VERSION", "2.1.0")
+	defer os.Setenv("KAFKA_VERSION", "")
+	os.Setenv("KAFKA_RECORD_HEADERS", "true")
+	defer os.Setenv("KAFKA_RECORD_HEADERS", "")
+	os.Setenv("KAFKA_PRODUCER_COMPRESSION", "snappy")
+	defer os.Setenv("KAFKA_PRODUCER_COMPRESSION", "")
+	os.Setenv("KAFKA_PRODUCER_LINGER", "5ms")
+	defer os.Setenv("KAFKA_PRODUCER_LINGER", "")
+	os.Setenv("KAFKA_PRODUCER_BATCH_SIZE", "65536")
+	defer os.Setenv("KAFKA_PRODUCER_BATCH_SIZE", "")
+	os.Setenv("KAFKA_PRODUCER_ACKS", "1")
+	defer os.Setenv("KAFKA_PRODUCER_ACKS", "")
+	os.Setenv("KAFKA_TLS", "true")
+	defer os.Setenv("KAFKA_TLS", "")
+	os.Setenv("KAFKA_TLS_CA_FILE", "/certs/ca.pem")
+	defer os.Setenv("KAFKA_TLS_CA_FILE", "")
+	os.Setenv("KAFKA_TLS_CERT_FILE", "/certs/client.pem")
+	defer os.Setenv("KAFKA_TLS_CERT_FILE", "")
+	os.Setenv("KAFKA_TLS_KEY_FILE", "/certs/client.key")
+	defer os.Setenv("KAFKA_TLS_KEY_FILE", "")
+	os.Setenv("KAFKA_SASL_MECHANISM", "SCRAM-SHA-256")
+	defer os.Setenv("KAFKA_SASL_MECHANISM", "")
+	os.Setenv("KAFKA_SASL_USERNAME", "user")
+	defer os.Setenv("KAFKA_SASL_USERNAME", "")
+	os.Setenv("KAFKA_SASL_PASSWORD", "secret")
+	defer os.Setenv("KAFKA_SASL_PASSWORD", "")
+	os.Setenv("VERITONE_CHUNK_CACHE_MAX_BYTES", "2097152")
+	defer os.Setenv("VERITONE_CHUNK_CACHE_MAX_BYTES", "")
+	os.Setenv("VERITONE_CHUNK_CACHE_DIR", "/tmp/chunks")
+	defer os.Setenv("VERITONE_CHUNK_CACHE_DIR", "")
+	os.Setenv("VERITONE_DOWNLOAD_ATTEMPTS", "5")
+	defer os.Setenv("VERITONE_DOWNLOAD_ATTEMPTS", "")
+	os.Setenv("VERITONE_DOWNLOAD_IDLE_TIMEOUT", "10s")
+	defer os.Setenv("VERITONE_DOWNLOAD_IDLE_TIMEOUT", "")
+	os.Setenv("VERITONE_PREFETCH_CHUNKS", "4")
+	defer os.Setenv("VERITONE_PREFETCH_CHUNKS", "")
+	os.Setenv("VERITONE_PREFETCH_DIR", "/tmp/prefetch")
+	defer os.Setenv("VERITONE_PREFETCH_DIR", "")
+	os.Setenv("VERITONE_PREFETCH_MAX_BYTES", "1048576")
+	defer os.Setenv("VERITONE_PREFETCH_MAX_BYTES", "")
+	os.Setenv("VERITONE_MEMORY_BUDGET_BYTES", "1073741824")
+	defer os.Setenv("VERITONE_MEMORY_BUDGET_BYTES", "")
+	os.Setenv("VERITONE_MEMORY_DEFAULT_CHUNK_BYTES", "1048576")
+	defer os.Setenv("VERITONE_MEMORY_DEFAULT_CHUNK_BYTES", "")
+	os.Setenv("VERITONE_TASK_FAIRNESS", "true")
+	defer os.Setenv("VERITONE_TASK_FAIRNESS", "")
+	os.Setenv("VERITONE_TASK_MAX_CONCURRENCY", "2")
+	defer os.Setenv("VERITONE_TASK_MAX_CONCURRENCY", "")
+	os.Setenv("VERITONE_TASK_QUEUE_SIZE", "50")
+	defer os.Setenv("VERITONE_TASK_QUEUE_SIZE", "")
+	os.Setenv("KAFKA_INPUT_TOPICS", "priority-topic=3, bulk-topic")
+	defer os.Setenv("KAFKA_INPUT_TOPICS", "")
+	os.Setenv("VERITONE_INPUT_PRIORITY", "strict")
+	defer os.Setenv("VERITONE_INPUT_PRIORITY", "")
+	os.Setenv("VERITONE_ORDERED_OUTPUT", "true")
+	defer os.Setenv("VERITONE_ORDERED_OUTPUT", "")
+	os.Setenv("VERITONE_ORDERED_OUTPUT_TIMEOUT", "10s")
+	defer os.Setenv("VERITONE_ORDERED_OUTPUT_TIMEOUT", "")
+	os.Setenv("VERITONE_ORDERED_OUTPUT_MAX_BUFFERED", "20")
+	defer os.Setenv("VERITONE_ORDERED_OUTPUT_MAX_BUFFERED", "")
+	os.Setenv("VERITONE_MAX_OUTPUT_BYTES", "2048")
+	defer os.Setenv("VERITONE_MAX_OUTPUT_BYTES", "")
+	os.Setenv("VERITONE_MAX_STREAMED_OUTPUT_BYTES", "4096")
+	defer os.Setenv("VERITONE_MAX_STREAMED_OUTPUT_BYTES", "")
+	os.Setenv("VERITONE_INTERIM_OUTPUT_INTERVAL", "500ms")
+	defer os.Setenv("VERITONE_INTERIM_OUTPUT_INTERVAL", "")
+	os.Setenv("VERITONE_OFFLOAD_LARGE_OUTPUT", "true")
+	defer os.Setenv("VERITONE_OFFLOAD_LARGE_OUTPUT", "")
+	os.Setenv("VERITONE_DEDUPE_CACHE_SIZE", "500")
+	defer os.Setenv("VERITONE_DEDUPE_CACHE_SIZE", "")
+	os.Setenv("VERITONE_DEDUPE_DIR", "/cache/dedupe")
+	defer os.Setenv("VERITONE_DEDUPE_DIR", "")
+	os.Setenv("VERITONE_BATCH_SIZE", "16")
+	defer os.Setenv("VERITONE_BATCH_SIZE", "")
+	os.Setenv("VERITONE_BATCH_WAIT_MS", "250")
+	defer os.Setenv("VERITONE_BATCH_WAIT_MS", "")
+	os.Setenv("VERITONE_WEBHOOK_RETRY_STATUS_CODES", "500, 502")
+	defer os.Setenv("VERITONE_WEBHOOK_RETRY_STATUS_CODES", "")
+	os.Setenv("VERITONE_WEBHOOK_NO_RETRY_STATUS_CODES", "400,422")
+	defer os.Setenv("VERITONE_WEBHOOK_NO_RETRY_STATUS_CODES", "")
+	os.Setenv("VERITONE_WEBHOOK_MAX_THROTTLED_RETRIES", "5")
+	defer os.Setenv("VERITONE_WEBHOOK_MAX_THROTTLED_RETRIES", "")
+	os.Setenv("VERITONE_WEBHOOK_MAX_THROTTLE_DURATION", "30s")
+	defer os.Setenv("VERITONE_WEBHOOK_MAX_THROTTLE_DURATION", "")
 
-	config := NewConfig()
+	config := NewConfig("instance1", "", nil, nil)
 	is.Equal(config.Processing.DisableChunkDownload, true)
 	is.Equal(config.Webhooks.Ready.URL, "http://0.0.0.0:8080/readyz")
 	is.Equal(config.Webhooks.Process.URL, "http://0.0.0.0:8080/process")
+	is.Equal(config.Finalize.URL, "http://0.0.0.0:8080/finalize")
+	is.Equal(config.GRPC.Address, "localhost:50051")
+	is.Equal(config.Async.CallbackAddr, "127.0.0.1:9091")
+	is.Equal(config.Async.Timeout, 5*time.Minute)
+	is.Equal(config.Stdio.Enabled, true)
 	is.Equal(len(config.Kafka.Brokers), 2)
 	is.Equal(config.Kafka.Brokers[0], "0.0.0.0:9092")
 	is.Equal(config.Kafka.Brokers[1], "1.1.1.1:9092")
 	is.Equal(config.Kafka.ConsumerGroup, "consumer-group")
 	is.Equal(config.Kafka.InputTopic, "input-topic")
 	is.Equal(config.Kafka.EventTopic, "events")
+	is.Equal(config.Inputs.Topics, []inputTopic{{Topic: "priority-topic", Weight: 3}, {Topic: "bulk-topic", Weight: 1}})
+	is.Equal(config.Inputs.Strict, true)
+	is.Equal(config.DeadLetter.Topic, "dlq-topic")
+	is.Equal(config.Producer.Version, "2.1.0")
+	is.Equal(config.Producer.RecordHeaders, true)
+	is.Equal(config.Producer.Compression, "snappy")
+	is.Equal(config.Producer.Linger, 5*time.Millisecond)
+	is.Equal(config.Producer.BatchSize, 65536)
+	is.Equal(config.Producer.RequiredAcks, "1")
+	is.Equal(config.KafkaSecurity.TLS.Enabled, true)
+	is.Equal(config.KafkaSecurity.TLS.CAFile, "/certs/ca.pem")
+	is.Equal(config.KafkaSecurity.TLS.CertFile, "/certs/client.pem")
+	is.Equal(config.KafkaSecurity.TLS.KeyFile, "/certs/client.key")
+	is.Equal(config.KafkaSecurity.TLS.InsecureSkipVerify, false)
+	is.Equal(config.KafkaSecurity.SASL.Mechanism, "SCRAM-SHA-256")
+	is.Equal(config.KafkaSecurity.SASL.Username, "user")
+	is.Equal(config.KafkaSecurity.SASL.Password, "secret")
 
 	is.Equal(config.Engine.ID, "engine1")
 	is.Equal(config.Engine.InstanceID, "instance1")
@@ -57,9 +189,59 @@ func TestNewConfig(t *testing.T) {
 	is.Equal(config.Webhooks.Backoff.InitialBackoffDuration, 100*time.Millisecond)
 	is.Equal(config.Webhooks.Backoff.MaxBackoffDuration, 1*time.Second)
 
+	// adaptive concurrency
+	is.Equal(config.AdaptiveConcurrency.Enabled, true)
+	is.Equal(config.AdaptiveConcurrency.MinConcurrency, 2)
+	is.Equal(config.AdaptiveConcurrency.MaxConcurrency, 20)
+	is.Equal(config.AdaptiveConcurrency.LatencyTolerance, 1.5)
+	is.Equal(config.AdaptiveConcurrency.MaxErrorRate, 0.25)
+
+	// ordering
+	is.Equal(config.MediaCache.MaxBytes, int64(2097152))
+	is.Equal(config.MediaCache.Dir, "/tmp/chunks")
+	is.Equal(config.MediaCache.DownloadAttempts, 5)
+	is.Equal(config.MediaCache.IdleTimeout, 10*time.Second)
+	is.Equal(config.Prefetch.Count, 4)
+	is.Equal(config.Prefetch.Dir, "/tmp/prefetch")
+	is.Equal(config.Prefetch.MaxBytes, int64(1048576))
+	is.Equal(config.Memory.BudgetBytes, int64(1073741824))
+	is.Equal(config.Memory.DefaultChunkBytes, int64(1048576))
+	is.Equal(config.Fairness.Enabled, true)
+	is.Equal(config.Fairness.MaxPerTask, 2)
+	is.Equal(config.Fairness.MaxQueued, 50)
+	is.Equal(config.Ordering.Enabled, true)
+	is.Equal(config.Ordering.Timeout, 10*time.Second)
+	is.Equal(config.Ordering.MaxBuffered, 20)
+
+	// output
+	is.Equal(config.Output.MaxContentBytes, 2048)
+	is.Equal(config.Output.MaxStreamedBytes, 4096)
+	is.Equal(config.Output.InterimInterval, 500*time.Millisecond)
+	is.Equal(config.Output.Offload, true)
+
+	// dedupe
+	is.Equal(config.Dedupe.Size, 500)
+	is.Equal(config.Dedupe.Dir, "/cache/dedupe")
+
+	// batch
+	is.Equal(config.Batch.Size, 16)
+	is.Equal(config.Batch.Wait, 250*time.Millisecond)
+
+	// retry
+	is.Equal(config.Retry.RetryableStatusCodes, []int{500, 502})
+	is.Equal(config.Retry.NonRetryableStatusCodes, []int{400, 422})
+	is.Equal(config.Retry.MaxThrottledRetries, 5)
+	is.Equal(config.Retry.MaxThrottleDuration, 30*time.Second)
+
+	// chunk
+	is.Equal(config.Chunk.Timeout, 2*time.Minute)
+
 	// events
 	is.Equal(config.Events.PeriodicUpdateDuration, 1*time.Minute)
 
+	// journal
+	is.Equal(config.Journal.Dir, "/cache/journal")
+
 	// self driving
 	is.Equal(config.SelfDriving.SelfDrivingMode, true)
 	is.Equal(config.SelfDriving.PollInterval, 5*time.Minute)
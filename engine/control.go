@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// Control message types.
+const (
+	// messageTypeChunkEOF is sent after the last chunk of a task.
+	messageTypeChunkEOF processing.MessageType = "chunk_eof"
+	// messageTypeTaskCancel is sent when a task is cancelled.
+	messageTypeTaskCancel processing.MessageType = "task_cancel"
+)
+
+// cancelledTaskExpiry is how long a cancelled task is remembered if
+// the end of the task never arrives.
+const cancelledTaskExpiry = 1 * time.Hour
+
+// controlMessage is a message about the lifecycle of a task.
+type controlMessage struct {
+	Type         processing.MessageType `json:"type"`
+	TimestampUTC int64                  `json:"timestampUTC,omitempty"`
+	TaskID       string                 `json:"taskId"`
+	JobID        string                 `json:"jobId,omitempty"`
+	TDOID        string                 `json:"tdoId,omitempty"`
+}
+
+// taskCancels keeps track of the in-flight chunks for each task so
+// they can be aborted if the task is cancelled, and so the end of the
+// task can wait for them.
+// A nil *taskCancels is valid and tracks nothing.
+type taskCancels struct {
+	lock     sync.Mutex
+	next     int
+	inFlight map[string]map[int]context.CancelFunc
+	// cancelled holds when each task was cancelled.
+	cancelled map[string]time.Time
+	// pending counts the chunks of each task that have been consumed
+	// but not finished.
+	pending map[string]int
+	// drained has a channel for each task that is being waited for,
+	// which is closed when it has no pending chunks.
+	drained map[string]chan struct{}
+}
+
+// newTaskCancels makes a new taskCancels.
+func newTaskCancels() *taskCancels {
+	return &taskCancels{
+		inFlight:  make(map[string]map[int]context.CancelFunc),
+		cancelled: make(map[string]time.Time),
+		pending:   make(map[string]int),
+		drained:   make(map[string]chan struct{}),
+	}
+}
+
+// chunkTaskID gets the task ID of a media chunk message, or false if
+// the message isn't a media chunk.
+func chunkTaskID(msg *sarama.ConsumerMessage) (string, bool) {
+	var typeCheck struct {
+		Type   processing.MessageType `json:"type"`
+		TaskID string                 `json:"taskId"`
+	}
+	if err := json.Unmarshal(msg.Value, &typeCheck); err != nil {
+		return "", false
+	}
+	return typeCheck.TaskID, typeCheck.Type == processing.MessageTypeMediaChunk
+}
+
+// isControlMessage gets whether the message is a task lifecycle
+// message.
+func isControlMessage(msg *sarama.ConsumerMessage) bool {
+	var typeCheck struct {
+		Type processing.MessageType `json:"type"`
+	}
+	if err := json.Unmarshal(msg.Value, &typeCheck); err != nil {
+		return false
+	}
+	return typeCheck.Type == messageTypeChunkEOF || typeCheck.Type == messageTypeTaskCancel
+}
+
+// consumed counts the message as pending until finished is called,
+// if it is a media chunk.
+func (t *taskCancels) consumed(msg *sarama.ConsumerMessage) {
+	if t == nil {
+		return
+	}
+	taskID, ok := chunkTaskID(msg)
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending[taskID]++
+}
+
+// finished stops counting the message as pending.
+func (t *taskCancels) finished(msg *sarama.ConsumerMessage) {
+	if t == nil {
+		return
+	}
+	taskID, ok := chunkTaskID(msg)
+	if !ok {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pending[taskID]--
+	if t.pending[taskID] > 0 {
+		return
+	}
+	delete(t.pending, taskID)
+	if drained, ok := t.drained[taskID]; ok {
+		close(drained)
+		delete(t.drained, taskID)
+	}
+}
+
+// waitForChunks waits until every consumed chunk of the task has
+// finished, or the context is done.
+func (t *taskCancels) waitForChunks(ctx context.Context, taskID string) error {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	if t.pending[taskID] == 0 {
+		t.lock.Unlock()
+		return nil
+	}
+	drained, ok := t.drained[taskID]
+	if !ok {
+		drained = make(chan struct{})
+		t.drained[taskID] = drained
+	}
+	t.lock.Unlock()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track makes a context for processing a chunk of the task that
+// is cancelled if the task is cancelled.
+// The returned func must be called when the chunk is finished.
+func (t *taskCancels) track(ctx context.Context, taskID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	if t == nil {
+		return ctx, cancel
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	id := t.next
+	t.next++
+	if t.inFlight[taskID] == nil {
+		t.inFlight[taskID] = make(map[int]context.CancelFunc)
+	}
+	t.inFlight[taskID][id] = cancel
+	return ctx, func() {
+		cancel()
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.inFlight[taskID], id)
+		if len(t.inFlight[taskID]) == 0 {
+			delete(t.inFlight, taskID)
+		}
+	}
+}
+
+// cancel aborts the in-flight chunks for the task, and remembers
+// that it was cancelled until the end of the task, or for
+// cancelledTaskExpiry.
+// Returns the number of chunks aborted.
+func (t *taskCancels) cancel(taskID string) int {
+	if t == nil {
+		return 0
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	for id, cancelled := range t.cancelled {
+		if now.Sub(cancelled) > cancelledTaskExpiry {
+			delete(t.cancelled, id)
+		}
+	}
+	t.cancelled[taskID] = now
+	for _, cancel := range t.inFlight[taskID] {
+		cancel()
+	}
+	return len(t.inFlight[taskID])
+}
+
+// isCancelled gets whether the task has been cancelled.
+func (t *taskCancels) isCancelled(taskID string) bool {
+	if t == nil {
+		return false
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	cancelled, ok := t.cancelled[taskID]
+	return ok && time.Since(cancelled) <= cancelledTaskExpiry
+}
+
+// forget forgets that the task was cancelled.
+func (t *taskCancels) forget(taskID string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.cancelled, taskID)
+}
+
+// processMessageControl handles task lifecycle messages.
+// The end of a task is only finalized once its chunks have finished.
+// Finalizing is retried like the Process webhook; if it still fails,
+// the message is sent to the dead-letter topic. If the engine shuts
+// down first, an abandonedError is returned.
+func (e *Engine) processMessageControl(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	var control controlMessage
+	if err := json.Unmarshal(msg.Value, &control); err != nil {
+		return errors.Wrap(err, "unmarshal message value JSON")
+	}
+	switch control.Type {
+	case messageTypeTaskCancel:
+		n := e.tasks.cancel(control.TaskID)
+		e.logDebug(fmt.Sprintf("task %s cancelled, aborted %d chunk(s)", control.TaskID, n))
+	case messageTypeChunkEOF:
+		e.tasks.forget(control.TaskID)
+		if err := e.tasks.waitForChunks(ctx, control.TaskID); err != nil {
+			return abandonedError{err: errors.Wrap(err, "wait for chunks")}
+		}
+		retry := e.newRetryPolicy()
+		var attempts []webhookAttempt
+		for {
+			start := time.Now()
+			err := e.finalizeTask(ctx, msg, control)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				return abandonedError{err: errors.Wrap(err, "finalize")}
+			}
+			attempt := webhookAttempt{
+				StartedUTC: start.UTC().UnixNano() / 1e6,
+				DurationMS: int64(time.Since(start) / time.Millisecond),
+				Error:      err.Error(),
+			}
+			if ce, ok := causeChunkError(err); ok {
+				attempt.StatusCode = ce.statusCode
+			}
+			attempts = append(attempts, attempt)
+			delay, _, ok := retry.next(err)
+			if !ok {
+				e.logDebug("WARN", fmt.Sprintf("giving up finalizing task %s after %d attempt(s): %v", control.TaskID, len(attempts), err))
+				e.sendDeadLetter(msg, attempts, err)
+				return nil
+			}
+			e.logDebug("WARN", fmt.Sprintf("failed to finalize task %s (retrying in %s): %v", control.TaskID, delay, err))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return abandonedError{err: errors.Wrap(err, "finalize")}
+			}
+		}
+	}
+	return nil
+}
+
+// finalizeTask calls the Finalize webhook (if configured), or Finalize
+// over gRPC, to let the engine know there are no more chunks for the
+// task.
+// Any output from the engine is sent as a ChunkResult.
+func (e *Engine) finalizeTask(ctx context.Context, msg *sarama.ConsumerMessage, control controlMessage) error {
+	var body []byte
+	if e.rpc != nil {
+		content, err := e.rpc.finalize(ctx, control)
+		if err != nil {
+			return err
+		}
+		body = []byte(content)
+	} else if e.Config.Finalize.URL != "" {
+		var err error
+		body, err = e.callFinalizeWebhook(ctx, control)
+		if err != nil {
+			return err
+		}
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		// nothing more to output
+		return nil
+	}
+	outputMessage := processing.MediaChunkMessage{
+		Type:         processing.MessageTypeEngineOutput,
+		TaskID:       control.TaskID,
+		JobID:        control.JobID,
+		TimestampUTC: time.Now().Unix(),
+		Content:      string(body),
+	}
+	return e.sendChunkResult(ctx, msg.Key, messageTraceID(msg, control.TaskID), chunkResult{
+		ChunkResult: processing.ChunkResult{
+			Type:         processing.MessageTypeChunkResult,
+			TaskID:       control.TaskID,
+			Status:       processing.ChunkStatusSuccess,
+			EngineOutput: &outputMessage,
+		},
+	})
+}
+
+// callFinalizeWebhook calls the Finalize webhook for the task, and
+// gets the response body.
+func (e *Engine) callFinalizeWebhook(ctx context.Context, control controlMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("taskId", control.TaskID)
+	w.WriteField("jobId", control.JobID)
+	w.WriteField("tdoId", control.TDOID)
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.Config.Finalize.URL, &buf)
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	resp, err := e.webhookClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "read response body")
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return nil, newWebhookError(resp.StatusCode, resp.Header, body)
+	}
+	return body, nil
+}
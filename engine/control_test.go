@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestTaskCancels(t *testing.T) {
+	is := is.New(t)
+	tasks := newTaskCancels()
+	ctx := context.Background()
+	ctx1, done1 := tasks.track(ctx, "task1")
+	ctx2, done2 := tasks.track(ctx, "task2")
+	defer done2()
+	is.Equal(tasks.isCancelled("task1"), false)
+	is.Equal(tasks.cancel("task1"), 1)
+	is.True(ctx1.Err() != nil)
+	is.NoErr(ctx2.Err()) // other tasks are unaffected
+	is.Equal(tasks.isCancelled("task1"), true)
+	is.Equal(tasks.isCancelled("task2"), false)
+	done1()
+	is.Equal(len(tasks.inFlight["task1"]), 0)
+	tasks.forget("task1")
+	is.Equal(tasks.isCancelled("task1"), false)
+
+	// cancelled tasks are forgotten eventually, even without an end
+	tasks.cancel("task3")
+	tasks.cancelled["task3"] = time.Now().Add(-cancelledTaskExpiry - time.Minute)
+	is.Equal(tasks.isCancelled("task3"), false)
+	tasks.cancel("task4")
+	is.Equal(len(tasks.cancelled), 1) // task3 was removed
+
+	// nil is fine
+	var nilTasks *taskCancels
+	ctx3, done3 := nilTasks.track(ctx, "task1")
+	is.Equal(nilTasks.cancel("task1"), 0)
+	is.NoErr(ctx3.Err())
+	done3()
+	is.Equal(nilTasks.isCancelled("task1"), false)
+}
+
+func TestTaskCancelsWaitForChunks(t *testing.T) {
+	is := is.New(t)
+	tasks := newTaskCancels()
+	chunk := &sarama.ConsumerMessage{Value: []byte(`{"type":"media_chunk","taskId":"task1"}`)}
+	eof := &sarama.ConsumerMessage{Value: []byte(`{"type":"chunk_eof","taskId":"task1"}`)}
+	tasks.consumed(chunk)
+	tasks.consumed(eof) // not a chunk
+
+	is.NoErr(tasks.waitForChunks(context.Background(), "task2")) // nothing pending
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	is.Equal(tasks.waitForChunks(ctx, "task1"), context.DeadlineExceeded)
+
+	waited := make(chan error)
+	go func() {
+		waited <- tasks.waitForChunks(context.Background(), "task1")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	tasks.finished(chunk)
+	select {
+	case err := <-waited:
+		is.NoErr(err)
+	case <-time.After(1 * time.Second):
+		is.Fail() // still waiting after the chunk finished
+	}
+	is.Equal(len(tasks.pending), 0)
+	is.Equal(len(tasks.drained), 0)
+}
+
+// newControlTestEngine makes an Engine with pipes for testing
+// control messages.
+func newControlTestEngine(processURL string) (*Engine, *processing.Pipe, *processing.Pipe) {
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Processing.Concurrency = 2
+	engine.Config.Webhooks.Process.URL = processURL
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	outputPipe := processing.NewPipe()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	return engine, inputPipe, outputPipe
+}
+
+func TestProcessingTaskCancel(t *testing.T) {
+	is := is.New(t)
+	started := make(chan struct{})
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer processSrv.Close()
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine, inputPipe, outputPipe := newControlTestEngine(processSrv.URL)
+	defer inputPipe.Close()
+	defer outputPipe.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder("task1"),
+		Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+			Type:      processing.MessageTypeMediaChunk,
+			TaskID:    "task1",
+			ChunkUUID: "chunk1",
+		}),
+	})
+	is.NoErr(err)
+	select {
+	case <-started:
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	_, _, err = inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 2,
+		Key:    sarama.StringEncoder("task1"),
+		Value: processing.NewJSONEncoder(controlMessage{
+			Type:   messageTypeTaskCancel,
+			TaskID: "task1",
+		}),
+	})
+	is.NoErr(err)
+	select {
+	case outputMsg := <-outputPipe.Messages():
+		var result chunkResult
+		err := json.Unmarshal(outputMsg.Value, &result)
+		is.NoErr(err)
+		is.Equal(result.ChunkUUID, "chunk1")
+		is.Equal(result.Status, processing.ChunkStatusError)
+		is.Equal(result.FailureReason, failureReasonCancelled)
+	case <-time.After(2 * time.Second):
+		is.Fail() // timed out
+	}
+}
+
+// TestProcessingTaskCancelAllSlotsBusy ensures a task can be cancelled
+// when its hung chunks are using every processing slot.
+func TestProcessingTaskCancelAllSlotsBusy(t *testing.T) {
+	is := is.New(t)
+	started := make(chan struct{}, 10)
+	finished := make(chan struct{})
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		// hangs until the chunk is aborted
+		select {
+		case <-r.Context().Done():
+		case <-finished:
+		}
+	}))
+	defer processSrv.Close()
+	defer close(finished)
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine, inputPipe, outputPipe := newControlTestEngine(processSrv.URL)
+	defer inputPipe.Close()
+	defer outputPipe.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	engine.Config.Chunk.Timeout = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	send := func(offset int64, value sarama.Encoder) {
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: offset,
+			Key:    sarama.StringEncoder("task1"),
+			Value:  value,
+		})
+		is.NoErr(err)
+	}
+	chunk := func(chunkUUID string) sarama.Encoder {
+		return processing.NewJSONEncoder(processing.MediaChunkMessage{
+			Type:      processing.MessageTypeMediaChunk,
+			TaskID:    "task1",
+			ChunkUUID: chunkUUID,
+		})
+	}
+	// fill both slots
+	send(1, chunk("chunk1"))
+	send(2, chunk("chunk2"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(1 * time.Second):
+			is.Fail() // timed out
+			return
+		}
+	}
+	// another chunk waits for a slot, in front of the cancellation
+	send(3, chunk("chunk3"))
+	send(4, processing.NewJSONEncoder(controlMessage{
+		Type:   messageTypeTaskCancel,
+		TaskID: "task1",
+	}))
+	cancelled := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			var result chunkResult
+			err := json.Unmarshal(outputMsg.Value, &result)
+			is.NoErr(err)
+			is.Equal(result.Status, processing.ChunkStatusError)
+			is.Equal(result.FailureReason, failureReasonCancelled)
+			cancelled[result.ChunkUUID] = true
+		case <-time.After(2 * time.Second):
+			is.Fail() // timed out
+			return
+		}
+	}
+	is.Equal(cancelled, map[string]bool{"chunk1": true, "chunk2": true, "chunk3": true})
+}
+
+func TestProcessingChunkEOF(t *testing.T) {
+	is := is.New(t)
+	var finalizeForm map[string]string
+	finalizeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		finalizeForm = map[string]string{
+			"taskId": r.FormValue("taskId"),
+			"jobId":  r.FormValue("jobId"),
+			"tdoId":  r.FormValue("tdoId"),
+		}
+		err := json.NewEncoder(w).Encode(engineOutput{
+			Series: []seriesObject{{Object: object{Label: "summary"}}},
+		})
+		is.NoErr(err)
+	}))
+	defer finalizeSrv.Close()
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine, inputPipe, outputPipe := newControlTestEngine("")
+	defer inputPipe.Close()
+	defer outputPipe.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	engine.Config.Finalize.URL = finalizeSrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder("task1"),
+		Value: processing.NewJSONEncoder(controlMessage{
+			Type:   messageTypeChunkEOF,
+			TaskID: "task1",
+			JobID:  "job1",
+			TDOID:  "tdo1",
+		}),
+	})
+	is.NoErr(err)
+	select {
+	case outputMsg := <-outputPipe.Messages():
+		var result chunkResult
+		err := json.Unmarshal(outputMsg.Value, &result)
+		is.NoErr(err)
+		is.Equal(result.TaskID, "task1")
+		is.Equal(result.Status, processing.ChunkStatusSuccess)
+		is.True(result.EngineOutput != nil)
+		var output engineOutput
+		err = json.Unmarshal([]byte(result.EngineOutput.Content), &output)
+		is.NoErr(err)
+		is.Equal(output.Series[0].Object.Label, "summary")
+	case <-time.After(2 * time.Second):
+		is.Fail() // timed out
+	}
+	is.Equal(finalizeForm["taskId"], "task1")
+	is.Equal(finalizeForm["jobId"], "job1")
+	is.Equal(finalizeForm["tdoId"], "tdo1")
+}
+
+func TestProcessingChunkEOFRetry(t *testing.T) {
+	is := is.New(t)
+	var calls int32
+	finalizeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "not yet", http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, `{"series":[]}`)
+	}))
+	defer finalizeSrv.Close()
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine, inputPipe, outputPipe := newControlTestEngine("")
+	defer inputPipe.Close()
+	defer outputPipe.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	engine.Config.Finalize.URL = finalizeSrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder("task1"),
+		Value: processing.NewJSONEncoder(controlMessage{
+			Type:   messageTypeChunkEOF,
+			TaskID: "task1",
+		}),
+	})
+	is.NoErr(err)
+	select {
+	case outputMsg := <-outputPipe.Messages():
+		var result chunkResult
+		err := json.Unmarshal(outputMsg.Value, &result)
+		is.NoErr(err)
+		is.Equal(result.TaskID, "task1")
+		is.Equal(result.Status, processing.ChunkStatusSuccess)
+	case <-time.After(2 * time.Second):
+		is.Fail() // timed out
+	}
+	is.Equal(atomic.LoadInt32(&calls), int32(2)) // retried after the failure
+}
+
+// TestProcessingChunkEOFBadRequest ensures a Finalize webhook that
+// can't succeed is not retried forever.
+func TestProcessingChunkEOFBadRequest(t *testing.T) {
+	is := is.New(t)
+	var calls int32
+	finalizeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "unknown task", http.StatusBadRequest)
+	}))
+	defer finalizeSrv.Close()
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine, inputPipe, outputPipe := newControlTestEngine("")
+	defer inputPipe.Close()
+	defer outputPipe.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	engine.Config.Finalize.URL = finalizeSrv.URL
+	engine.Config.DeadLetter.Topic = "dead-letters"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder("task1"),
+		Value: processing.NewJSONEncoder(controlMessage{
+			Type:   messageTypeChunkEOF,
+			TaskID: "task1",
+		}),
+	})
+	is.NoErr(err)
+	select {
+	case outputMsg := <-outputPipe.Messages():
+		is.Equal(outputMsg.Topic, "dead-letters")
+		var letter deadLetter
+		err := json.Unmarshal(outputMsg.Value, &letter)
+		is.NoErr(err)
+		is.Equal(len(letter.Attempts), 1)
+		is.Equal(letter.Attempts[0].StatusCode, http.StatusBadRequest)
+	case <-time.After(2 * time.Second):
+		is.Fail() // timed out
+	}
+	is.Equal(atomic.LoadInt32(&calls), int32(1)) // not retried
+	waitForOffset(t, inputPipe, 1)
+}
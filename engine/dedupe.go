@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// dedupeFilename is the name of the dedupe file inside the dedupe directory.
+const dedupeFilename = "dedupe.log"
+
+// dedupeEntry is a completed chunk, and a single line in the dedupe file.
+type dedupeEntry struct {
+	Key    string      `json:"key"`
+	Result chunkResult `json:"result"`
+}
+
+// dedupeCache remembers the ChunkResult of recently completed chunks so
+// chunks that are redelivered (for example after a consumer rebalance) are
+// not processed twice.
+// The least recently used entries are evicted once the cache is full.
+// A nil *dedupeCache is valid and remembers nothing.
+type dedupeCache struct {
+	lock    sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	// path and f are the file the cache is persisted to (if any).
+	path    string
+	f       *os.File
+	written int
+}
+
+// newDedupeCache makes a dedupeCache that holds up to size entries.
+// If dir is not empty, the cache is persisted there, and any
+// entries from previous runs are loaded.
+func newDedupeCache(size int, dir string) (*dedupeCache, error) {
+	c := &dedupeCache{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+	if dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "make dedupe dir")
+	}
+	c.path = filepath.Join(dir, dedupeFilename)
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// dedupeKey gets the key for a chunk in the dedupe cache.
+func dedupeKey(taskID, chunkUUID string) string {
+	return taskID + "/" + chunkUUID
+}
+
+// get gets the result of a previously completed chunk.
+func (c *dedupeCache) get(key string) (chunkResult, bool) {
+	if c == nil {
+		return chunkResult{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return chunkResult{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(dedupeEntry).Result, true
+}
+
+// add remembers the result of a completed chunk.
+// Failed chunks are not remembered, so they may be tried again
+// (for example when replayed from the dead-letter topic).
+func (c *dedupeCache) add(key string, result chunkResult) error {
+	if c == nil || result.Status == processing.ChunkStatusError {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry := dedupeEntry{Key: key, Result: result}
+	c.apply(entry)
+	if c.f == nil {
+		return nil
+	}
+	if c.written >= c.size {
+		return c.compact()
+	}
+	return c.write(c.f, entry)
+}
+
+// apply adds the entry to the cache, evicting the least
+// recently used entries if it is full.
+// Callers must hold the lock.
+func (c *dedupeCache) apply(entry dedupeEntry) {
+	if el, ok := c.entries[entry.Key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[entry.Key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(dedupeEntry).Key)
+	}
+}
+
+// load reads the existing dedupe file (if any).
+func (c *dedupeCache) load() error {
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "open dedupe file")
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		var entry dedupeEntry
+		if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+			// a partial line from a crash part way through a write
+			continue
+		}
+		c.apply(entry)
+	}
+	if err := s.Err(); err != nil {
+		return errors.Wrap(err, "read dedupe file")
+	}
+	return nil
+}
+
+// compact rewrites the dedupe file so that it only contains
+// the entries in the cache, oldest first.
+// Callers must hold the lock (or have the only reference).
+func (c *dedupeCache) compact() error {
+	tmp := c.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create dedupe file")
+	}
+	c.written = 0
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		if err := c.write(f, el.Value.(dedupeEntry)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close dedupe file")
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return errors.Wrap(err, "replace dedupe file")
+	}
+	if c.f != nil {
+		c.f.Close()
+	}
+	c.f, err = os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open dedupe file")
+	}
+	return nil
+}
+
+// write writes a single entry line to f.
+func (c *dedupeCache) write(f *os.File, entry dedupeEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "encode dedupe entry")
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "write dedupe file")
+	}
+	c.written++
+	return nil
+}
+
+// Close closes the dedupe file (if any).
+func (c *dedupeCache) Close() error {
+	if c == nil || c.f == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.f.Close()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestDedupeCache(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "dedupe")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	result := func(chunkUUID string, status processing.ChunkStatus) chunkResult {
+		return chunkResult{ChunkResult: processing.ChunkResult{
+			TaskID:    "task1",
+			ChunkUUID: chunkUUID,
+			Status:    status,
+		}}
+	}
+	c, err := newDedupeCache(2, dir)
+	is.NoErr(err)
+	is.NoErr(c.add(dedupeKey("task1", "chunk1"), result("chunk1", processing.ChunkStatusSuccess)))
+	is.NoErr(c.add(dedupeKey("task1", "chunk2"), result("chunk2", processing.ChunkStatusIgnored)))
+	is.NoErr(c.add(dedupeKey("task1", "chunk3"), result("chunk3", processing.ChunkStatusError)))
+	_, ok := c.get(dedupeKey("task1", "chunk3"))
+	is.Equal(ok, false) // failed chunks are not remembered
+	got, ok := c.get(dedupeKey("task1", "chunk1"))
+	is.True(ok)
+	is.Equal(got.ChunkUUID, "chunk1")
+	// chunk2 is now the least recently used
+	is.NoErr(c.add(dedupeKey("task1", "chunk4"), result("chunk4", processing.ChunkStatusSuccess)))
+	_, ok = c.get(dedupeKey("task1", "chunk2"))
+	is.Equal(ok, false) // evicted
+	is.NoErr(c.Close())
+
+	// entries are remembered after a restart
+	c, err = newDedupeCache(2, dir)
+	is.NoErr(err)
+	_, ok = c.get(dedupeKey("task1", "chunk1"))
+	is.True(ok)
+	_, ok = c.get(dedupeKey("task1", "chunk4"))
+	is.True(ok)
+	_, ok = c.get(dedupeKey("task1", "chunk2"))
+	is.Equal(ok, false)
+	is.NoErr(c.Close())
+
+	var nilCache *dedupeCache
+	is.NoErr(nilCache.add("key", result("chunk1", processing.ChunkStatusSuccess)))
+	_, ok = nilCache.get("key")
+	is.Equal(ok, false)
+}
+
+// TestProcessingChunkRedelivered ensures a chunk that is delivered
+// again after completing is not sent to the webhook again.
+func TestProcessingChunkRedelivered(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Dedupe.Size = 10
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	var calls int32
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		err := json.NewEncoder(w).Encode(engineOutput{
+			Series: []seriesObject{{Object: object{Label: "something"}}},
+		})
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	inputMessage := processing.MediaChunkMessage{
+		TimestampUTC:  time.Now().Unix(),
+		ChunkUUID:     "123",
+		Type:          processing.MessageTypeMediaChunk,
+		StartOffsetMS: 1000,
+		EndOffsetMS:   2000,
+		JobID:         "job1",
+		TDOID:         "tdo1",
+		TaskID:        "task1",
+	}
+	var results []chunkResult
+	for i := 0; i < 2; i++ {
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: int64(i),
+			Key:    sarama.StringEncoder(inputMessage.TaskID),
+			Value:  processing.NewJSONEncoder(inputMessage),
+		})
+		is.NoErr(err)
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			var result chunkResult
+			err := json.Unmarshal(outputMsg.Value, &result)
+			is.NoErr(err)
+			results = append(results, result)
+		case <-time.After(1 * time.Second):
+			is.Fail() // timed out
+			return
+		}
+	}
+	is.Equal(atomic.LoadInt32(&calls), int32(1)) // webhook only called once
+	is.Equal(results[1].Status, processing.ChunkStatusSuccess)
+	is.True(results[1].EngineOutput != nil)
+	is.Equal(results[1].EngineOutput.Content, results[0].EngineOutput.Content)
+	is.Equal(results[1].Attempts, 1)
+}
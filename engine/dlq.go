@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// messageTypeDeadLetter is the type of messages sent to the dead-letter topic.
+const messageTypeDeadLetter = "dead_letter"
+
+// webhookAttempt describes a single call to the Process webhook.
+type webhookAttempt struct {
+	// StartedUTC is when the attempt was made in epoch millisecs.
+	StartedUTC int64 `json:"startedUTC"`
+	// DurationMS is how long the attempt took in millisecs.
+	DurationMS int64 `json:"durationMs"`
+	// StatusCode is the HTTP status code the webhook responded with,
+	// or zero if no response was received.
+	StatusCode int `json:"statusCode,omitempty"`
+	// Error is the error (including any response body) for failed attempts.
+	Error string `json:"error,omitempty"`
+}
+
+// deadLetter is the message sent to the dead-letter topic for chunks
+// that could not be processed after exhausting all retries.
+type deadLetter struct {
+	Type         string `json:"type"`
+	TimestampUTC int64  `json:"timestampUTC"`
+	EngineID     string `json:"engineId,omitempty"`
+	InstanceID   string `json:"instanceId,omitempty"`
+	// Topic, Partition and Offset describe where the original
+	// message was consumed from.
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+	// Key is the key of the original message.
+	Key []byte `json:"key,omitempty"`
+	// Message is the original message value.
+	Message json.RawMessage `json:"message"`
+	// Error is the final error.
+	Error string `json:"error"`
+	// FailureReason is the failure reason for the error.
+	FailureReason string `json:"failureReason,omitempty"`
+	// Attempts describes every call made to the webhook.
+	Attempts []webhookAttempt `json:"attempts"`
+}
+
+// sendDeadLetter sends the original message along with the details of
+// every attempt to the dead-letter topic.
+// Does nothing if there is no dead-letter topic configured.
+func (e *Engine) sendDeadLetter(msg *sarama.ConsumerMessage, attempts []webhookAttempt, cause error) {
+	if e.Config.DeadLetter.Topic == "" {
+		return
+	}
+	reason, _ := failureDetails(cause)
+	value := json.RawMessage(msg.Value)
+	if !json.Valid(msg.Value) {
+		// keep malformed messages as a string so the
+		// dead letter is still valid JSON
+		value, _ = json.Marshal(string(msg.Value))
+	}
+	letter := deadLetter{
+		Type:          messageTypeDeadLetter,
+		TimestampUTC:  time.Now().UTC().UnixNano() / 1e6,
+		EngineID:      e.Config.Engine.ID,
+		InstanceID:    e.Config.Engine.InstanceID,
+		Topic:         msg.Topic,
+		Partition:     msg.Partition,
+		Offset:        msg.Offset,
+		Key:           msg.Key,
+		Message:       value,
+		Error:         cause.Error(),
+		FailureReason: reason,
+		Attempts:      attempts,
+	}
+	_, _, err := e.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: e.Config.DeadLetter.Topic,
+		Key:   sarama.ByteEncoder(msg.Key),
+		Value: processing.NewJSONEncoder(letter),
+	})
+	if err != nil {
+		e.logDebug("WARN", "failed to send dead letter:", err)
+	}
+}
+
+// runDeadLetterCommand runs the `engine dlq` subcommands.
+//
+//	engine dlq replay [-topic topic] [-group group]
+//
+// replay consumes the dead-letter topic and sends each original message
+// back to the topic it came from (or -topic) so it is processed again
+// through the normal path.
+// It stops once no dead letters have arrived for Engine.EndIfIdleDuration.
+func (e *Engine) runDeadLetterCommand(ctx context.Context, args []string) error {
+	if len(args) < 1 || args[0] != "replay" {
+		return errors.New("usage: engine dlq replay [-topic topic] [-group group]")
+	}
+	flags := flag.NewFlagSet("dlq replay", flag.ContinueOnError)
+	topic := flags.String("topic", "", "topic to replay dead letters to (default: the original topic)")
+	group := flags.String("group", e.Config.Kafka.ConsumerGroup+"_dlq_replay", "consumer group to use when reading the dead-letter topic")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if e.Config.DeadLetter.Topic == "" {
+		return errors.New("missing KAFKA_DLQ_TOPIC")
+	}
+	consumer, cleanup, err := newKafkaConsumer(e.Config, *group, e.Config.DeadLetter.Topic)
+	if err != nil {
+		return errors.Wrap(err, "kafka consumer")
+	}
+	defer cleanup()
+	producer, err := newKafkaProducer(e.Config)
+	if err != nil {
+		return errors.Wrap(err, "kafka producer")
+	}
+	e.consumer = consumer
+	e.producer = producer
+	n, err := e.replayDeadLetters(ctx, *topic)
+	e.logDebug(fmt.Sprintf("replayed %d dead letter(s)", n))
+	return err
+}
+
+// replayDeadLetters reads dead letters from the consumer and produces the
+// original messages to topic, or to their original topic if topic is empty.
+func (e *Engine) replayDeadLetters(ctx context.Context, topic string) (int, error) {
+	var n int
+	for {
+		select {
+		case msg, ok := <-e.consumer.Messages():
+			if !ok {
+				return n, nil
+			}
+			var letter deadLetter
+			if err := json.Unmarshal(msg.Value, &letter); err != nil {
+				e.logDebug("WARN", "skipping malformed dead letter:", err)
+				e.consumer.MarkOffset(msg, "")
+				continue
+			}
+			if letter.Type != messageTypeDeadLetter {
+				e.consumer.MarkOffset(msg, "")
+				continue
+			}
+			dest := topic
+			if dest == "" {
+				dest = letter.Topic
+			}
+			_, _, err := e.producer.SendMessage(&sarama.ProducerMessage{
+				Topic: dest,
+				Key:   sarama.ByteEncoder(letter.Key),
+				Value: sarama.ByteEncoder(letter.Message),
+			})
+			if err != nil {
+				return n, errors.Wrapf(err, "replay to %s", dest)
+			}
+			e.consumer.MarkOffset(msg, "")
+			n++
+		case <-time.After(e.Config.Engine.EndIfIdleDuration):
+			return n, nil
+		case <-ctx.Done():
+			return n, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// TestDeadLetter ensures chunks that exhaust their retries are
+// sent to the dead-letter topic along with the details of each attempt.
+func TestDeadLetter(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.DeadLetter.Topic = "dlq-topic"
+	engine.Config.Webhooks.Backoff.MaxRetries = 1
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Something went wrong", http.StatusInternalServerError)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	inputMessage := processing.MediaChunkMessage{
+		TimestampUTC:  time.Now().Unix(),
+		ChunkUUID:     "123",
+		Type:          processing.MessageTypeMediaChunk,
+		StartOffsetMS: 1000,
+		EndOffsetMS:   2000,
+		JobID:         "job1",
+		TDOID:         "tdo1",
+		TaskID:        "task1",
+	}
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Topic:  "input-topic",
+		Offset: 1,
+		Key:    sarama.StringEncoder(inputMessage.TaskID),
+		Value:  processing.NewJSONEncoder(inputMessage),
+	})
+	is.NoErr(err)
+
+	var outputMsg *sarama.ConsumerMessage
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	is.Equal(outputMsg.Topic, "dlq-topic")
+	is.Equal(string(outputMsg.Key), inputMessage.TaskID)
+	var letter deadLetter
+	err = json.Unmarshal(outputMsg.Value, &letter)
+	is.NoErr(err)
+	is.Equal(letter.Type, messageTypeDeadLetter)
+	is.Equal(letter.Topic, "input-topic")
+	is.Equal(letter.Offset, int64(1))
+	is.Equal(letter.Error, "500: Something went wrong")
+	var original processing.MediaChunkMessage
+	err = json.Unmarshal(letter.Message, &original)
+	is.NoErr(err)
+	is.Equal(original.ChunkUUID, inputMessage.ChunkUUID)
+	is.Equal(len(letter.Attempts), 2) // initial attempt and one retry
+	for _, attempt := range letter.Attempts {
+		is.Equal(attempt.StatusCode, http.StatusInternalServerError)
+		is.Equal(attempt.Error, "500: Something went wrong")
+		is.True(attempt.StartedUTC > 0)
+	}
+
+	// the error ChunkResult is still sent
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	is.Equal(outputMsg.Topic, engine.Config.Kafka.ChunkTopic)
+	var chunkResult processing.ChunkResult
+	err = json.Unmarshal(outputMsg.Value, &chunkResult)
+	is.NoErr(err)
+	is.Equal(chunkResult.Status, processing.ChunkStatusError)
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Engine.EndIfIdleDuration = 100 * time.Millisecond
+	engine.logDebug = func(args ...interface{}) {}
+	dlqPipe := processing.NewPipe()
+	defer dlqPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = dlqPipe
+	engine.producer = outputPipe
+
+	original := `{"type":"media_chunk","chunkUUID":"123","taskId":"task1"}`
+	_, _, err := dlqPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 5,
+		Value: processing.NewJSONEncoder(deadLetter{
+			Type:    messageTypeDeadLetter,
+			Topic:   "input-topic",
+			Key:     []byte("task1"),
+			Message: json.RawMessage(original),
+		}),
+	})
+	is.NoErr(err)
+	_, _, err = dlqPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 6,
+		Value:  sarama.StringEncoder(`not a dead letter`),
+	})
+	is.NoErr(err)
+
+	n, err := engine.replayDeadLetters(context.Background(), "")
+	is.NoErr(err)
+	is.Equal(n, 1)
+	is.Equal(dlqPipe.Offset, int64(6))
+
+	var outputMsg *sarama.ConsumerMessage
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	is.Equal(outputMsg.Topic, "input-topic")
+	is.Equal(string(outputMsg.Key), "task1")
+	is.Equal(string(outputMsg.Value), original)
+}
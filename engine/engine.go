@@ -46,11 +46,53 @@ type Engine struct {
 	// processingSemaphore is a buffered channel that controls how
 	// many concurrent processing tasks will be performed.
 	processingSemaphore chan struct{}
+	// concurrency adjusts the processing concurrency limit.
+	// May be nil.
+	concurrency *adaptiveConcurrency
+	// batches receives chunks to be sent to the Process webhook
+	// in batches. Nil unless batch mode is enabled.
+	batches chan *batchItem
+	// throttling is 1 while concurrency is lowered because
+	// the engine asked the toolkit to back off.
+	throttling int32
+	// offsets tracks in-flight messages so offsets are only
+	// committed once their ChunkResult has been produced.
+	offsets *offsetTracker
+	// ordering holds back ChunkResults so they are produced in
+	// order for each task. May be nil.
+	ordering *outputOrder
+	// mediaCache keeps downloaded chunk media on disk.
+	// May be nil.
+	mediaCache *mediaCache
+	// prefetcher downloads chunk media ahead of processing.
+	// May be nil.
+	prefetcher *chunkPrefetcher
+	// memory limits the total size of the chunks in flight.
+	// May be nil.
+	memory *memoryBudget
+	// scheduler shares processing fairly between tasks.
+	// May be nil.
+	scheduler *taskScheduler
+	// tasks tracks in-flight chunks so they can be aborted
+	// when their task is cancelled.
+	tasks *taskCancels
+	// dedupe remembers the results of completed chunks.
+	// May be nil.
+	dedupe *dedupeCache
+	// journal records in-flight messages on local disk.
+	// May be nil.
+	journal *journal
 
 	testMode bool
 
 	// client is the client to use to make webhook requests.
 	webhookClient *http.Client
+	// callbacks receives callbacks from the engine when it
+	// processes chunks asynchronously. May be nil.
+	callbacks *asyncCallbacks
+	// rpc calls the engine over gRPC, or the subprocess's stdin
+	// and stdout, instead of the webhooks. May be nil.
+	rpc engineRPC
 	// graphQLHTTPClient is the client used to access GraphQL.
 	graphQLHTTPClient *http.Client
 
@@ -84,7 +126,7 @@ func NewEngine() *Engine {
 			logger.Debug(args...)
 		},
 		Config:            NewConfig(engineInstanceId, logFileName, logWriter, logger),
-		webhookClient:     &http.Client{ /* no timeout */ },
+		webhookClient:     &http.Client{Transport: newWebhookTransport() /* no timeout */},
 		graphQLHTTPClient: &http.Client{Timeout: 30 * time.Minute},
 	}
 }
@@ -129,6 +171,25 @@ func (e *Engine) Run(ctx context.Context) error {
 	if err != nil {
 		return errors.Wrap(err, "isTrainingTask")
 	}
+	if e.Config.GRPC.Address != "" {
+		grpcEngine, err := dialGRPCEngine(e.Config.GRPC.Address)
+		if err != nil {
+			return errors.Wrap(err, "grpc")
+		}
+		defer grpcEngine.Close()
+		e.rpc = grpcEngine
+		e.logDebug("calling the engine over gRPC at", e.Config.GRPC.Address)
+	} else if e.Config.Stdio.Enabled && !isTraining {
+		if len(e.Config.Subprocess.Arguments) < 1 {
+			return errors.New("not enough arguments to run subprocess")
+		}
+		stdioEngine, err := startStdioEngine(ctx, e.Config.Subprocess.Arguments, e.Config.Stdout, e.Config.Stderr)
+		if err != nil {
+			return errors.Wrap(err, e.Config.Subprocess.Arguments[0])
+		}
+		e.rpc = stdioEngine
+		e.logDebug("calling the engine over the subprocess's stdin and stdout")
+	}
 	if e.testMode {
 		go e.runTestConsole(ctx)
 		e.logDebug("running subprocess for testing...")
@@ -139,11 +200,37 @@ func (e *Engine) Run(ctx context.Context) error {
 		e.logDebug("running subprocess for training...")
 		return e.runSubprocessOnly(ctx)
 	}
+	if e.Config.Async.CallbackAddr != "" {
+		e.callbacks, err = listenAsyncCallbacks(e.Config.Async.CallbackAddr)
+		if err != nil {
+			return errors.Wrap(err, "async callbacks")
+		}
+		go func() {
+			if err := e.callbacks.serve(ctx); err != nil {
+				e.logDebug("WARN", "async callbacks:", err)
+			}
+		}()
+		e.logDebug("receiving async callbacks at", e.callbacks.baseURL)
+	}
 	semaphoreSize := 1
 	if e.Config.Processing.Concurrency > 0 {
 		semaphoreSize = e.Config.Processing.Concurrency
 	}
 	e.processingSemaphore = make(chan struct{}, semaphoreSize)
+	if e.Config.AdaptiveConcurrency.Enabled {
+		max := e.Config.AdaptiveConcurrency.MaxConcurrency
+		if max == 0 {
+			max = semaphoreSize
+		}
+		e.concurrency = newAdaptiveConcurrency(semaphoreSize,
+			e.Config.AdaptiveConcurrency.MinConcurrency, max,
+			e.Config.AdaptiveConcurrency.LatencyTolerance,
+			e.Config.AdaptiveConcurrency.MaxErrorRate,
+			e.logDebug,
+		)
+		e.processingSemaphore = e.concurrency.semaphore
+		go e.concurrency.run(ctx)
+	}
 	if e.Config.SelfDriving.SelfDrivingMode {
 		e.logDebug("running inference in file system mode...")
 		return e.runInferenceFSMode(ctx)
@@ -155,10 +242,18 @@ func (e *Engine) Run(ctx context.Context) error {
 
 // runSubprocessOnly starts the subprocess and doesn't do anything else.
 // This is used for training tasks.
+// If the subprocess has already been started to use stdio, this
+// waits for it instead.
 func (e *Engine) runSubprocessOnly(ctx context.Context) error {
 	if len(e.Config.Subprocess.Arguments) < 1 {
 		return errors.New("not enough arguments to run subprocess")
 	}
+	if stdioEngine, ok := e.rpc.(*stdioEngine); ok {
+		if err := stdioEngine.wait(); err != nil {
+			return errors.Wrap(err, e.Config.Subprocess.Arguments[0])
+		}
+		return nil
+	}
 	cmd := exec.CommandContext(ctx, e.Config.Subprocess.Arguments[0], e.Config.Subprocess.Arguments[1:]...)
 	cmd.Stdout = e.Config.Stdout
 	cmd.Stderr = e.Config.Stderr
@@ -219,7 +314,7 @@ func (e *Engine) getSelfDrivingPayloadFile(inputDir string) ([]byte, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "read self-driving payload.json")
 	}
-	e.logDebug("using payload.json: %s: %s", payloadFilepath, string(b))
+	e.logDebug(fmt.Sprintf("using payload.json: %s: %s", payloadFilepath, string(b)))
 	return b, nil
 }
 func (e *Engine) processSelfDrivingFile(outputDir string, file selfdriving.File) error {
@@ -228,10 +323,29 @@ func (e *Engine) processSelfDrivingFile(outputDir string, file selfdriving.File)
 	if err != nil {
 		return err
 	}
+	if e.rpc != nil {
+		return e.processSelfDrivingFileRPC(outputDir, file, payloadJSON)
+	}
 	req, err := processing.NewRequestFromFile(e.Config.Webhooks.Process.URL, file, payloadJSON)
 	if err != nil {
 		return errors.Wrap(err, "new request")
 	}
+	// the async timeout applies once the file is accepted, rather
+	// than the chunk timeout
+	asyncCtx := req.Context()
+	if e.Config.Chunk.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), e.Config.Chunk.Timeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	waiter, err := e.callbacks.register()
+	if err != nil {
+		return err
+	}
+	defer e.callbacks.remove(waiter)
+	if waiter != nil {
+		req.Header.Set(callbackURLHeader, waiter.url)
+	}
 	resp, err := e.webhookClient.Do(req)
 	if err != nil {
 		return err
@@ -241,6 +355,10 @@ func (e *Engine) processSelfDrivingFile(outputDir string, file selfdriving.File)
 		e.logDebug("ignoring chunk after StatusNoContent:", file.Path)
 		return nil
 	}
+	if resp.StatusCode == http.StatusAccepted && waiter != nil {
+		e.logDebug(fmt.Sprintf("file %s accepted (job handle %q), waiting for callback", file.Path, acceptedJobHandle(resp.Body)))
+		return e.waitForSelfDrivingCallback(asyncCtx, outputDir, file, waiter)
+	}
 	if resp.StatusCode != http.StatusOK {
 		var buf bytes.Buffer
 		if _, err := io.Copy(&buf, resp.Body); err != nil {
@@ -310,14 +428,20 @@ func writeOutputFile(outputFile string, r io.Reader) error {
 func (e *Engine) runInference(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	var cmd *exec.Cmd
-	if len(e.Config.Subprocess.Arguments) > 0 {
-		cmd = exec.CommandContext(ctx, e.Config.Subprocess.Arguments[0], e.Config.Subprocess.Arguments[1:]...)
+	// wait waits for the subprocess to exit
+	var wait func() error
+	if stdioEngine, ok := e.rpc.(*stdioEngine); ok {
+		wait = stdioEngine.wait
+	} else if len(e.Config.Subprocess.Arguments) > 0 {
+		cmd := exec.CommandContext(ctx, e.Config.Subprocess.Arguments[0], e.Config.Subprocess.Arguments[1:]...)
 		cmd.Stdout = e.Config.Stdout
 		cmd.Stderr = e.Config.Stderr
 		if err := cmd.Start(); err != nil {
 			return errors.Wrap(err, e.Config.Subprocess.Arguments[0])
 		}
+		wait = cmd.Wait
+	}
+	if wait != nil {
 		readyCtx, cancel := context.WithTimeout(ctx, e.Config.Subprocess.ReadyTimeout)
 		defer cancel()
 		e.logDebug("waiting for ready... will expire after", e.Config.Subprocess.ReadyTimeout)
@@ -325,7 +449,83 @@ func (e *Engine) runInference(ctx context.Context) error {
 			return err
 		}
 	}
-	e.logDebug(fmt.Sprintf("processing %d task(s) concurrently", e.Config.Processing.Concurrency))
+	e.offsets = newOffsetTracker()
+	e.tasks = newTaskCancels()
+	if e.Config.Journal.Dir != "" {
+		var err error
+		e.journal, err = openJournal(e.Config.Journal.Dir)
+		if err != nil {
+			return errors.Wrap(err, "journal")
+		}
+		if err := e.replayJournal(); err != nil {
+			return err
+		}
+	}
+	if e.Config.Ordering.Enabled {
+		e.ordering = newOutputOrder(e.Config.Ordering.Timeout, e.Config.Ordering.MaxBuffered, e.logDebug)
+	}
+	if e.Config.Dedupe.Size > 0 {
+		var err error
+		e.dedupe, err = newDedupeCache(e.Config.Dedupe.Size, e.Config.Dedupe.Dir)
+		if err != nil {
+			return errors.Wrap(err, "dedupe")
+		}
+	}
+	if e.concurrency != nil {
+		e.logDebug(fmt.Sprintf("processing %d task(s) concurrently (adaptive between %d and %d)", e.concurrency.Limit(), e.concurrency.min, e.concurrency.max))
+	} else {
+		e.logDebug(fmt.Sprintf("processing %d task(s) concurrently", e.Config.Processing.Concurrency))
+	}
+	if e.Config.MediaCache.MaxBytes > 0 {
+		var err error
+		e.mediaCache, err = newMediaCache(e.webhookClient, e.Config.MediaCache.Dir, e.Config.MediaCache.MaxBytes, e.Config.MediaCache.DownloadAttempts)
+		if err != nil {
+			return errors.Wrap(err, "media cache")
+		}
+		e.mediaCache.idleTimeout = e.Config.MediaCache.IdleTimeout
+		e.logDebug(fmt.Sprintf("caching up to %d bytes of chunk media in %s", e.Config.MediaCache.MaxBytes, e.mediaCache.dir))
+	}
+	if e.Config.Prefetch.Count > 0 {
+		var err error
+		e.prefetcher, err = newChunkPrefetcher(e.webhookClient, e.Config.Prefetch.Count, e.Config.Prefetch.Dir, e.Config.Prefetch.MaxBytes, e.logDebug)
+		if err != nil {
+			return errors.Wrap(err, "prefetch")
+		}
+		e.prefetcher.cache = e.mediaCache
+		e.logDebug(fmt.Sprintf("prefetching up to %d chunk(s)", e.Config.Prefetch.Count))
+	}
+	if e.Config.Memory.BudgetBytes > 0 {
+		e.memory = newMemoryBudget(e.Config.Memory.BudgetBytes)
+		e.logDebug(fmt.Sprintf("limiting chunks in flight to %d bytes", e.Config.Memory.BudgetBytes))
+	}
+	if e.Config.Fairness.Enabled || e.Config.Fairness.MaxPerTask > 0 {
+		e.scheduler = newTaskScheduler(e.Config.Fairness.MaxPerTask, e.Config.Fairness.MaxQueued)
+		if e.Config.Fairness.MaxPerTask > 0 {
+			e.logDebug(fmt.Sprintf("sharing processing fairly between tasks (at most %d chunk(s) per task)", e.Config.Fairness.MaxPerTask))
+		} else {
+			e.logDebug("sharing processing fairly between tasks")
+		}
+	}
+	if _, ok := e.consumer.(*inputLanes); ok {
+		// lanes choose the next message when it is read, so
+		// buffering messages ahead of processing defeats them.
+		if e.scheduler != nil {
+			e.logDebug("WARN", "with task fairness, input topic priorities only apply when the scheduler queue has space, not when a processing slot is free")
+		}
+		if e.prefetcher != nil {
+			e.logDebug("WARN", fmt.Sprintf("with prefetching, input topic priorities are applied %d chunk(s) ahead of processing", e.Config.Prefetch.Count))
+		}
+	}
+	if e.Config.Batch.Size > 1 && e.rpc != nil {
+		e.logDebug("WARN", "batch mode is only supported with webhooks, so chunks will be sent one at a time")
+	} else if e.Config.Batch.Size > 1 {
+		if e.Config.Batch.Size > cap(e.processingSemaphore) {
+			e.logDebug("WARN", fmt.Sprintf("batch size %d is larger than the concurrency %d, so batches will never be full", e.Config.Batch.Size, cap(e.processingSemaphore)))
+		}
+		e.logDebug(fmt.Sprintf("sending chunks in batches of up to %d (waiting up to %s)", e.Config.Batch.Size, e.Config.Batch.Wait))
+		e.batches = make(chan *batchItem)
+		go e.runBatches(ctx)
+	}
 	e.logDebug("waiting for messages...")
 	e.sendEvent(event{
 		Key:  e.Config.Engine.ID,
@@ -334,53 +534,194 @@ func (e *Engine) runInference(ctx context.Context) error {
 	go e.sendPeriodicEvents(ctx)
 	go func() {
 		var wg sync.WaitGroup
+		if e.scheduler != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				e.runScheduler(ctx, &wg)
+			}()
+		}
 		defer func() {
+			e.scheduler.close()
 			e.logDebug("waiting for jobs to finish...")
 			wg.Wait()
+			if n := e.offsets.inFlight(); n > 0 {
+				e.logDebug(fmt.Sprintf("%d message(s) left uncommitted and will be redelivered", n))
+			}
+			if err := e.journal.Close(); err != nil {
+				e.logDebug("WARN", "journal:", err)
+			}
+			if err := e.dedupe.Close(); err != nil {
+				e.logDebug("WARN", "dedupe:", err)
+			}
 			e.logDebug("shutting down...")
 			e.sendEvent(event{
 				Key:  e.Config.Engine.ID,
 				Type: eventStop,
 			})
 			cancel()
+			if err := e.prefetcher.Close(); err != nil {
+				e.logDebug("WARN", "prefetch:", err)
+			}
+			if err := e.mediaCache.Close(); err != nil {
+				e.logDebug("WARN", "media cache:", err)
+			}
+		}()
+		messages := e.consumer.Messages()
+		if e.prefetcher != nil {
+			messages = e.prefetcher.readAhead(ctx, messages)
+		}
+		// receive records a consumed message, and starts it straight
+		// away if it is a control message, which doesn't need a
+		// processing slot (so a task can be cancelled even when its
+		// chunks are using every slot).
+		// Returns false if the message is a chunk that still needs
+		// processing.
+		receive := func(msg *sarama.ConsumerMessage) bool {
+			e.offsets.track(msg)
+			e.tasks.consumed(msg)
+			if err := e.journal.consumed(msg); err != nil {
+				e.logDebug("WARN", "journal:", err)
+			}
+			// register in the order the messages were consumed,
+			// even though they may be processed in another order.
+			e.ordering.register(msg)
+			if !isControlMessage(msg) {
+				return false
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				e.processConsumed(ctx, msg, func() {})
+			}()
+			return true
+		}
+		// start processes a chunk in the processing slot that
+		// has been taken for it.
+		start := func(msg *sarama.ConsumerMessage) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				e.processConsumed(ctx, msg, func() {
+					// release the semaphore
+					<-e.processingSemaphore
+				})
+			}()
+		}
+		if e.scheduler != nil {
+			for {
+				select {
+				case msg, ok := <-messages:
+					if !ok {
+						// consumer has closed down
+						return
+					}
+					if receive(msg) {
+						continue
+					}
+					if err := e.scheduler.push(ctx, msg); err != nil {
+						return
+					}
+				case <-time.After(e.Config.Engine.EndIfIdleDuration):
+					e.logDebug(fmt.Sprintf("idle for %s", e.Config.Engine.EndIfIdleDuration))
+					return
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		// waiting holds the chunks read while every processing slot
+		// is busy, so control messages behind them are still seen.
+		var waiting []*sarama.ConsumerMessage
+		defer func() {
+			// chunks that were never started will be redelivered
+			for _, msg := range waiting {
+				e.ordering.forget(msg)
+				e.tasks.finished(msg)
+			}
 		}()
+		maxWaiting := e.Config.Fairness.MaxQueued
+		if maxWaiting < 1 {
+			maxWaiting = 1
+		}
 		for {
+			if messages == nil && len(waiting) == 0 {
+				// consumer has closed down
+				return
+			}
+			// pause starting chunks while the chunks in flight
+			// use up the memory budget.
+			var slots chan struct{}
+			hasSpace, spaceChanged := e.memory.space()
+			if hasSpace {
+				slots = e.processingSemaphore
+			}
+			if len(waiting) > 0 && hasSpace {
+				select {
+				case slots <- struct{}{}:
+					start(waiting[0])
+					waiting = waiting[1:]
+					continue
+				default:
+				}
+			}
+			readAhead := messages
+			if len(waiting) >= maxWaiting {
+				readAhead = nil
+			}
 			select {
-			case msg, ok := <-e.consumer.Messages():
-				if !ok {
-					// consumer has closed down
-					return
+			case slots <- struct{}{}:
+				// try to put something into the semaphore
+				// this will block if the channel is full
+				// causing processing to pause - it will unblock
+				// when we release the semaphore.
+				if len(waiting) > 0 {
+					start(waiting[0])
+					waiting = waiting[1:]
+					continue
 				}
-				e.consumer.MarkOffset(msg, "")
+				// the slot is taken before reading the next message,
+				// so that with several input topics the next message
+				// is chosen when it can be processed.
 				select {
+				case msg, ok := <-messages:
+					if !ok {
+						// consumer has closed down
+						<-e.processingSemaphore
+						return
+					}
+					if receive(msg) {
+						<-e.processingSemaphore
+						continue
+					}
+					start(msg)
+				case <-time.After(e.Config.Engine.EndIfIdleDuration):
+					<-e.processingSemaphore
+					e.logDebug(fmt.Sprintf("idle for %s", e.Config.Engine.EndIfIdleDuration))
+					return
 				case <-ctx.Done():
+					<-e.processingSemaphore
 					return
-				case e.processingSemaphore <- struct{}{}:
-					// try to put something into the semaphore
-					// this will block if the channel is full
-					// causing processing to pause - it will unblock
-					// when we release the semaphore.
 				}
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					if err := e.processMessage(ctx, msg); err != nil {
-						e.logDebug(fmt.Sprintf("processing error: %v", err))
-					}
-					// release the semaphore
-					<-e.processingSemaphore
-				}()
-			case <-time.After(e.Config.Engine.EndIfIdleDuration):
-				e.logDebug(fmt.Sprintf("idle for %s", e.Config.Engine.EndIfIdleDuration))
-				return
+			case msg, ok := <-readAhead:
+				if !ok {
+					// consumer has closed down, but the chunks
+					// already read are still processed
+					messages = nil
+					continue
+				}
+				if !receive(msg) {
+					waiting = append(waiting, msg)
+				}
+			case <-spaceChanged:
 			case <-ctx.Done():
 				return
 			}
 		}
 	}()
-	if cmd != nil {
+	if wait != nil {
 		// wait for the command
-		if err := cmd.Wait(); err != nil {
+		if err := wait(); err != nil {
 			if err := ctx.Err(); err != nil {
 				// if the context has an error, we'll assume this command
 				// errored because we terminated it (via context).
@@ -395,7 +736,71 @@ func (e *Engine) runInference(ctx context.Context) error {
 	return nil
 }
 
-func (e *Engine) processMessage(ctx context.Context, msg *sarama.ConsumerMessage) error {
+// runScheduler processes the messages released by the scheduler
+// as processing slots become available.
+// Blocks until the scheduler is closed and empty, or the context
+// is done.
+func (e *Engine) runScheduler(ctx context.Context, wg *sync.WaitGroup) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e.processingSemaphore <- struct{}{}:
+		}
+		if err := e.memory.waitForSpace(ctx); err != nil {
+			<-e.processingSemaphore
+			return
+		}
+		msg, done, ok := e.scheduler.next(ctx)
+		if !ok {
+			<-e.processingSemaphore
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.processConsumed(ctx, msg, func() {
+				done()
+				<-e.processingSemaphore
+			})
+		}()
+	}
+}
+
+// processConsumed processes a consumed message, and commits its
+// offset unless it was abandoned.
+// release releases the processing slot held for the message. It is
+// called once, either when the message is finished with or when its
+// result is waiting for its turn to be produced.
+func (e *Engine) processConsumed(ctx context.Context, msg *sarama.ConsumerMessage, release func()) {
+	var releaseOnce sync.Once
+	releaseSlot := func() {
+		releaseOnce.Do(release)
+	}
+	defer releaseSlot()
+	defer e.ordering.forget(msg)
+	defer e.tasks.finished(msg)
+	if err := e.journal.processing(msg); err != nil {
+		e.logDebug("WARN", "journal:", err)
+	}
+	err := e.processMessage(ctx, msg, releaseSlot)
+	if err != nil {
+		e.logDebug(fmt.Sprintf("processing error: %v", err))
+	}
+	if err := e.journal.done(msg); err != nil {
+		e.logDebug("WARN", "journal:", err)
+	}
+	if isAbandoned(err) {
+		// shutting down without producing a ChunkResult, so leave
+		// the offset uncommitted and let the message be redelivered
+		// when the partition is next consumed.
+		e.logDebug(fmt.Sprintf("not committing offset %d (partition %d)", msg.Offset, msg.Partition))
+	} else if commit := e.offsets.done(msg); commit != nil {
+		e.consumer.MarkOffset(commit, "")
+	}
+}
+
+func (e *Engine) processMessage(ctx context.Context, msg *sarama.ConsumerMessage, release func()) error {
 	start := time.Now()
 	defer func() {
 		now := time.Now()
@@ -405,13 +810,20 @@ func (e *Engine) processMessage(ctx context.Context, msg *sarama.ConsumerMessage
 		Type processing.MessageType
 	}
 	if err := json.Unmarshal(msg.Value, &typeCheck); err != nil {
-		return errors.Wrap(err, "unmarshal message value JSON")
+		// nothing can be done with it except set it aside
+		err = newChunkError(failureReasonInvalidMessage, errors.Wrap(err, "unmarshal message value JSON"))
+		e.sendDeadLetter(msg, nil, err)
+		return err
 	}
 	switch typeCheck.Type {
 	case processing.MessageTypeMediaChunk:
-		if err := e.processMessageMediaChunk(ctx, msg); err != nil {
+		if err := e.processMessageMediaChunk(ctx, msg, release); err != nil {
 			return errors.Wrap(err, "process media chunk")
 		}
+	case messageTypeChunkEOF, messageTypeTaskCancel:
+		if err := e.processMessageControl(ctx, msg); err != nil {
+			return errors.Wrap(err, "process control message")
+		}
 	default:
 		e.logDebug(fmt.Sprintf("ignoring message of type %q: %+v", typeCheck.Type, msg))
 	}
@@ -419,72 +831,223 @@ func (e *Engine) processMessage(ctx context.Context, msg *sarama.ConsumerMessage
 }
 
 // processMessageMediaChunk processes a single media chunk as described by the sarama.ConsumerMessage.
-func (e *Engine) processMessageMediaChunk(ctx context.Context, msg *sarama.ConsumerMessage) error {
-	var mediaChunk processing.MediaChunkMessage
-	if err := json.Unmarshal(msg.Value, &mediaChunk); err != nil {
-		return errors.Wrap(err, "unmarshal message value JSON")
+// If the ChunkResult could not be produced, an abandonedError is returned.
+// release is called to release the processing slot before waiting for
+// the ChunkResult's turn to be produced (see waitForTurn).
+func (e *Engine) processMessageMediaChunk(ctx context.Context, msg *sarama.ConsumerMessage, release func()) (err error) {
+	mediaChunk, err := validateMediaChunk(msg.Value)
+	// the media may have been prefetched even if the chunk is invalid
+	// or a duplicate.
+	defer e.prefetcher.remove(mediaChunk)
+	if err != nil {
+		e.waitForTurn(ctx, msg, release)
+		return e.processInvalidMessage(ctx, msg, mediaChunk, err)
+	}
+	if e.journal.crashed(msg) {
+		// already reported as crashed when the engine started, so
+		// don't send a second result for it.
+		e.logDebug(fmt.Sprintf("chunk %s was reported as crashed by a previous run, dropping it", mediaChunk.ChunkUUID))
+		return nil
 	}
+	traceID := messageTraceID(msg, mediaChunk.ChunkUUID)
 	e.sendEvent(event{
 		Key:     mediaChunk.ChunkUUID,
+		TraceID: traceID,
 		Type:    eventConsumed,
 		JobID:   mediaChunk.JobID,
 		TaskID:  mediaChunk.TaskID,
 		ChunkID: mediaChunk.ChunkUUID,
 	})
-	finalUpdateMessage := processing.ChunkResult{
-		Type:      processing.MessageTypeChunkResult,
-		TaskID:    mediaChunk.TaskID,
-		ChunkUUID: mediaChunk.ChunkUUID,
-		Status:    processing.ChunkStatusSuccess, // optimistic
+	dedupeKey := dedupeKey(mediaChunk.TaskID, mediaChunk.ChunkUUID)
+	if result, ok := e.dedupe.get(dedupeKey); ok {
+		// already processed (probably redelivered after a rebalance),
+		// so send the same result again rather than calling the webhook.
+		e.logDebug(fmt.Sprintf("chunk %s has already been processed, sending previous result", mediaChunk.ChunkUUID))
+		e.waitForTurn(ctx, msg, release)
+		if err := e.sendChunkResult(ctx, msg.Key, traceID, result); err != nil {
+			return abandonedError{err: errors.Wrap(err, "send final chunk update")}
+		}
+		e.sendEvent(event{
+			Key:     mediaChunk.ChunkUUID,
+			TraceID: traceID,
+			Type:    eventProduced,
+			JobID:   mediaChunk.JobID,
+			TaskID:  mediaChunk.TaskID,
+			ChunkID: mediaChunk.ChunkUUID,
+		})
+		return nil
+	}
+	finalUpdateMessage := chunkResult{
+		ChunkResult: processing.ChunkResult{
+			Type:      processing.MessageTypeChunkResult,
+			TaskID:    mediaChunk.TaskID,
+			ChunkUUID: mediaChunk.ChunkUUID,
+			Status:    processing.ChunkStatusSuccess, // optimistic
+		},
 	}
+	var attempts []webhookAttempt
 	defer func() {
+		if ctx.Err() != nil && err != nil {
+			// shutting down part way through a chunk; report nothing
+			// so that it is redelivered to another instance.
+			err = abandonedError{err: err}
+			return
+		}
 		// send the final (ChunkResult) message
-		finalUpdateMessage.TimestampUTC = time.Now().Unix()
-		_, _, err := e.producer.SendMessage(&sarama.ProducerMessage{
-			Topic: e.Config.Kafka.ChunkTopic,
-			Key:   sarama.ByteEncoder(msg.Key),
-			Value: processing.NewJSONEncoder(finalUpdateMessage),
-		})
-		if err != nil {
-			e.logDebug("WARN", "failed to send final chunk update:", err)
+		finalUpdateMessage.Attempts = len(attempts)
+		e.waitForTurn(ctx, msg, release)
+		if sendErr := e.sendChunkResult(ctx, msg.Key, traceID, finalUpdateMessage); sendErr != nil {
+			err = abandonedError{err: errors.Wrap(sendErr, "send final chunk update")}
+			return
+		}
+		if err := e.dedupe.add(dedupeKey, finalUpdateMessage); err != nil {
+			e.logDebug("WARN", "dedupe:", err)
 		}
 		e.sendEvent(event{
 			Key:     mediaChunk.ChunkUUID,
+			TraceID: traceID,
 			Type:    eventProduced,
 			JobID:   mediaChunk.JobID,
 			TaskID:  mediaChunk.TaskID,
 			ChunkID: mediaChunk.ChunkUUID,
 		})
 	}()
+	// chunkCtx carries the deadline for the whole chunk, which
+	// is shared by every attempt. It is also cancelled if the
+	// task is cancelled, like taskCtx, which has no deadline.
+	taskCtx, done := e.tasks.track(ctx, mediaChunk.TaskID)
+	defer done()
+	chunkCtx := taskCtx
+	if timeout := e.chunkTimeout(msg); timeout > 0 {
+		var cancel context.CancelFunc
+		chunkCtx, cancel = context.WithTimeout(chunkCtx, timeout)
+		defer cancel()
+	}
+	if e.tasks.isCancelled(mediaChunk.TaskID) {
+		finalUpdateMessage.Status = processing.ChunkStatusError
+		finalUpdateMessage.ErrorMsg = "task was cancelled"
+		finalUpdateMessage.FailureReason = failureReasonCancelled
+		finalUpdateMessage.FailureMsg = finalUpdateMessage.ErrorMsg
+		return nil
+	}
 	ignoreChunk := false
-	retry := processing.NewDoubleTimeBackoff(
-		e.Config.Webhooks.Backoff.InitialBackoffDuration,
-		e.Config.Webhooks.Backoff.MaxBackoffDuration,
-		e.Config.Webhooks.Backoff.MaxRetries,
-	)
 	var content string
-	err := retry.Do(func() error {
-		req, err := processing.NewRequestFromMediaChunk(e.webhookClient, e.Config.Webhooks.Process.URL,
-			mediaChunk, e.Config.Processing.DisableChunkDownload, "" ,"", "", 0)
+	// chunkBytes is the size of the chunk held against the memory
+	// budget, which is estimated once and then updated when the
+	// chunk is downloaded, so retries don't estimate it again.
+	chunkBytes := int64(-1)
+	process := func() (err error) {
+		start := time.Now()
+		attempt := webhookAttempt{StartedUTC: start.UTC().UnixNano() / 1e6}
+		defer func() {
+			attempt.DurationMS = int64(time.Since(start) / time.Millisecond)
+			if err != nil {
+				attempt.Error = err.Error()
+			}
+			attempts = append(attempts, attempt)
+		}()
+		if err := chunkCtx.Err(); err != nil {
+			return newChunkError(failureReasonTimeout, err)
+		}
+		// hold the size of the chunk against the memory budget
+		// while it is being processed.
+		var hold *memoryHold
+		if e.memory != nil {
+			if chunkBytes < 0 {
+				chunkBytes = e.chunkSize(chunkCtx, mediaChunk)
+			}
+			hold, err = e.memory.hold(chunkCtx, chunkBytes)
+			if err != nil {
+				return newChunkError(failureReasonTimeout, err)
+			}
+		}
+		defer func() {
+			// retries hold what was actually read
+			if measured := hold.release(); measured > 0 {
+				chunkBytes = measured
+			}
+		}()
+		if e.batches != nil {
+			result := e.processBatched(chunkCtx, mediaChunk, hold)
+			attempt.StatusCode = result.statusCode
+			if result.err != nil {
+				return result.err
+			}
+			ignoreChunk = result.ignored
+			content = result.content
+			return nil
+		}
+		if e.rpc != nil {
+			resp, err := e.processRPC(chunkCtx, mediaChunk, hold)
+			if err != nil {
+				return err
+			}
+			ignoreChunk = resp.Ignored
+			content = resp.Content
+			return nil
+		}
+		var req *http.Request
+		if e.prefetcher != nil || e.mediaCache != nil {
+			req, err = e.newStreamingRequest(chunkCtx, mediaChunk, hold)
+			if err != nil {
+				return err
+			}
+		} else {
+			req, err = processing.NewRequestFromMediaChunk(e.webhookClient, e.Config.Webhooks.Process.URL,
+				mediaChunk, e.Config.Processing.DisableChunkDownload, "", "", "", 0)
+			if err != nil {
+				return newChunkError(failureReasonDownloadFailed, errors.Wrap(err, "new request"))
+			}
+		}
+		if req.ContentLength > 0 {
+			// the chunk has already been downloaded, so account
+			// for the actual size.
+			hold.measure(req.ContentLength)
+		}
+		waiter, err := e.callbacks.register()
 		if err != nil {
-			return errors.Wrap(err, "new request")
+			return newChunkError(failureReasonInternalError, err)
 		}
-		req = req.WithContext(ctx)
+		defer e.callbacks.remove(waiter)
+		if waiter != nil {
+			req.Header.Set(callbackURLHeader, waiter.url)
+		}
+		req = req.WithContext(chunkCtx)
+		sent := time.Now()
 		resp, err := e.webhookClient.Do(req)
 		if err != nil {
-			return err
+			if chunkCtx.Err() == nil {
+				e.concurrency.observe(time.Since(sent), true)
+			}
+			return newChunkError(failureReasonEngineUnavailable, err)
 		}
+		e.concurrency.observe(time.Since(sent), isOverloaded(resp.StatusCode))
 		defer resp.Body.Close()
+		attempt.StatusCode = resp.StatusCode
 		if resp.StatusCode == http.StatusNoContent {
 			ignoreChunk = true
 			return nil
 		}
+		if resp.StatusCode == http.StatusAccepted && waiter != nil {
+			// the engine will send the output to the callback URL
+			e.logDebug(fmt.Sprintf("chunk %s accepted (job handle %q), waiting for callback", mediaChunk.ChunkUUID, acceptedJobHandle(resp.Body)))
+			// the async timeout applies instead of the chunk timeout
+			ignoreChunk, content, err = e.waitForCallback(taskCtx, waiter, func(callback asyncCallback) {
+				e.logDebug(fmt.Sprintf("progress for chunk %s: %s", mediaChunk.ChunkUUID, callback.Message))
+				if output := callback.output(); output != "" {
+					if err := e.produceInterimOutput(msg.Key, traceID, mediaChunk, output); err != nil {
+						e.logDebug("WARN", "failed to send interim output:", err)
+					}
+				}
+			})
+			return err
+		}
 		if resp.StatusCode != http.StatusOK {
 			var buf bytes.Buffer
 			if _, err := io.Copy(&buf, resp.Body); err != nil {
-				return errors.Wrap(err, "read body")
+				return newChunkError(failureReasonEngineError, errors.Wrap(err, "read body"))
 			}
-			return errors.Errorf("%d: %s", resp.StatusCode, strings.TrimSpace(buf.String()))
+			return newWebhookError(resp.StatusCode, resp.Header, buf.Bytes())
 		}
 		if resp.ContentLength == 0 {
 			ignoreChunk = true
@@ -498,7 +1061,7 @@ func (e *Engine) processMessageMediaChunk(ctx context.Context, msg *sarama.Consu
 			// files output
 			payload, err := mediaChunk.UnmarshalPayload()
 			if err != nil {
-				return errors.Wrap(err, "unmarshal payload")
+				return newChunkError(failureReasonInternalError, errors.Wrap(err, "unmarshal payload"))
 			}
 			type mediaItem struct {
 				AssetID     string `json:"assetId"`
@@ -514,19 +1077,19 @@ func (e *Engine) processMessageMediaChunk(ctx context.Context, msg *sarama.Consu
 					break
 				}
 				if err != nil {
-					return errors.Wrap(err, "reading multipart response")
+					return newChunkError(failureReasonEngineError, errors.Wrap(err, "reading multipart response"))
 				}
 				assetCreate := processing.AssetCreate{
-                                        AssetType:      "media",
+					AssetType:      "media",
 					ContainerTDOID: mediaChunk.TDOID,
 					ContentType:    p.Header.Get("Content-Type"),
 					Name:           p.FileName(),
 					Body:           p,
 				}
 				client := vericlient.NewClient(e.graphQLHTTPClient, payload.Token, payload.VeritoneAPIBaseURL+"/v3/graphql")
-				createdAsset, err := assetCreate.Do(ctx, client)
+				createdAsset, err := assetCreate.Do(chunkCtx, client)
 				if err != nil {
-					return errors.Wrapf(err, "create asset for %s", p.FileName())
+					return newChunkError(failureReasonAssetUploadFailed, errors.Wrapf(err, "create asset for %s", p.FileName()))
 				}
 				outputJSON.Media = append(outputJSON.Media, mediaItem{
 					AssetID:     createdAsset.ID,
@@ -539,22 +1102,63 @@ func (e *Engine) processMessageMediaChunk(ctx context.Context, msg *sarama.Consu
 				return errors.Wrap(err, "encode output JSON")
 			}
 			content = string(jsonBytes)
+		} else if mediaType == ndjsonContentType {
+			// streamed series items
+			streamed, err := e.readStreamedOutput(msg.Key, traceID, mediaChunk, resp.Body)
+			if err != nil {
+				return err
+			}
+			content = streamed
 		} else {
 			// JSON output
 			bodyBytes, err := ioutil.ReadAll(resp.Body)
 			if err != nil {
-				return errors.Wrap(err, "read response body")
+				return newChunkError(failureReasonEngineError, errors.Wrap(err, "read response body"))
 			}
 			content = string(bodyBytes)
 		}
 		return nil
-	})
+	}
+	retry := e.newRetryPolicy()
+	for {
+		if err = process(); err == nil {
+			break
+		}
+		delay, throttled, ok := retry.next(err)
+		if !ok {
+			break
+		}
+		if throttled {
+			e.throttle(ctx, delay)
+		}
+		e.logDebug(fmt.Sprintf("retrying chunk %s in %s: %v", mediaChunk.ChunkUUID, delay, err))
+		select {
+		case <-time.After(delay):
+		case <-chunkCtx.Done():
+		}
+	}
+	if err == nil && !ignoreChunk && e.isOutputTooLarge(content) {
+		content, err = e.offloadOutput(chunkCtx, mediaChunk, content)
+	}
 	if err != nil {
+		cancelled := e.tasks.isCancelled(mediaChunk.TaskID)
+		if ctx.Err() == nil && !cancelled {
+			e.sendDeadLetter(msg, attempts, err)
+		}
 		// send error message
 		finalUpdateMessage.Status = processing.ChunkStatusError
 		finalUpdateMessage.ErrorMsg = err.Error()
-		finalUpdateMessage.FailureReason = "internal_error"
-		finalUpdateMessage.FailureMsg = finalUpdateMessage.ErrorMsg
+		finalUpdateMessage.FailureReason, finalUpdateMessage.FailureMsg = failureDetails(err)
+		if chunkCtx.Err() == context.DeadlineExceeded {
+			finalUpdateMessage.ErrorMsg = fmt.Sprintf("chunk timed out after %s: %v", e.chunkTimeout(msg), err)
+			finalUpdateMessage.FailureReason = failureReasonTimeout
+			finalUpdateMessage.FailureMsg = finalUpdateMessage.ErrorMsg
+		}
+		if cancelled {
+			finalUpdateMessage.ErrorMsg = fmt.Sprintf("task was cancelled: %v", err)
+			finalUpdateMessage.FailureReason = failureReasonCancelled
+			finalUpdateMessage.FailureMsg = finalUpdateMessage.ErrorMsg
+		}
 		return err
 	}
 	if ignoreChunk {
@@ -579,6 +1183,77 @@ func (e *Engine) processMessageMediaChunk(ctx context.Context, msg *sarama.Consu
 	return nil
 }
 
+// chunkTimeout gets the maximum amount of time allowed to process the
+// chunk in msg. The task payload may override the configured timeout.
+// Zero means there is no limit.
+func (e *Engine) chunkTimeout(msg *sarama.ConsumerMessage) time.Duration {
+	options, err := taskOptionsFromMessage(msg.Value)
+	if err != nil {
+		e.logDebug("WARN", "task payload options:", err)
+		return e.Config.Chunk.Timeout
+	}
+	if options.ChunkTimeout == "" {
+		return e.Config.Chunk.Timeout
+	}
+	timeout, err := time.ParseDuration(options.ChunkTimeout)
+	if err != nil {
+		e.logDebug("WARN", fmt.Sprintf("task payload chunkTimeout %q: %v", options.ChunkTimeout, err))
+		return e.Config.Chunk.Timeout
+	}
+	return timeout
+}
+
+// waitForTurn waits until the ChunkResult for msg may be produced, if
+// output is ordered.
+// The processing slot is released first, so chunks waiting for earlier
+// ones to finish don't stop other chunks being processed; the waiting
+// results are limited by Ordering.MaxBuffered instead.
+func (e *Engine) waitForTurn(ctx context.Context, msg *sarama.ConsumerMessage, release func()) {
+	if e.ordering == nil {
+		return
+	}
+	release()
+	e.ordering.wait(ctx, msg)
+}
+
+// sendChunkResult sends the ChunkResult to the chunk topic, retrying
+// with backoff until it is sent.
+// An error is only returned if the context is done first, in which
+// case the message is abandoned. Giving up any sooner would leave its
+// offset uncommitted, which holds back every later offset in the
+// partition.
+func (e *Engine) sendChunkResult(ctx context.Context, key []byte, traceID string, result chunkResult) error {
+	backoff := minProduceBackoff
+	for {
+		err := e.produceChunkResult(key, traceID, result)
+		if err == nil {
+			return nil
+		}
+		e.logDebug("WARN", fmt.Sprintf("failed to send final chunk update (retrying in %s): %v", backoff, err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if backoff > maxProduceBackoff {
+			backoff = maxProduceBackoff
+		}
+	}
+}
+
+// produceChunkResult sends the ChunkResult to the chunk topic.
+func (e *Engine) produceChunkResult(key []byte, traceID string, result chunkResult) error {
+	result.TimestampUTC = time.Now().Unix()
+	_, _, err := e.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   e.Config.Kafka.ChunkTopic,
+		Key:     sarama.ByteEncoder(key),
+		Value:   processing.NewJSONEncoder(result),
+		Headers: e.recordHeaders(traceID),
+	})
+	return err
+}
+
 // ready returns a channel that is closed when the engine is
 // ready.
 // The channel may receive an error if something goes wrong while waiting
@@ -594,7 +1269,16 @@ func (e *Engine) ready(ctx context.Context) error {
 			e.logDebug("ready: exceeded", e.Config.Webhooks.Ready.MaximumPollDuration)
 			return errReadyTimeout
 		}
-		resp, err := http.Get(e.Config.Webhooks.Ready.URL)
+		if e.rpc != nil {
+			if err := e.rpc.ready(ctx); err != nil {
+				e.logDebug("ready: err:", err)
+				time.Sleep(e.Config.Webhooks.Ready.PollDuration)
+				continue
+			}
+			e.logDebug("ready: yes")
+			return nil
+		}
+		resp, err := e.webhookClient.Get(e.Config.Webhooks.Ready.URL)
 		if err != nil {
 			e.logDebug("ready: err:", err)
 			time.Sleep(e.Config.Webhooks.Ready.PollDuration)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -114,7 +115,7 @@ func TestProcessingChunk(t *testing.T) {
 	is.NoErr(err)
 	is.Equal(len(output.Series), 1)
 	is.Equal(output.Series[0].Object.Label, "something")
-	is.Equal(inputPipe.Offset, int64(1)) // Offset
+	waitForOffset(t, inputPipe, 1)
 
 	// stop the engine
 	cancel()
@@ -212,7 +213,7 @@ func TestProcessingChunkError(t *testing.T) {
 	is.NoErr(err)
 
 	var outputMsg *sarama.ConsumerMessage
-	var chunkResult processing.ChunkResult
+	var chunkResult chunkResult
 
 	// read the chunk success message
 	select {
@@ -230,8 +231,9 @@ func TestProcessingChunkError(t *testing.T) {
 	is.Equal(chunkResult.TaskID, inputMessage.TaskID)
 	is.Equal(chunkResult.ChunkUUID, inputMessage.ChunkUUID)
 	is.Equal(chunkResult.Status, processing.ChunkStatusError)
-	is.Equal(chunkResult.FailureReason, "internal_error")
+	is.Equal(chunkResult.FailureReason, failureReasonEngineError)
 	is.Equal(chunkResult.FailureMsg, "500: Something went wrong")
+	is.Equal(chunkResult.Attempts, 2) // initial attempt and one retry
 	is.True(chunkResult.EngineOutput == nil)
 }
 
@@ -427,7 +429,7 @@ func TestIgnoredChunks(t *testing.T) {
 	is.Equal(chunkProcessedStatus.ChunkUUID, inputMessage.ChunkUUID)
 	is.Equal(chunkProcessedStatus.Status, processing.ChunkStatusIgnored)
 
-	is.Equal(inputPipe.Offset, int64(1)) // Offset
+	waitForOffset(t, inputPipe, 1)
 }
 
 func TestSubprocessCrash(t *testing.T) {
@@ -492,3 +494,74 @@ type coords struct {
 	X float64 `json:"x"`
 	Y float64 `json:"y"`
 }
+
+// TestChunkTimeout ensures a hung Process webhook is cancelled once the
+// chunk deadline expires, and that retries share the same deadline.
+func TestChunkTimeout(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Chunk.Timeout = 1 * time.Minute
+	engine.Config.Webhooks.Backoff.MaxRetries = 3
+	engine.Config.Webhooks.Backoff.InitialBackoffDuration = 10 * time.Millisecond
+	engine.Config.Webhooks.Backoff.MaxBackoffDuration = 10 * time.Millisecond
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	var lock sync.Mutex
+	var calls int
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		_, err := ioutil.ReadAll(r.Body)
+		is.NoErr(err)
+		// hang until the toolkit gives up
+		<-r.Context().Done()
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	// the task payload overrides the configured timeout
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder("task1"),
+		Value:  sarama.StringEncoder(`{"type":"media_chunk","chunkUUID":"123","taskId":"task1","taskPayload":{"chunkTimeout":"200ms"}}`),
+	})
+	is.NoErr(err)
+
+	var outputMsg *sarama.ConsumerMessage
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	var chunkResult processing.ChunkResult
+	err = json.Unmarshal(outputMsg.Value, &chunkResult)
+	is.NoErr(err)
+	is.Equal(chunkResult.ChunkUUID, "123")
+	is.Equal(chunkResult.Status, processing.ChunkStatusError)
+	is.Equal(chunkResult.FailureReason, failureReasonTimeout)
+	is.True(strings.HasPrefix(chunkResult.FailureMsg, "chunk timed out after 200ms"))
+	lock.Lock()
+	defer lock.Unlock()
+	is.Equal(calls, 1) // retries must not get a fresh deadline
+}
@@ -0,0 +1,589 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: engine.proto
+
+// Package enginepb describes the gRPC alternative to the Engine
+// Toolkit webhooks.
+
+package enginepb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type ReadyRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReadyRequest) Reset()         { *m = ReadyRequest{} }
+func (m *ReadyRequest) String() string { return proto.CompactTextString(m) }
+func (*ReadyRequest) ProtoMessage()    {}
+func (*ReadyRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_770b178c3aab763f, []int{0}
+}
+
+func (m *ReadyRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReadyRequest.Unmarshal(m, b)
+}
+func (m *ReadyRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReadyRequest.Marshal(b, m, deterministic)
+}
+func (m *ReadyRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReadyRequest.Merge(m, src)
+}
+func (m *ReadyRequest) XXX_Size() int {
+	return xxx_messageInfo_ReadyRequest.Size(m)
+}
+func (m *ReadyRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReadyRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReadyRequest proto.InternalMessageInfo
+
+type ReadyResponse struct {
+	// ready is whether the engine is ready to process chunks.
+	Ready                bool     `protobuf:"varint,1,opt,name=ready,proto3" json:"ready,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ReadyResponse) Reset()         { *m = ReadyResponse{} }
+func (m *ReadyResponse) String() string { return proto.CompactTextString(m) }
+func (*ReadyResponse) ProtoMessage()    {}
+func (*ReadyResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_770b178c3aab763f, []int{1}
+}
+
+func (m *ReadyResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ReadyResponse.Unmarshal(m, b)
+}
+func (m *ReadyResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ReadyResponse.Marshal(b, m, deterministic)
+}
+func (m *ReadyResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ReadyResponse.Merge(m, src)
+}
+func (m *ReadyResponse) XXX_Size() int {
+	return xxx_messageInfo_ReadyResponse.Size(m)
+}
+func (m *ReadyResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ReadyResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ReadyResponse proto.InternalMessageInfo
+
+func (m *ReadyResponse) GetReady() bool {
+	if m != nil {
+		return m.Ready
+	}
+	return false
+}
+
+// ProcessRequest has the same fields as the Process webhook form.
+type ProcessRequest struct {
+	ChunkUuid            string `protobuf:"bytes,1,opt,name=chunk_uuid,json=chunkUuid,proto3" json:"chunk_uuid,omitempty"`
+	ChunkMimeType        string `protobuf:"bytes,2,opt,name=chunk_mime_type,json=chunkMimeType,proto3" json:"chunk_mime_type,omitempty"`
+	StartOffsetMs        int32  `protobuf:"varint,3,opt,name=start_offset_ms,json=startOffsetMs,proto3" json:"start_offset_ms,omitempty"`
+	EndOffsetMs          int32  `protobuf:"varint,4,opt,name=end_offset_ms,json=endOffsetMs,proto3" json:"end_offset_ms,omitempty"`
+	Width                int32  `protobuf:"varint,5,opt,name=width,proto3" json:"width,omitempty"`
+	Height               int32  `protobuf:"varint,6,opt,name=height,proto3" json:"height,omitempty"`
+	LibraryId            string `protobuf:"bytes,7,opt,name=library_id,json=libraryId,proto3" json:"library_id,omitempty"`
+	LibraryEngineModelId string `protobuf:"bytes,8,opt,name=library_engine_model_id,json=libraryEngineModelId,proto3" json:"library_engine_model_id,omitempty"`
+	CacheUri             string `protobuf:"bytes,9,opt,name=cache_uri,json=cacheUri,proto3" json:"cache_uri,omitempty"`
+	VeritoneApiBaseUrl   string `protobuf:"bytes,10,opt,name=veritone_api_base_url,json=veritoneApiBaseUrl,proto3" json:"veritone_api_base_url,omitempty"`
+	Token                string `protobuf:"bytes,11,opt,name=token,proto3" json:"token,omitempty"`
+	// payload is the task payload JSON.
+	Payload string `protobuf:"bytes,12,opt,name=payload,proto3" json:"payload,omitempty"`
+	// chunk is the chunk media, unless chunk downloads are disabled.
+	Chunk                []byte   `protobuf:"bytes,13,opt,name=chunk,proto3" json:"chunk,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ProcessRequest) Reset()         { *m = ProcessRequest{} }
+func (m *ProcessRequest) String() string { return proto.CompactTextString(m) }
+func (*ProcessRequest) ProtoMessage()    {}
+func (*ProcessRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_770b178c3aab763f, []int{2}
+}
+
+func (m *ProcessRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ProcessRequest.Unmarshal(m, b)
+}
+func (m *ProcessRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ProcessRequest.Marshal(b, m, deterministic)
+}
+func (m *ProcessRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ProcessRequest.Merge(m, src)
+}
+func (m *ProcessRequest) XXX_Size() int {
+	return xxx_messageInfo_ProcessRequest.Size(m)
+}
+func (m *ProcessRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ProcessRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ProcessRequest proto.InternalMessageInfo
+
+func (m *ProcessRequest) GetChunkUuid() string {
+	if m != nil {
+		return m.ChunkUuid
+	}
+	return ""
+}
+
+func (m *ProcessRequest) GetChunkMimeType() string {
+	if m != nil {
+		return m.ChunkMimeType
+	}
+	return ""
+}
+
+func (m *ProcessRequest) GetStartOffsetMs() int32 {
+	if m != nil {
+		return m.StartOffsetMs
+	}
+	return 0
+}
+
+func (m *ProcessRequest) GetEndOffsetMs() int32 {
+	if m != nil {
+		return m.EndOffsetMs
+	}
+	return 0
+}
+
+func (m *ProcessRequest) GetWidth() int32 {
+	if m != nil {
+		return m.Width
+	}
+	return 0
+}
+
+func (m *ProcessRequest) GetHeight() int32 {
+	if m != nil {
+		return m.Height
+	}
+	return 0
+}
+
+func (m *ProcessRequest) GetLibraryId() string {
+	if m != nil {
+		return m.LibraryId
+	}
+	return ""
+}
+
+func (m *ProcessRequest) GetLibraryEngineModelId() string {
+	if m != nil {
+		return m.LibraryEngineModelId
+	}
+	return ""
+}
+
+func (m *ProcessRequest) GetCacheUri() string {
+	if m != nil {
+		return m.CacheUri
+	}
+	return ""
+}
+
+func (m *ProcessRequest) GetVeritoneApiBaseUrl() string {
+	if m != nil {
+		return m.VeritoneApiBaseUrl
+	}
+	return ""
+}
+
+func (m *ProcessRequest) GetToken() string {
+	if m != nil {
+		return m.Token
+	}
+	return ""
+}
+
+func (m *ProcessRequest) GetPayload() string {
+	if m != nil {
+		return m.Payload
+	}
+	return ""
+}
+
+func (m *ProcessRequest) GetChunk() []byte {
+	if m != nil {
+		return m.Chunk
+	}
+	return nil
+}
+
+type ProcessResponse struct {
+	// ignored is whether the engine chose not to process the chunk,
+	// like a 204 response from the Process webhook.
+	Ignored bool `protobuf:"varint,1,opt,name=ignored,proto3" json:"ignored,omitempty"`
+	// content is the engine output JSON.
+	Content              string   `protobuf:"bytes,2,opt,name=content,proto3" json:"content,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ProcessResponse) Reset()         { *m = ProcessResponse{} }
+func (m *ProcessResponse) String() string { return proto.CompactTextString(m) }
+func (*ProcessResponse) ProtoMessage()    {}
+func (*ProcessResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_770b178c3aab763f, []int{3}
+}
+
+func (m *ProcessResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ProcessResponse.Unmarshal(m, b)
+}
+func (m *ProcessResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ProcessResponse.Marshal(b, m, deterministic)
+}
+func (m *ProcessResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ProcessResponse.Merge(m, src)
+}
+func (m *ProcessResponse) XXX_Size() int {
+	return xxx_messageInfo_ProcessResponse.Size(m)
+}
+func (m *ProcessResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ProcessResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ProcessResponse proto.InternalMessageInfo
+
+func (m *ProcessResponse) GetIgnored() bool {
+	if m != nil {
+		return m.Ignored
+	}
+	return false
+}
+
+func (m *ProcessResponse) GetContent() string {
+	if m != nil {
+		return m.Content
+	}
+	return ""
+}
+
+type FinalizeRequest struct {
+	TaskId               string   `protobuf:"bytes,1,opt,name=task_id,json=taskId,proto3" json:"task_id,omitempty"`
+	JobId                string   `protobuf:"bytes,2,opt,name=job_id,json=jobId,proto3" json:"job_id,omitempty"`
+	TdoId                string   `protobuf:"bytes,3,opt,name=tdo_id,json=tdoId,proto3" json:"tdo_id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FinalizeRequest) Reset()         { *m = FinalizeRequest{} }
+func (m *FinalizeRequest) String() string { return proto.CompactTextString(m) }
+func (*FinalizeRequest) ProtoMessage()    {}
+func (*FinalizeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_770b178c3aab763f, []int{4}
+}
+
+func (m *FinalizeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FinalizeRequest.Unmarshal(m, b)
+}
+func (m *FinalizeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FinalizeRequest.Marshal(b, m, deterministic)
+}
+func (m *FinalizeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FinalizeRequest.Merge(m, src)
+}
+func (m *FinalizeRequest) XXX_Size() int {
+	return xxx_messageInfo_FinalizeRequest.Size(m)
+}
+func (m *FinalizeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_FinalizeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FinalizeRequest proto.InternalMessageInfo
+
+func (m *FinalizeRequest) GetTaskId() string {
+	if m != nil {
+		return m.TaskId
+	}
+	return ""
+}
+
+func (m *FinalizeRequest) GetJobId() string {
+	if m != nil {
+		return m.JobId
+	}
+	return ""
+}
+
+func (m *FinalizeRequest) GetTdoId() string {
+	if m != nil {
+		return m.TdoId
+	}
+	return ""
+}
+
+type FinalizeResponse struct {
+	// content is any final engine output JSON for the task.
+	Content              string   `protobuf:"bytes,1,opt,name=content,proto3" json:"content,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *FinalizeResponse) Reset()         { *m = FinalizeResponse{} }
+func (m *FinalizeResponse) String() string { return proto.CompactTextString(m) }
+func (*FinalizeResponse) ProtoMessage()    {}
+func (*FinalizeResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_770b178c3aab763f, []int{5}
+}
+
+func (m *FinalizeResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_FinalizeResponse.Unmarshal(m, b)
+}
+func (m *FinalizeResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_FinalizeResponse.Marshal(b, m, deterministic)
+}
+func (m *FinalizeResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_FinalizeResponse.Merge(m, src)
+}
+func (m *FinalizeResponse) XXX_Size() int {
+	return xxx_messageInfo_FinalizeResponse.Size(m)
+}
+func (m *FinalizeResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_FinalizeResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_FinalizeResponse proto.InternalMessageInfo
+
+func (m *FinalizeResponse) GetContent() string {
+	if m != nil {
+		return m.Content
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*ReadyRequest)(nil), "enginepb.ReadyRequest")
+	proto.RegisterType((*ReadyResponse)(nil), "enginepb.ReadyResponse")
+	proto.RegisterType((*ProcessRequest)(nil), "enginepb.ProcessRequest")
+	proto.RegisterType((*ProcessResponse)(nil), "enginepb.ProcessResponse")
+	proto.RegisterType((*FinalizeRequest)(nil), "enginepb.FinalizeRequest")
+	proto.RegisterType((*FinalizeResponse)(nil), "enginepb.FinalizeResponse")
+}
+
+func init() { proto.RegisterFile("engine.proto", fileDescriptor_770b178c3aab763f) }
+
+var fileDescriptor_770b178c3aab763f = []byte{
+	// 508 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x93, 0x4f, 0x8b, 0xd3, 0x40,
+	0x18, 0xc6, 0x89, 0x35, 0x69, 0xfb, 0x6e, 0xbb, 0x95, 0xa1, 0xbb, 0x1d, 0x2b, 0x42, 0x09, 0x28,
+	0x3d, 0x48, 0x41, 0x45, 0xf0, 0x24, 0xec, 0xc2, 0x0a, 0x3d, 0x14, 0x25, 0x58, 0x10, 0x2f, 0x21,
+	0xe9, 0xbc, 0xdb, 0xce, 0x36, 0x9d, 0x89, 0x99, 0x89, 0x52, 0xbf, 0x9b, 0x47, 0xbf, 0x97, 0xcc,
+	0x9f, 0xb4, 0x5d, 0xdd, 0xe3, 0xf3, 0x3c, 0xbf, 0x0c, 0xef, 0xbf, 0x40, 0x0f, 0xc5, 0x9a, 0x0b,
+	0x9c, 0x95, 0x95, 0xd4, 0x92, 0x74, 0x9c, 0x2a, 0xf3, 0xf8, 0x1c, 0x7a, 0x09, 0x66, 0x6c, 0x9f,
+	0xe0, 0xf7, 0x1a, 0x95, 0x8e, 0x5f, 0x40, 0xdf, 0x6b, 0x55, 0x4a, 0xa1, 0x90, 0x0c, 0x21, 0xac,
+	0x8c, 0x41, 0x83, 0x49, 0x30, 0xed, 0x24, 0x4e, 0xc4, 0xbf, 0x5b, 0x70, 0xfe, 0xb9, 0x92, 0x2b,
+	0x54, 0xca, 0x7f, 0x49, 0x9e, 0x03, 0xac, 0x36, 0xb5, 0xd8, 0xa6, 0x75, 0xcd, 0x99, 0xa5, 0xbb,
+	0x49, 0xd7, 0x3a, 0xcb, 0x9a, 0x33, 0xf2, 0x12, 0x06, 0x2e, 0xde, 0xf1, 0x1d, 0xa6, 0x7a, 0x5f,
+	0x22, 0x7d, 0x64, 0x99, 0xbe, 0xb5, 0x17, 0x7c, 0x87, 0x5f, 0xf6, 0x25, 0x1a, 0x4e, 0xe9, 0xac,
+	0xd2, 0xa9, 0xbc, 0xbd, 0x55, 0xa8, 0xd3, 0x9d, 0xa2, 0xad, 0x49, 0x30, 0x0d, 0x93, 0xbe, 0xb5,
+	0x3f, 0x59, 0x77, 0xa1, 0x48, 0x0c, 0x7d, 0x14, 0xec, 0x84, 0x7a, 0x6c, 0xa9, 0x33, 0x14, 0xec,
+	0xc0, 0x0c, 0x21, 0xfc, 0xc9, 0x99, 0xde, 0xd0, 0xd0, 0x66, 0x4e, 0x90, 0x4b, 0x88, 0x36, 0xc8,
+	0xd7, 0x1b, 0x4d, 0x23, 0x6b, 0x7b, 0x65, 0x1a, 0x28, 0x78, 0x5e, 0x65, 0xd5, 0x3e, 0xe5, 0x8c,
+	0xb6, 0x5d, 0x03, 0xde, 0x99, 0x33, 0xf2, 0x0e, 0x46, 0x4d, 0xec, 0xa6, 0x97, 0xee, 0x24, 0xc3,
+	0xc2, 0xb0, 0x1d, 0xcb, 0x0e, 0x7d, 0x7c, 0x63, 0xd3, 0x85, 0x09, 0xe7, 0x8c, 0x3c, 0x83, 0xee,
+	0x2a, 0x5b, 0x6d, 0x30, 0xad, 0x2b, 0x4e, 0xbb, 0x16, 0xec, 0x58, 0x63, 0x59, 0x71, 0xf2, 0x1a,
+	0x2e, 0x7e, 0x60, 0xc5, 0xb5, 0x14, 0x98, 0x66, 0x25, 0x4f, 0xf3, 0x4c, 0x19, 0xb0, 0xa0, 0x60,
+	0x41, 0xd2, 0x84, 0x57, 0x25, 0xbf, 0xce, 0x14, 0x2e, 0xab, 0xc2, 0xf4, 0xa4, 0xe5, 0x16, 0x05,
+	0x3d, 0xb3, 0x88, 0x13, 0x84, 0x42, 0xbb, 0xcc, 0xf6, 0x85, 0xcc, 0x18, 0xed, 0x59, 0xbf, 0x91,
+	0x86, 0xb7, 0x03, 0xa6, 0xfd, 0x49, 0x30, 0xed, 0x25, 0x4e, 0xc4, 0x37, 0x30, 0x38, 0xac, 0xcf,
+	0x2f, 0x9a, 0x42, 0x9b, 0xaf, 0x85, 0xac, 0x90, 0xf9, 0x55, 0x37, 0xd2, 0x24, 0x2b, 0x29, 0x34,
+	0x0a, 0xed, 0x57, 0xd6, 0xc8, 0xf8, 0x2b, 0x0c, 0x3e, 0x72, 0x91, 0x15, 0xfc, 0x17, 0x36, 0x67,
+	0x30, 0x82, 0xb6, 0xce, 0xd4, 0x36, 0x3d, 0xdc, 0x40, 0x64, 0xe4, 0x9c, 0x91, 0x0b, 0x88, 0xee,
+	0x64, 0x6e, 0x7c, 0xf7, 0x48, 0x78, 0x27, 0x73, 0x67, 0x6b, 0x26, 0x8d, 0xdd, 0xf2, 0x0d, 0x31,
+	0x39, 0x67, 0xf1, 0x2b, 0x78, 0x72, 0x7c, 0xf9, 0x58, 0x61, 0x53, 0x47, 0x70, 0xaf, 0x8e, 0x37,
+	0x7f, 0x02, 0x88, 0xdc, 0xd8, 0xc9, 0x7b, 0x08, 0xed, 0x01, 0x93, 0xcb, 0x59, 0x73, 0xe4, 0xb3,
+	0xd3, 0x0b, 0x1f, 0x8f, 0xfe, 0xf3, 0xfd, 0xf3, 0x1f, 0xa0, 0xed, 0x67, 0x42, 0xe8, 0x91, 0xb9,
+	0x7f, 0xe5, 0xe3, 0xa7, 0x0f, 0x24, 0xfe, 0xfb, 0x2b, 0xe8, 0x34, 0x25, 0x93, 0x13, 0xec, 0x9f,
+	0x01, 0x8d, 0xc7, 0x0f, 0x45, 0xee, 0x89, 0x6b, 0xf8, 0x76, 0xf8, 0x33, 0xf3, 0xc8, 0xfe, 0xaa,
+	0x6f, 0xff, 0x0e, 0x00, 0xf8, 0xa7, 0xd2, 0x10, 0xba, 0x03, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// EngineClient is the client API for Engine service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type EngineClient interface {
+	// Ready is polled until the engine is ready to process chunks.
+	Ready(ctx context.Context, in *ReadyRequest, opts ...grpc.CallOption) (*ReadyResponse, error)
+	// Process processes a chunk.
+	Process(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error)
+	// Finalize is called once all the chunks of a task have been
+	// processed. Engines that don't need it can return Unimplemented.
+	Finalize(ctx context.Context, in *FinalizeRequest, opts ...grpc.CallOption) (*FinalizeResponse, error)
+}
+
+type engineClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewEngineClient(cc *grpc.ClientConn) EngineClient {
+	return &engineClient{cc}
+}
+
+func (c *engineClient) Ready(ctx context.Context, in *ReadyRequest, opts ...grpc.CallOption) (*ReadyResponse, error) {
+	out := new(ReadyResponse)
+	err := c.cc.Invoke(ctx, "/enginepb.Engine/Ready", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) Process(ctx context.Context, in *ProcessRequest, opts ...grpc.CallOption) (*ProcessResponse, error) {
+	out := new(ProcessResponse)
+	err := c.cc.Invoke(ctx, "/enginepb.Engine/Process", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *engineClient) Finalize(ctx context.Context, in *FinalizeRequest, opts ...grpc.CallOption) (*FinalizeResponse, error) {
+	out := new(FinalizeResponse)
+	err := c.cc.Invoke(ctx, "/enginepb.Engine/Finalize", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// EngineServer is the server API for Engine service.
+type EngineServer interface {
+	// Ready is polled until the engine is ready to process chunks.
+	Ready(context.Context, *ReadyRequest) (*ReadyResponse, error)
+	// Process processes a chunk.
+	Process(context.Context, *ProcessRequest) (*ProcessResponse, error)
+	// Finalize is called once all the chunks of a task have been
+	// processed. Engines that don't need it can return Unimplemented.
+	Finalize(context.Context, *FinalizeRequest) (*FinalizeResponse, error)
+}
+
+// UnimplementedEngineServer can be embedded to have forward compatible implementations.
+type UnimplementedEngineServer struct {
+}
+
+func (*UnimplementedEngineServer) Ready(ctx context.Context, req *ReadyRequest) (*ReadyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ready not implemented")
+}
+func (*UnimplementedEngineServer) Process(ctx context.Context, req *ProcessRequest) (*ProcessResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Process not implemented")
+}
+func (*UnimplementedEngineServer) Finalize(ctx context.Context, req *FinalizeRequest) (*FinalizeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Finalize not implemented")
+}
+
+func RegisterEngineServer(s *grpc.Server, srv EngineServer) {
+	s.RegisterService(&_Engine_serviceDesc, srv)
+}
+
+func _Engine_Ready_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).Ready(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/enginepb.Engine/Ready",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).Ready(ctx, req.(*ReadyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_Process_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).Process(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/enginepb.Engine/Process",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).Process(ctx, req.(*ProcessRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Engine_Finalize_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FinalizeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(EngineServer).Finalize(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/enginepb.Engine/Finalize",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(EngineServer).Finalize(ctx, req.(*FinalizeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _Engine_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "enginepb.Engine",
+	HandlerType: (*EngineServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Ready",
+			Handler:    _Engine_Ready_Handler,
+		},
+		{
+			MethodName: "Process",
+			Handler:    _Engine_Process_Handler,
+		},
+		{
+			MethodName: "Finalize",
+			Handler:    _Engine_Finalize_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "engine.proto",
+}
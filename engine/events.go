@@ -31,6 +31,8 @@ type event struct {
 	Key string
 	// Type of the event should be one of the constants
 	Type string
+	// TraceID is sent in the record headers (if any)
+	TraceID string
 
 	// for produce/consume events
 	JobID   string
@@ -40,6 +42,8 @@ type event struct {
 	// for periodic events
 	ProcessingDurationSecs int64
 	UpDurationSecs         int64
+	ConcurrencyLimit       int
+	TaskQueueDepths        map[string]int
 }
 
 // sendEvent produces an event with fire and forget policy
@@ -62,6 +66,8 @@ func (e *Engine) sendEvent(evt event) {
 			BuildID:                buildID,
 			ProcessingDurationSecs: evt.ProcessingDurationSecs,
 			UpDurationSecs:         evt.UpDurationSecs,
+			ConcurrencyLimit:       evt.ConcurrencyLimit,
+			TaskQueueDepths:        evt.TaskQueueDepths,
 		},
 		Event:   evt.Type,
 		JobID:   evt.JobID,
@@ -69,9 +75,10 @@ func (e *Engine) sendEvent(evt event) {
 		ChunkID: evt.ChunkID,
 	}
 	_, _, err := e.eventProducer.SendMessage(&sarama.ProducerMessage{
-		Topic: e.Config.Kafka.EventTopic,
-		Key:   sarama.ByteEncoder(evt.Key),
-		Value: processing.NewJSONEncoder(edgeEvt),
+		Topic:   e.Config.Kafka.EventTopic,
+		Key:     sarama.ByteEncoder(evt.Key),
+		Value:   processing.NewJSONEncoder(edgeEvt),
+		Headers: e.recordHeaders(evt.TraceID),
 	})
 	if err != nil {
 		e.logDebug("WARN", "failed to produce engine event:", err, evt)
@@ -97,6 +104,8 @@ func (e *Engine) sendPeriodicEvents(ctx context.Context) {
 				Type:                   eventPeriodic,
 				UpDurationSecs:         int64(now.Sub(start).Seconds()),
 				ProcessingDurationSecs: int64(e.ProcessingDuration().Seconds()),
+				ConcurrencyLimit:       e.concurrency.Limit(),
+				TaskQueueDepths:        e.scheduler.queueDepths(),
 			})
 		}
 	}
@@ -117,9 +126,11 @@ type edgeEvent struct {
 
 // EngineInfo contains contextual data for EngineInstance* events
 type EngineInfo struct {
-	EngineID               string `json:"engineId,omitempty"`               // EngineID of instance (required)
-	BuildID                string `json:"buildId,omitempty"`                // BuildID of instance (required)
-	InstanceID             string `json:"instanceId,omitempty"`             // InstanceID is unique ID of instance (either AWS Task ID or random UUID) (required)
-	UpDurationSecs         int64  `json:"upDurationSecs,omitempty"`         // UpDurationSecs Required only for EngineInstancePeriodic event, contains engine up time in seconds
-	ProcessingDurationSecs int64  `json:"processingDurationSecs,omitempty"` // ProcessingDurationSecs required only for EngineInstancePeriodic event, contains engine processing time in seconds
+	EngineID               string         `json:"engineId,omitempty"`               // EngineID of instance (required)
+	BuildID                string         `json:"buildId,omitempty"`                // BuildID of instance (required)
+	InstanceID             string         `json:"instanceId,omitempty"`             // InstanceID is unique ID of instance (either AWS Task ID or random UUID) (required)
+	UpDurationSecs         int64          `json:"upDurationSecs,omitempty"`         // UpDurationSecs Required only for EngineInstancePeriodic event, contains engine up time in seconds
+	ProcessingDurationSecs int64          `json:"processingDurationSecs,omitempty"` // ProcessingDurationSecs required only for EngineInstancePeriodic event, contains engine processing time in seconds
+	ConcurrencyLimit       int            `json:"concurrencyLimit,omitempty"`       // ConcurrencyLimit is the current adaptive concurrency limit (if enabled), only for EngineInstancePeriodic event
+	TaskQueueDepths        map[string]int `json:"taskQueueDepths,omitempty"`        // TaskQueueDepths is the number of chunks waiting for each task (if fair scheduling is enabled), only for EngineInstancePeriodic event
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// ChunkResult failure reasons.
+const (
+	// failureReasonInternalError is reported when nothing more specific
+	// is known about the failure.
+	failureReasonInternalError = "internal_error"
+	// failureReasonBadInput is reported when the engine rejected the
+	// chunk with a 4xx response.
+	failureReasonBadInput = "bad_input"
+	// failureReasonEngineError is reported when the engine failed with a
+	// 5xx (or other unexpected) response, or the response was unreadable.
+	failureReasonEngineError = "engine_error"
+	// failureReasonEngineUnavailable is reported when the Process webhook
+	// could not be reached.
+	failureReasonEngineUnavailable = "engine_unavailable"
+	// failureReasonDownloadFailed is reported when the chunk media could
+	// not be downloaded.
+	failureReasonDownloadFailed = "download_failed"
+	// failureReasonTimeout is reported for chunks that were not processed
+	// before their deadline.
+	failureReasonTimeout = "timeout"
+	// failureReasonAssetUploadFailed is reported when output files from
+	// the engine could not be stored as assets.
+	failureReasonAssetUploadFailed = "asset_upload_failed"
+	// failureReasonOutputTooLarge is reported when the engine output is
+	// too large to be delivered.
+	failureReasonOutputTooLarge = "output_too_large"
+	// failureReasonInstanceCrashed is reported for chunks that were in
+	// flight when the engine instance died.
+	failureReasonInstanceCrashed = "instance_crashed"
+	// failureReasonCancelled is reported for chunks of tasks that
+	// were cancelled.
+	failureReasonCancelled = "cancelled"
+	// failureReasonInvalidMessage is reported for media chunk messages
+	// that are malformed or missing required fields.
+	failureReasonInvalidMessage = "invalid_message"
+)
+
+// chunkResult is a processing.ChunkResult with additional details
+// about how the chunk was processed.
+type chunkResult struct {
+	processing.ChunkResult
+	// Attempts is the number of times the Process webhook was called.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// chunkError is an error processing a chunk that knows
+// its failure reason.
+type chunkError struct {
+	// reason is the ChunkResult failure reason.
+	reason string
+	// msg is the failure message (if different from the error).
+	msg string
+	// statusCode is the Process webhook response status code (if any).
+	statusCode int
+	// retryAfter is the Retry-After header from the Process webhook (if any).
+	retryAfter string
+	err        error
+}
+
+func (c *chunkError) Error() string {
+	return c.err.Error()
+}
+
+// Cause gets the underlying error.
+func (c *chunkError) Cause() error {
+	return c.err
+}
+
+// newChunkError makes an error with the specified failure reason.
+func newChunkError(reason string, err error) error {
+	return &chunkError{reason: reason, err: err}
+}
+
+// causeChunkError finds the chunkError in the chain of
+// causes of err.
+func causeChunkError(err error) (*chunkError, bool) {
+	for err != nil {
+		if ce, ok := err.(*chunkError); ok {
+			return ce, true
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = causer.Cause()
+	}
+	return nil, false
+}
+
+// failureDetails gets the failure reason and message to report
+// in the ChunkResult for err.
+func failureDetails(err error) (reason, msg string) {
+	ce, ok := causeChunkError(err)
+	if !ok {
+		return failureReasonInternalError, err.Error()
+	}
+	msg = ce.msg
+	if msg == "" {
+		msg = err.Error()
+	}
+	return ce.reason, msg
+}
+
+// webhookErrorBody is the optional JSON body engines may return
+// from the Process webhook when they fail.
+type webhookErrorBody struct {
+	FailureReason string `json:"failureReason"`
+	Message       string `json:"message"`
+}
+
+// newWebhookError makes a chunkError from an unsuccessful Process
+// webhook response.
+// If the body is a webhookErrorBody, its failure reason and message
+// are passed through.
+func newWebhookError(statusCode int, header http.Header, body []byte) error {
+	reason := failureReasonEngineError
+	if statusCode >= 400 && statusCode < 500 {
+		reason = failureReasonBadInput
+	}
+	text := strings.TrimSpace(string(body))
+	ce := &chunkError{
+		reason:     reason,
+		statusCode: statusCode,
+		retryAfter: header.Get("Retry-After"),
+	}
+	if strings.Contains(header.Get("Content-Type"), "json") {
+		var errBody webhookErrorBody
+		if err := json.Unmarshal(body, &errBody); err == nil {
+			if errBody.FailureReason != "" {
+				ce.reason = errBody.FailureReason
+			}
+			if errBody.Message != "" {
+				text = errBody.Message
+				ce.msg = errBody.Message
+			}
+		}
+	}
+	ce.err = errors.Errorf("%d: %s", statusCode, text)
+	if text == "" {
+		ce.err = errors.Errorf("%d: %s", statusCode, http.StatusText(statusCode))
+	}
+	return ce
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestNewWebhookError(t *testing.T) {
+	for _, tc := range []struct {
+		statusCode  int
+		contentType string
+		body        string
+		reason      string
+		err         string
+		msg         string
+	}{
+		{
+			statusCode: http.StatusBadRequest,
+			body:       "unsupported file type\n",
+			reason:     failureReasonBadInput,
+			err:        "400: unsupported file type",
+			msg:        "400: unsupported file type",
+		},
+		{
+			statusCode: http.StatusInternalServerError,
+			body:       "Something went wrong",
+			reason:     failureReasonEngineError,
+			err:        "500: Something went wrong",
+			msg:        "500: Something went wrong",
+		},
+		{
+			statusCode: http.StatusBadGateway,
+			reason:     failureReasonEngineError,
+			err:        "502: Bad Gateway",
+			msg:        "502: Bad Gateway",
+		},
+		{
+			statusCode:  http.StatusUnprocessableEntity,
+			contentType: "application/json; charset=utf-8",
+			body:        `{"failureReason":"wrong_type","message":"expected audio"}`,
+			reason:      "wrong_type",
+			err:         "422: expected audio",
+			msg:         "expected audio",
+		},
+		{
+			statusCode:  http.StatusInternalServerError,
+			contentType: "application/json",
+			body:        `{"message":"out of memory"}`,
+			reason:      failureReasonEngineError,
+			err:         "500: out of memory",
+			msg:         "out of memory",
+		},
+	} {
+		t.Run(tc.err, func(t *testing.T) {
+			is := is.New(t)
+			header := make(http.Header)
+			header.Set("Content-Type", tc.contentType)
+			err := newWebhookError(tc.statusCode, header, []byte(tc.body))
+			is.Equal(err.Error(), tc.err)
+			reason, msg := failureDetails(err)
+			is.Equal(reason, tc.reason)
+			is.Equal(msg, tc.msg)
+		})
+	}
+}
+
+func TestFailureDetails(t *testing.T) {
+	is := is.New(t)
+	reason, msg := failureDetails(errors.New("something"))
+	is.Equal(reason, failureReasonInternalError)
+	is.Equal(msg, "something")
+
+	err := newChunkError(failureReasonAssetUploadFailed, errors.New("upload failed"))
+	reason, msg = failureDetails(errors.Wrap(err, "create asset"))
+	is.Equal(reason, failureReasonAssetUploadFailed)
+	is.Equal(msg, "create asset: upload failed")
+}
+
+// TestProcessingChunkFailureReason ensures failure reasons returned by
+// the engine are passed through in the ChunkResult.
+func TestProcessingChunkFailureReason(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Webhooks.Backoff.MaxRetries = 0
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		err := json.NewEncoder(w).Encode(webhookErrorBody{
+			FailureReason: "wrong_type",
+			Message:       "expected an image",
+		})
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	inputMessage := processing.MediaChunkMessage{
+		TimestampUTC:  time.Now().Unix(),
+		ChunkUUID:     "123",
+		Type:          processing.MessageTypeMediaChunk,
+		StartOffsetMS: 1000,
+		EndOffsetMS:   2000,
+		JobID:         "job1",
+		TDOID:         "tdo1",
+		TaskID:        "task1",
+	}
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder(inputMessage.TaskID),
+		Value:  processing.NewJSONEncoder(inputMessage),
+	})
+	is.NoErr(err)
+
+	var outputMsg *sarama.ConsumerMessage
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	var result chunkResult
+	err = json.Unmarshal(outputMsg.Value, &result)
+	is.NoErr(err)
+	is.Equal(result.Status, processing.ChunkStatusError)
+	is.Equal(result.ErrorMsg, "400: expected an image")
+	is.Equal(result.FailureReason, "wrong_type")
+	is.Equal(result.FailureMsg, "expected an image")
+	is.Equal(result.Attempts, 1)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veritone/engine-toolkit/engine/enginepb"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+	"github.com/veritone/realtime/modules/engines/toolkit/selfdriving"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// maxGRPCMessageBytes is the largest message sent to, or received
+// from, the engine over gRPC.
+const maxGRPCMessageBytes = 1 << 30
+
+// grpcStatusCodes are the HTTP status codes equivalent to gRPC
+// status codes, so failed calls are retried and reported like
+// Process webhook responses.
+// Codes not listed are treated as 500.
+var grpcStatusCodes = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.FailedPrecondition: http.StatusBadRequest,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.Aborted:            http.StatusConflict,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+// engineRPC calls the engine without the webhooks.
+// Errors from process are chunkErrors, as they are for the Process
+// webhook.
+type engineRPC interface {
+	ready(ctx context.Context) error
+	process(ctx context.Context, req *enginepb.ProcessRequest) (*enginepb.ProcessResponse, error)
+	finalize(ctx context.Context, control controlMessage) (string, error)
+}
+
+// grpcEngine calls the engine over gRPC instead of the webhooks.
+type grpcEngine struct {
+	conn   *grpc.ClientConn
+	client enginepb.EngineClient
+}
+
+// dialGRPCEngine connects to the engine at addr.
+// The connection is made in the background, so this doesn't fail
+// if the engine isn't running yet.
+func dialGRPCEngine(addr string) (*grpcEngine, error) {
+	conn, err := grpc.Dial(addr,
+		grpc.WithInsecure(),
+		grpc.WithDefaultCallOptions(
+			grpc.MaxCallRecvMsgSize(maxGRPCMessageBytes),
+			grpc.MaxCallSendMsgSize(maxGRPCMessageBytes),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcEngine{
+		conn:   conn,
+		client: enginepb.NewEngineClient(conn),
+	}, nil
+}
+
+// Close closes the connection to the engine.
+func (g *grpcEngine) Close() error {
+	return g.conn.Close()
+}
+
+// ready returns an error unless the engine is ready.
+func (g *grpcEngine) ready(ctx context.Context) error {
+	resp, err := g.client.Ready(ctx, &enginepb.ReadyRequest{})
+	if err != nil {
+		return err
+	}
+	if !resp.Ready {
+		return errors.New("not ready")
+	}
+	return nil
+}
+
+// process calls Process for the chunk.
+// Errors are chunkErrors with the equivalent HTTP status code.
+func (g *grpcEngine) process(ctx context.Context, req *enginepb.ProcessRequest) (*enginepb.ProcessResponse, error) {
+	var trailer metadata.MD
+	resp, err := g.client.Process(ctx, req, grpc.Trailer(&trailer))
+	if err != nil {
+		return nil, grpcError(err, trailer)
+	}
+	return resp, nil
+}
+
+// finalize calls Finalize for the task, and gets any output.
+// Engines that don't implement Finalize have no output.
+func (g *grpcEngine) finalize(ctx context.Context, control controlMessage) (string, error) {
+	resp, err := g.client.Finalize(ctx, &enginepb.FinalizeRequest{
+		TaskId: control.TaskID,
+		JobId:  control.JobID,
+		TdoId:  control.TDOID,
+	})
+	if status.Code(err) == codes.Unimplemented {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Content, nil
+}
+
+// grpcError makes a chunkError from a failed gRPC call.
+// If the engine couldn't be reached, the failure reason is
+// engine_unavailable. Otherwise the error is treated like a webhook
+// response with the equivalent HTTP status code, and a retry-after
+// trailer is used like the Retry-After header.
+func grpcError(err error, trailer metadata.MD) error {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() == codes.Unavailable {
+		return newChunkError(failureReasonEngineUnavailable, err)
+	}
+	statusCode, ok := grpcStatusCodes[st.Code()]
+	if !ok {
+		statusCode = http.StatusInternalServerError
+	}
+	header := make(http.Header)
+	if retryAfter := trailer.Get("retry-after"); len(retryAfter) > 0 {
+		header.Set("Retry-After", retryAfter[0])
+	}
+	return newWebhookError(statusCode, header, []byte(st.Message()))
+}
+
+// newProcessRequest makes the gRPC Process request for the chunk,
+// including the chunk media if it has any (see sendsChunkMedia).
+func (e *Engine) newProcessRequest(ctx context.Context, chunk processing.MediaChunkMessage) (*enginepb.ProcessRequest, error) {
+	payload, err := json.Marshal(chunk.TaskPayload)
+	if err != nil {
+		return nil, newChunkError(failureReasonInternalError, errors.Wrap(err, "encode payload"))
+	}
+	req := &enginepb.ProcessRequest{
+		ChunkUuid:            chunk.ChunkUUID,
+		ChunkMimeType:        chunk.MIMEType,
+		StartOffsetMs:        int32(chunk.StartOffsetMS),
+		EndOffsetMs:          int32(chunk.EndOffsetMS),
+		Width:                int32(chunk.Width),
+		Height:               int32(chunk.Height),
+		LibraryId:            taskPayloadString(chunk, "libraryId"),
+		LibraryEngineModelId: taskPayloadString(chunk, "libraryEngineModelId"),
+		CacheUri:             chunk.CacheURI,
+		VeritoneApiBaseUrl:   taskPayloadString(chunk, "veritoneApiBaseUrl"),
+		Token:                taskPayloadString(chunk, "token"),
+		Payload:              string(payload),
+	}
+	if !e.sendsChunkMedia(chunk) {
+		return req, nil
+	}
+	media, err := e.openMedia(ctx, chunk)
+	if err != nil {
+		return nil, newChunkError(failureReasonDownloadFailed, errors.Wrap(err, "download chunk"))
+	}
+	defer media.Close()
+	req.Chunk, err = ioutil.ReadAll(media)
+	if err != nil {
+		return nil, newChunkError(failureReasonDownloadFailed, errors.Wrap(err, "download chunk"))
+	}
+	return req, nil
+}
+
+// processRPC sends the chunk to the engine over gRPC or stdio.
+// hold is the memory held for the chunk, which is measured once the
+// media is downloaded.
+func (e *Engine) processRPC(ctx context.Context, chunk processing.MediaChunkMessage, hold *memoryHold) (*enginepb.ProcessResponse, error) {
+	req, err := e.newProcessRequest(ctx, chunk)
+	if err != nil {
+		return nil, err
+	}
+	hold.measure(int64(len(req.Chunk)))
+	sent := time.Now()
+	resp, err := e.rpc.process(ctx, req)
+	if err != nil {
+		if ctx.Err() == nil {
+			ce, _ := causeChunkError(err)
+			e.concurrency.observe(time.Since(sent), ce == nil || ce.statusCode == 0 || isOverloaded(ce.statusCode))
+		}
+		return nil, err
+	}
+	e.concurrency.observe(time.Since(sent), false)
+	return resp, nil
+}
+
+// processSelfDrivingFileRPC sends the file to the engine over gRPC
+// or stdio, and writes the output to outputDir.
+func (e *Engine) processSelfDrivingFileRPC(outputDir string, file selfdriving.File, payloadJSON []byte) error {
+	data, err := ioutil.ReadFile(file.Path)
+	if err != nil {
+		return errors.Wrap(err, "read file")
+	}
+	ctx := context.Background()
+	if e.Config.Chunk.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Config.Chunk.Timeout)
+		defer cancel()
+	}
+	resp, err := e.rpc.process(ctx, &enginepb.ProcessRequest{
+		ChunkUuid:     filepath.Base(file.Path),
+		ChunkMimeType: mime.TypeByExtension(filepath.Ext(file.Path)),
+		Payload:       string(payloadJSON),
+		Chunk:         data,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.Ignored {
+		e.logDebug("ignoring chunk:", file.Path)
+		return nil
+	}
+	if resp.Content == "" {
+		e.logDebug("no data to output for file:", file.Path)
+		return nil
+	}
+	outputFile := filepath.Join(outputDir, filepath.Base(file.Path)+".json")
+	return writeOutputFile(outputFile, strings.NewReader(resp.Content))
+}
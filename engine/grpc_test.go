@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"github.com/veritone/engine-toolkit/engine/enginepb"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testGRPCEngine is an engine that processes chunks over gRPC.
+type testGRPCEngine struct {
+	enginepb.UnimplementedEngineServer
+	requests chan *enginepb.ProcessRequest
+}
+
+func (s *testGRPCEngine) Ready(ctx context.Context, req *enginepb.ReadyRequest) (*enginepb.ReadyResponse, error) {
+	return &enginepb.ReadyResponse{Ready: true}, nil
+}
+
+func (s *testGRPCEngine) Process(ctx context.Context, req *enginepb.ProcessRequest) (*enginepb.ProcessResponse, error) {
+	s.requests <- req
+	switch req.StartOffsetMs {
+	case 1000:
+		return &enginepb.ProcessResponse{Ignored: true}, nil
+	case 2000:
+		return nil, status.Error(codes.InvalidArgument, "unsupported chunk")
+	}
+	return &enginepb.ProcessResponse{Content: `{"series":[]}`}, nil
+}
+
+// newTestGRPCServer serves the engine on a local port.
+// The returned func stops the server.
+func newTestGRPCServer(t *testing.T, engine enginepb.EngineServer) (string, func()) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	enginepb.RegisterEngineServer(srv, engine)
+	go srv.Serve(lis)
+	return lis.Addr().String(), srv.Stop
+}
+
+func TestGRPCError(t *testing.T) {
+	is := is.New(t)
+
+	err := grpcError(status.Error(codes.InvalidArgument, "bad chunk"), nil)
+	reason, msg := failureDetails(err)
+	is.Equal(reason, failureReasonBadInput)
+	is.Equal(msg, "400: bad chunk")
+	_, _, retry := (&retryPolicy{maxRetries: 1, nonRetryable: map[int]bool{400: true}}).next(err)
+	is.Equal(retry, false)
+
+	err = grpcError(status.Error(codes.ResourceExhausted, "busy"), metadata.Pairs("retry-after", "2"))
+	delay, throttled, retry := (&retryPolicy{maxThrottles: 1}).next(err)
+	is.True(retry)
+	is.True(throttled)
+	is.Equal(delay, 2*time.Second)
+
+	err = grpcError(status.Error(codes.Unavailable, "connection refused"), nil)
+	reason, _ = failureDetails(err)
+	is.Equal(reason, failureReasonEngineUnavailable)
+
+	err = grpcError(status.Error(codes.Internal, "crashed"), nil)
+	reason, _ = failureDetails(err)
+	is.Equal(reason, failureReasonEngineError)
+
+	err = grpcError(errors.New("not a status"), nil)
+	reason, _ = failureDetails(err)
+	is.Equal(reason, failureReasonEngineUnavailable)
+}
+
+func TestProcessingChunkOverGRPC(t *testing.T) {
+	is := is.New(t)
+	grpcEngine := &testGRPCEngine{requests: make(chan *enginepb.ProcessRequest, 3)}
+	addr, stop := newTestGRPCServer(t, grpcEngine)
+	defer stop()
+	var mediaRequests int32
+	mediaSrv := newMediaServer("media content", &mediaRequests)
+	defer mediaSrv.Close()
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Processing.DisableChunkDownload = false
+	engine.Config.Webhooks.Backoff.MaxRetries = 0
+	engine.Config.GRPC.Address = addr
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	engine.Config.Webhooks.Process.URL = "http://127.0.0.1:1/not-used"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	receive := func() chunkResult {
+		var result chunkResult
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			is.Equal(outputMsg.Topic, engine.Config.Kafka.ChunkTopic)
+			err := json.Unmarshal(outputMsg.Value, &result)
+			is.NoErr(err)
+		case <-time.After(2 * time.Second):
+			is.Fail() // timed out
+		}
+		return result
+	}
+	send := func(offset int64, chunkUUID string, startOffsetMS int) {
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: offset,
+			Key:    sarama.StringEncoder("task1"),
+			Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+				Type:          processing.MessageTypeMediaChunk,
+				TaskID:        "task1",
+				ChunkUUID:     chunkUUID,
+				StartOffsetMS: startOffsetMS,
+				EndOffsetMS:   startOffsetMS + 1000,
+				MIMEType:      "image/png",
+				CacheURI:      mediaSrv.URL,
+				TaskPayload:   map[string]interface{}{"token": "secret"},
+			}),
+		})
+		is.NoErr(err)
+	}
+
+	send(1, "chunk1", 0)
+	req := <-grpcEngine.requests
+	is.Equal(req.ChunkUuid, "chunk1")
+	is.Equal(req.ChunkMimeType, "image/png")
+	is.Equal(req.EndOffsetMs, int32(1000))
+	is.Equal(req.CacheUri, mediaSrv.URL)
+	is.Equal(req.Token, "secret")
+	is.Equal(string(req.Chunk), "media content")
+	result := receive()
+	is.Equal(result.ChunkUUID, "chunk1")
+	is.Equal(result.Status, processing.ChunkStatusSuccess)
+	is.Equal(result.EngineOutput.Content, `{"series":[]}`)
+
+	send(2, "chunk2", 1000)
+	<-grpcEngine.requests
+	result = receive()
+	is.Equal(result.ChunkUUID, "chunk2")
+	is.Equal(result.Status, processing.ChunkStatusIgnored)
+
+	send(3, "chunk3", 2000)
+	<-grpcEngine.requests
+	result = receive()
+	is.Equal(result.ChunkUUID, "chunk3")
+	is.Equal(result.Status, processing.ChunkStatusError)
+	is.Equal(result.FailureReason, failureReasonBadInput)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// journalFilename is the name of the journal file inside the journal directory.
+const journalFilename = "journal.log"
+
+// journalCompactAfter is the number of entries written before the
+// journal file is rewritten to contain only unfinished messages.
+const journalCompactAfter = 1000
+
+// journalReportedExpiry is how long a chunk reported as crashed is
+// remembered. It matches Kafka's default retention, after which the
+// chunk can't be redelivered.
+const journalReportedExpiry = 7 * 24 * time.Hour
+
+type journalState string
+
+const (
+	// journalStateConsumed is recorded when a message is consumed.
+	journalStateConsumed journalState = "consumed"
+	// journalStateProcessing is recorded when processing of a message begins.
+	journalStateProcessing journalState = "processing"
+	// journalStateDone is recorded when a message is finished with.
+	journalStateDone journalState = "done"
+	// journalStateReported is recorded when a chunk left unfinished by
+	// a previous run has been reported as crashed. It is kept until the
+	// chunk is redelivered, so the redelivered copy can be dropped.
+	journalStateReported journalState = "reported"
+)
+
+// journalEntry is a single line in the journal file.
+type journalEntry struct {
+	ID           string       `json:"id"`
+	State        journalState `json:"state"`
+	TimestampUTC int64        `json:"timestampUTC"`
+	// Key and Value are the original message, and are only present
+	// on the entry that first records it (or when compacted).
+	Key   []byte `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// journal is a write-ahead log of consumed messages kept on local disk.
+// It allows chunks that were in flight when the process died to be
+// reported as failed the next time the engine starts.
+// A nil *journal is valid and records nothing.
+type journal struct {
+	lock    sync.Mutex
+	path    string
+	f       *os.File
+	pending map[string]journalEntry
+	written int
+}
+
+// openJournal opens (or creates) the journal in dir.
+func openJournal(dir string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "make journal dir")
+	}
+	j := &journal{
+		path:    filepath.Join(dir, journalFilename),
+		pending: make(map[string]journalEntry),
+	}
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "open journal")
+	}
+	j.f = f
+	return j, nil
+}
+
+// load reads the existing journal file (if any) and works out which
+// messages were left unfinished.
+func (j *journal) load() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "open journal")
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(s.Bytes(), &entry); err != nil {
+			// a partial line from a crash part way through a write
+			continue
+		}
+		j.apply(entry)
+	}
+	if err := s.Err(); err != nil {
+		return errors.Wrap(err, "read journal")
+	}
+	j.expire()
+	return nil
+}
+
+// unfinished returns the entries that were left unfinished by a
+// previous run.
+// The state of each entry is the last state that was recorded.
+// Entries stay in the journal until they are marked as reported (or
+// discarded), so they are returned again by the next run if that
+// doesn't happen.
+func (j *journal) unfinished() ([]journalEntry, error) {
+	if j == nil {
+		return nil, nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	entries := make([]journalEntry, 0, len(j.pending))
+	for _, entry := range j.pending {
+		if entry.State == journalStateReported {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// reported records that an unfinished chunk from a previous run
+// has been reported as crashed.
+func (j *journal) reported(entry journalEntry) error {
+	return j.record(journalEntry{
+		ID:    entry.ID,
+		State: journalStateReported,
+	})
+}
+
+// discard records that an unfinished entry from a previous run
+// needs nothing doing with it.
+func (j *journal) discard(entry journalEntry) error {
+	return j.record(journalEntry{
+		ID:    entry.ID,
+		State: journalStateDone,
+	})
+}
+
+// crashed gets whether msg is a redelivered copy of a chunk that has
+// already been reported as crashed.
+func (j *journal) crashed(msg *sarama.ConsumerMessage) bool {
+	if j == nil {
+		return false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	entry, ok := j.pending[journalID(msg)]
+	return ok && entry.State == journalStateReported
+}
+
+// consumed records that msg has been consumed.
+func (j *journal) consumed(msg *sarama.ConsumerMessage) error {
+	return j.record(journalEntry{
+		ID:    journalID(msg),
+		State: journalStateConsumed,
+		Key:   msg.Key,
+		Value: msg.Value,
+	})
+}
+
+// processing records that processing of msg has started.
+func (j *journal) processing(msg *sarama.ConsumerMessage) error {
+	return j.record(journalEntry{
+		ID:    journalID(msg),
+		State: journalStateProcessing,
+	})
+}
+
+// done records that msg has been finished with.
+func (j *journal) done(msg *sarama.ConsumerMessage) error {
+	return j.record(journalEntry{
+		ID:    journalID(msg),
+		State: journalStateDone,
+	})
+}
+
+// record writes the entry to disk, and doesn't return until
+// it has been synced.
+func (j *journal) record(entry journalEntry) error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	entry.TimestampUTC = time.Now().Unix()
+	j.apply(entry)
+	if j.written >= journalCompactAfter {
+		return j.compact()
+	}
+	if err := j.write(j.f, entry); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// apply updates the pending entries with entry.
+// Entries carrying the message replace any previous entry, others
+// just update the state.
+// A reported entry stays reported until it is done, so a redelivered
+// copy of the chunk can be recognised while it is processed.
+func (j *journal) apply(entry journalEntry) {
+	existing, ok := j.pending[entry.ID]
+	switch {
+	case entry.State == journalStateDone:
+		delete(j.pending, entry.ID)
+	case ok && existing.State == journalStateReported:
+		// keep it reported
+	case entry.Value != nil:
+		j.pending[entry.ID] = entry
+	case ok:
+		existing.State = entry.State
+		existing.TimestampUTC = entry.TimestampUTC
+		j.pending[entry.ID] = existing
+	}
+}
+
+// expire forgets reported entries that are too old to be redelivered.
+// Callers must hold the lock.
+func (j *journal) expire() {
+	cutoff := time.Now().Add(-journalReportedExpiry).Unix()
+	for id, entry := range j.pending {
+		if entry.State == journalStateReported && entry.TimestampUTC < cutoff {
+			delete(j.pending, id)
+		}
+	}
+}
+
+// compact rewrites the journal so that it only contains
+// the pending entries.
+// Callers must hold the lock.
+func (j *journal) compact() error {
+	j.expire()
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create journal")
+	}
+	j.written = 0
+	for _, entry := range j.pending {
+		if err := j.write(f, entry); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "sync journal")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close journal")
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return errors.Wrap(err, "replace journal")
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open journal")
+	}
+	return nil
+}
+
+// write writes a single entry line to f.
+func (j *journal) write(f *os.File, entry journalEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "encode journal entry")
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return errors.Wrap(err, "write journal")
+	}
+	j.written++
+	return nil
+}
+
+// Close closes the journal file.
+func (j *journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.f.Close()
+}
+
+// journalID gets the unique ID of a message in the journal.
+func journalID(msg *sarama.ConsumerMessage) string {
+	return fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+}
+
+// replayJournal reports every media chunk left unfinished in the journal
+// by a previous run as failed, so it doesn't stay in processing forever.
+// Chunks whose results can't be sent are left in the journal, and are
+// reported by the next run.
+// Reported chunks are remembered, because their offsets were never
+// committed: when Kafka redelivers them they are dropped (see
+// journal.crashed), so the platform doesn't get a second result.
+func (e *Engine) replayJournal() error {
+	entries, err := e.journal.unfinished()
+	if err != nil {
+		return errors.Wrap(err, "journal")
+	}
+	for _, entry := range entries {
+		var mediaChunk processing.MediaChunkMessage
+		if err := json.Unmarshal(entry.Value, &mediaChunk); err != nil {
+			e.logDebug("journal: skipping unreadable message:", entry.ID, err)
+			if err := e.journal.discard(entry); err != nil {
+				return errors.Wrap(err, "journal")
+			}
+			continue
+		}
+		if mediaChunk.Type != processing.MessageTypeMediaChunk {
+			if err := e.journal.discard(entry); err != nil {
+				return errors.Wrap(err, "journal")
+			}
+			continue
+		}
+		e.logDebug(fmt.Sprintf("journal: chunk %s was left %s by a previous run", mediaChunk.ChunkUUID, entry.State))
+		msg := fmt.Sprintf("instance crashed while chunk was %s", entry.State)
+		err := e.produceChunkResult(entry.Key, mediaChunk.ChunkUUID, chunkResult{
+			ChunkResult: processing.ChunkResult{
+				Type:          processing.MessageTypeChunkResult,
+				TaskID:        mediaChunk.TaskID,
+				ChunkUUID:     mediaChunk.ChunkUUID,
+				Status:        processing.ChunkStatusError,
+				ErrorMsg:      msg,
+				FailureReason: failureReasonInstanceCrashed,
+				FailureMsg:    msg,
+			},
+		})
+		if err != nil {
+			e.logDebug("WARN", "journal: failed to report crashed chunk (will try again on the next run):", mediaChunk.ChunkUUID, err)
+			continue
+		}
+		if err := e.journal.reported(entry); err != nil {
+			return errors.Wrap(err, "journal")
+		}
+	}
+	return nil
+}
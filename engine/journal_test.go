@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestJournal(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "journal")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	msg1 := &sarama.ConsumerMessage{Topic: "topic", Offset: 1, Key: []byte("task1"), Value: []byte(`{"chunkUUID":"chunk1"}`)}
+	msg2 := &sarama.ConsumerMessage{Topic: "topic", Offset: 2, Key: []byte("task1"), Value: []byte(`{"chunkUUID":"chunk2"}`)}
+	j, err := openJournal(dir)
+	is.NoErr(err)
+	is.NoErr(j.consumed(msg1))
+	is.NoErr(j.consumed(msg2))
+	is.NoErr(j.processing(msg1))
+	is.NoErr(j.processing(msg2))
+	is.NoErr(j.done(msg2))
+	is.NoErr(j.Close())
+
+	// simulate restarting after a crash
+	j, err = openJournal(dir)
+	is.NoErr(err)
+	entries, err := j.unfinished()
+	is.NoErr(err)
+	is.Equal(len(entries), 1)
+	is.Equal(entries[0].ID, "topic/0/1")
+	is.Equal(entries[0].State, journalStateProcessing)
+	is.Equal(string(entries[0].Key), "task1")
+	is.Equal(string(entries[0].Value), `{"chunkUUID":"chunk1"}`)
+	is.NoErr(j.Close())
+
+	// unfinished entries are kept until they are reported
+	j, err = openJournal(dir)
+	is.NoErr(err)
+	entries, err = j.unfinished()
+	is.NoErr(err)
+	is.Equal(len(entries), 1)
+	is.NoErr(j.reported(entries[0]))
+	is.NoErr(j.Close())
+
+	j, err = openJournal(dir)
+	is.NoErr(err)
+	entries, err = j.unfinished()
+	is.NoErr(err)
+	is.Equal(len(entries), 0)
+	is.Equal(j.crashed(msg1), true) // remembered until it is redelivered
+	is.Equal(j.crashed(msg2), false)
+	is.NoErr(j.consumed(msg1))
+	is.NoErr(j.processing(msg1))
+	is.Equal(j.crashed(msg1), true)
+	is.NoErr(j.done(msg1))
+	is.Equal(j.crashed(msg1), false)
+	is.NoErr(j.Close())
+}
+
+func TestJournalReportedExpiry(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "journal")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	msg := &sarama.ConsumerMessage{Offset: 1, Value: []byte(`{}`)}
+	j, err := openJournal(dir)
+	is.NoErr(err)
+	is.NoErr(j.consumed(msg))
+	is.NoErr(j.reported(journalEntry{ID: journalID(msg)}))
+	is.Equal(j.crashed(msg), true)
+	// pretend it was reported a long time ago
+	entry := j.pending[journalID(msg)]
+	entry.TimestampUTC = time.Now().Add(-journalReportedExpiry - time.Hour).Unix()
+	j.pending[journalID(msg)] = entry
+	j.expire()
+	is.Equal(j.crashed(msg), false)
+	is.NoErr(j.Close())
+}
+
+func TestJournalCompact(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "journal")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	j, err := openJournal(dir)
+	is.NoErr(err)
+	unfinished := &sarama.ConsumerMessage{Offset: 0, Value: []byte(`{}`)}
+	is.NoErr(j.consumed(unfinished))
+	is.NoErr(j.processing(unfinished))
+	for i := 1; i <= journalCompactAfter; i++ {
+		msg := &sarama.ConsumerMessage{Offset: int64(i), Value: []byte(`{}`)}
+		is.NoErr(j.consumed(msg))
+		is.NoErr(j.done(msg))
+	}
+	is.NoErr(j.Close())
+	info, err := os.Stat(j.path)
+	is.NoErr(err)
+	is.True(info.Size() < 1024) // journal should have been compacted
+
+	j, err = openJournal(dir)
+	is.NoErr(err)
+	entries, err := j.unfinished()
+	is.NoErr(err)
+	is.Equal(len(entries), 1)
+	is.Equal(entries[0].State, journalStateProcessing)
+	is.NoErr(j.Close())
+}
+
+// TestReplayJournal ensures chunks left in the journal by a crashed
+// run are reported as failed when the engine starts.
+func TestReplayJournal(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "journal")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	inputMessage := processing.MediaChunkMessage{
+		TimestampUTC:  time.Now().Unix(),
+		ChunkUUID:     "123",
+		Type:          processing.MessageTypeMediaChunk,
+		StartOffsetMS: 1000,
+		EndOffsetMS:   2000,
+		JobID:         "job1",
+		TDOID:         "tdo1",
+		TaskID:        "task1",
+	}
+	value, err := json.Marshal(inputMessage)
+	is.NoErr(err)
+	j, err := openJournal(dir)
+	is.NoErr(err)
+	is.NoErr(j.consumed(&sarama.ConsumerMessage{Offset: 1, Key: []byte("task1"), Value: value}))
+	is.NoErr(j.Close())
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Journal.Dir = dir
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+
+	var outputMsg *sarama.ConsumerMessage
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	is.Equal(string(outputMsg.Key), inputMessage.TaskID)      // output message key must be TaskID
+	is.Equal(outputMsg.Topic, engine.Config.Kafka.ChunkTopic) // chunk topic
+	var chunkResult processing.ChunkResult
+	err = json.Unmarshal(outputMsg.Value, &chunkResult)
+	is.NoErr(err)
+	is.Equal(chunkResult.Type, processing.MessageTypeChunkResult)
+	is.Equal(chunkResult.TaskID, inputMessage.TaskID)
+	is.Equal(chunkResult.ChunkUUID, inputMessage.ChunkUUID)
+	is.Equal(chunkResult.Status, processing.ChunkStatusError)
+	is.Equal(chunkResult.FailureReason, failureReasonInstanceCrashed)
+	is.Equal(chunkResult.FailureMsg, "instance crashed while chunk was consumed")
+}
+
+// TestReplayJournalRedelivered ensures a chunk reported as crashed is
+// dropped when Kafka redelivers it, so it doesn't get a second result.
+func TestReplayJournalRedelivered(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "journal")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	value, err := json.Marshal(processing.MediaChunkMessage{
+		Type:      processing.MessageTypeMediaChunk,
+		ChunkUUID: "123",
+		TaskID:    "task1",
+	})
+	is.NoErr(err)
+	j, err := openJournal(dir)
+	is.NoErr(err)
+	is.NoErr(j.consumed(&sarama.ConsumerMessage{Offset: 1, Key: []byte("task1"), Value: value}))
+	is.NoErr(j.processing(&sarama.ConsumerMessage{Offset: 1}))
+	is.NoErr(j.Close())
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Journal.Dir = dir
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+
+	select {
+	case outputMsg := <-outputPipe.Messages():
+		var chunkResult processing.ChunkResult
+		err = json.Unmarshal(outputMsg.Value, &chunkResult)
+		is.NoErr(err)
+		is.Equal(chunkResult.FailureReason, failureReasonInstanceCrashed)
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+
+	// the offset was never committed, so Kafka redelivers the chunk
+	_, _, err = inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder("task1"),
+		Value:  sarama.ByteEncoder(value),
+	})
+	is.NoErr(err)
+	waitForOffset(t, inputPipe, 1)
+	select {
+	case outputMsg := <-outputPipe.Messages():
+		is.Fail() // unexpected second result
+		t.Log(string(outputMsg.Value))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// and it is forgotten once it has been dropped
+	entries, err := engine.journal.unfinished()
+	is.NoErr(err)
+	is.Equal(len(entries), 0)
+	is.Equal(engine.journal.crashed(&sarama.ConsumerMessage{Offset: 1}), false)
+}
+
+// TestReplayJournalProduceFailed ensures a chunk whose result can't be
+// sent stays in the journal, so the next run reports it.
+func TestReplayJournalProduceFailed(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "journal")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+
+	value, err := json.Marshal(processing.MediaChunkMessage{
+		Type:      processing.MessageTypeMediaChunk,
+		ChunkUUID: "123",
+		TaskID:    "task1",
+	})
+	is.NoErr(err)
+	j, err := openJournal(dir)
+	is.NoErr(err)
+	is.NoErr(j.consumed(&sarama.ConsumerMessage{Offset: 1, Key: []byte("task1"), Value: value}))
+	is.NoErr(j.consumed(&sarama.ConsumerMessage{Offset: 2, Value: []byte(`{"type":"chunk_eof"}`)}))
+	is.NoErr(j.Close())
+
+	engine := NewEngine()
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.logDebug = func(args ...interface{}) {}
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.producer = &flakyProducer{Producer: outputPipe, failures: 1}
+	engine.journal, err = openJournal(dir)
+	is.NoErr(err)
+	is.NoErr(engine.replayJournal())
+	is.NoErr(engine.journal.Close())
+
+	// only the chunk is left for the next run
+	engine.journal, err = openJournal(dir)
+	is.NoErr(err)
+	entries, err := engine.journal.unfinished()
+	is.NoErr(err)
+	is.Equal(len(entries), 1)
+	is.Equal(entries[0].ID, "/0/1")
+
+	go func() {
+		<-outputPipe.Messages()
+	}()
+	is.NoErr(engine.replayJournal())
+	is.NoErr(engine.journal.Close())
+	engine.journal, err = openJournal(dir)
+	is.NoErr(err)
+	entries, err = engine.journal.unfinished()
+	is.NoErr(err)
+	is.Equal(len(entries), 0)
+	is.NoErr(engine.journal.Close())
+}
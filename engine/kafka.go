@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// Kafka record header names.
+const (
+	headerToolkitVersion = "toolkit-version"
+	headerEngineID       = "engine-id"
+	headerInstanceID     = "instance-id"
+	headerTraceID        = "trace-id"
+	headerContentType    = "content-type"
+)
+
+// recordHeaders gets the headers to attach to messages produced
+// by the engine, or nil if record headers are disabled.
+// The trace ID is omitted if empty.
+func (e *Engine) recordHeaders(traceID string) []sarama.RecordHeader {
+	if !e.Config.Producer.RecordHeaders {
+		return nil
+	}
+	headers := []sarama.RecordHeader{
+		{Key: []byte(headerToolkitVersion), Value: []byte(EngineToolkitVersion + "-" + BuildTag)},
+		{Key: []byte(headerEngineID), Value: []byte(e.Config.Engine.ID)},
+		{Key: []byte(headerInstanceID), Value: []byte(e.Config.Engine.InstanceID)},
+		{Key: []byte(headerContentType), Value: []byte("application/json")},
+	}
+	if traceID != "" {
+		headers = append(headers, sarama.RecordHeader{Key: []byte(headerTraceID), Value: []byte(traceID)})
+	}
+	return headers
+}
+
+// messageTraceID gets the trace ID from the headers of a consumed
+// message, or fallback if it has none.
+func messageTraceID(msg *sarama.ConsumerMessage, fallback string) string {
+	for _, header := range msg.Headers {
+		if header != nil && string(header.Key) == headerTraceID && len(header.Value) > 0 {
+			return string(header.Value)
+		}
+	}
+	return fallback
+}
+
+// kafkaSecurity holds the TLS and SASL settings for
+// connecting to secured Kafka clusters.
+type kafkaSecurity struct {
+	TLS struct {
+		// Enabled is whether to connect to the brokers using TLS.
+		Enabled bool
+		// CAFile is the PEM encoded CA certificate used to verify
+		// the brokers. If empty, the system roots are used.
+		CAFile string
+		// CertFile and KeyFile are the PEM encoded client certificate
+		// and key. Optional.
+		CertFile string
+		KeyFile  string
+		// InsecureSkipVerify disables verification of the
+		// broker certificates.
+		InsecureSkipVerify bool
+	}
+	SASL struct {
+		// Mechanism is PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512.
+		// If empty, SASL is not used.
+		Mechanism string
+		Username  string
+		Password  string
+	}
+}
+
+// enabled gets whether any security settings are configured.
+func (s kafkaSecurity) enabled() bool {
+	return s.TLS.Enabled || s.SASL.Mechanism != ""
+}
+
+// apply applies the security settings to the sarama config.
+func (s kafkaSecurity) apply(config *sarama.Config) error {
+	if s.TLS.Enabled {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	if s.SASL.Mechanism == "" {
+		return nil
+	}
+	// SASL handshake v1 and SCRAM need a newer protocol version
+	// than the sarama default.
+	if !config.Version.IsAtLeast(sarama.V1_0_0_0) {
+		config.Version = sarama.V1_0_0_0
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User = s.SASL.Username
+	config.Net.SASL.Password = s.SASL.Password
+	switch mechanism := strings.ToUpper(s.SASL.Mechanism); mechanism {
+	case sarama.SASLTypePlaintext:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: sha256.New}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: sha512.New}
+		}
+	default:
+		return errors.Errorf("unsupported SASL mechanism %q", s.SASL.Mechanism)
+	}
+	return nil
+}
+
+// tlsConfig makes the tls.Config from the TLS settings.
+func (s kafkaSecurity) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: s.TLS.InsecureSkipVerify,
+	}
+	if s.TLS.CAFile != "" {
+		caPEM, err := ioutil.ReadFile(s.TLS.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.Errorf("no certificates found in %s", s.TLS.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if s.TLS.CertFile != "" || s.TLS.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.TLS.CertFile, s.TLS.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newKafkaConsumer makes a consumer for the topic, applying the
+// security settings.
+// Secured and unsecured clusters use the same consumer configuration.
+// The returned func must be called to clean up.
+func newKafkaConsumer(c Config, group, topic string) (processing.Consumer, func(), error) {
+	config := cluster.NewConfig()
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Return.Errors = true
+	if err := c.KafkaSecurity.apply(&config.Config); err != nil {
+		return nil, nil, errors.Wrap(err, "kafka security")
+	}
+	consumer, err := cluster.NewConsumer(c.Kafka.Brokers, group, []string{topic}, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		for err := range consumer.Errors() {
+			log.Println("kafka consumer:", err)
+		}
+	}()
+	cleanup := func() {
+		consumer.Close()
+	}
+	return consumer, cleanup, nil
+}
+
+// kafkaPartitionedConsumer is a sarama-cluster consumer in
+// cluster.ConsumerModePartitions, as a partitionedConsumer.
+type kafkaPartitionedConsumer struct {
+	*cluster.Consumer
+	partitions chan inputPartition
+}
+
+// Partitions gets a consumer for each partition as it is assigned.
+func (c *kafkaPartitionedConsumer) Partitions() <-chan inputPartition {
+	return c.partitions
+}
+
+// newKafkaPartitionedConsumer makes a single consumer for all of the
+// topics, which hands out a consumer for each assigned partition
+// (see inputLanes) until ctx is done.
+func newKafkaPartitionedConsumer(ctx context.Context, c Config, group string, topics []string) (*kafkaPartitionedConsumer, func(), error) {
+	config := cluster.NewConfig()
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	config.Consumer.Return.Errors = true
+	config.Group.Mode = cluster.ConsumerModePartitions
+	if err := c.KafkaSecurity.apply(&config.Config); err != nil {
+		return nil, nil, errors.Wrap(err, "kafka security")
+	}
+	consumer, err := cluster.NewConsumer(c.Kafka.Brokers, group, topics, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	go func() {
+		for err := range consumer.Errors() {
+			log.Println("kafka consumer:", err)
+		}
+	}()
+	partitions := make(chan inputPartition)
+	go func() {
+		defer close(partitions)
+		for partition := range consumer.Partitions() {
+			go func(partition cluster.PartitionConsumer) {
+				for err := range partition.Errors() {
+					log.Println("kafka consumer:", err)
+				}
+			}(partition)
+			select {
+			case partitions <- partition:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	cleanup := func() {
+		consumer.Close()
+	}
+	return &kafkaPartitionedConsumer{Consumer: consumer, partitions: partitions}, cleanup, nil
+}
+
+// producerSettings holds the tuning settings for the Kafka producer.
+// Empty settings keep the sarama defaults.
+type producerSettings struct {
+	// Version is the Kafka version to assume (e.g. "1.0.0").
+	Version string
+	// RecordHeaders is whether to attach record headers to produced
+	// messages, which needs Kafka 0.11.0 or later.
+	RecordHeaders bool
+	// Compression is the compression codec: none, gzip, snappy,
+	// lz4 or zstd.
+	Compression string
+	// Linger is how long to wait for more messages before
+	// sending a batch.
+	Linger time.Duration
+	// BatchSize is the size in bytes at which a batch is
+	// sent without waiting for Linger.
+	BatchSize int
+	// RequiredAcks is the acknowledgement required from the
+	// brokers: 0 (none), 1 (leader) or all.
+	RequiredAcks string
+}
+
+// apply applies the producer settings to the sarama config.
+func (s producerSettings) apply(config *sarama.Config) error {
+	if s.Version != "" {
+		version, err := sarama.ParseKafkaVersion(s.Version)
+		if err != nil {
+			return errors.Wrap(err, "kafka version")
+		}
+		config.Version = version
+	}
+	if s.RecordHeaders {
+		if s.Version == "" && !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			return errors.Errorf("kafka version %s is too old for record headers (need 0.11.0 or later)", config.Version)
+		}
+	}
+	switch strings.ToLower(s.Compression) {
+	case "":
+	case "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	case "lz4":
+		config.Producer.Compression = sarama.CompressionLZ4
+	case "zstd":
+		config.Producer.Compression = sarama.CompressionZSTD
+	default:
+		return errors.Errorf("unsupported compression codec %q", s.Compression)
+	}
+	if s.Linger > 0 {
+		config.Producer.Flush.Frequency = s.Linger
+	}
+	if s.BatchSize > 0 {
+		config.Producer.Flush.Bytes = s.BatchSize
+	}
+	switch strings.ToLower(s.RequiredAcks) {
+	case "":
+	case "0", "none":
+		config.Producer.RequiredAcks = sarama.NoResponse
+	case "1", "leader":
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	case "-1", "all":
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	default:
+		return errors.Errorf("unsupported required acks %q", s.RequiredAcks)
+	}
+	return nil
+}
+
+// newKafkaProducer makes a producer, applying the producer settings
+// and security settings.
+func newKafkaProducer(c Config) (processing.Producer, error) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	if err := c.Producer.apply(config); err != nil {
+		return nil, errors.Wrap(err, "kafka producer settings")
+	}
+	if err := c.KafkaSecurity.apply(config); err != nil {
+		return nil, errors.Wrap(err, "kafka security")
+	}
+	return sarama.NewSyncProducer(c.Kafka.Brokers, config)
+}
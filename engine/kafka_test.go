@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+	"github.com/xdg/scram"
+)
+
+func TestKafkaSecurity(t *testing.T) {
+	is := is.New(t)
+
+	var security kafkaSecurity
+	is.Equal(security.enabled(), false)
+
+	security.SASL.Mechanism = "scram-sha-512"
+	security.SASL.Username = "user"
+	security.SASL.Password = "pencil"
+	is.Equal(security.enabled(), true)
+	config := sarama.NewConfig()
+	is.NoErr(security.apply(config))
+	is.Equal(config.Net.SASL.Enable, true)
+	is.Equal(string(config.Net.SASL.Mechanism), sarama.SASLTypeSCRAMSHA512)
+	is.Equal(config.Net.SASL.User, "user")
+	is.Equal(config.Net.SASL.Password, "pencil")
+	is.True(config.Net.SASL.SCRAMClientGeneratorFunc != nil)
+	is.True(config.Version.IsAtLeast(sarama.V1_0_0_0))
+	is.Equal(config.Net.TLS.Enable, false)
+
+	security.SASL.Mechanism = "PLAIN"
+	config = sarama.NewConfig()
+	is.NoErr(security.apply(config))
+	is.Equal(string(config.Net.SASL.Mechanism), sarama.SASLTypePlaintext)
+
+	security.SASL.Mechanism = "GSSAPI"
+	is.True(security.apply(sarama.NewConfig()) != nil) // unsupported mechanism
+
+	security.SASL.Mechanism = ""
+	security.TLS.Enabled = true
+	security.TLS.InsecureSkipVerify = true
+	config = sarama.NewConfig()
+	is.NoErr(security.apply(config))
+	is.Equal(config.Net.TLS.Enable, true)
+	is.Equal(config.Net.TLS.Config.InsecureSkipVerify, true)
+	is.Equal(config.Net.SASL.Enable, false)
+
+	security.TLS.CAFile = "testdata/missing-ca.pem"
+	is.True(security.apply(sarama.NewConfig()) != nil) // missing CA file
+}
+
+func TestScramClient(t *testing.T) {
+	is := is.New(t)
+	credentials, err := scram.SHA256.NewClient("user", "pencil", "")
+	is.NoErr(err)
+	stored := credentials.GetStoredCredentials(scram.KeyFactors{Salt: "salt", Iters: 4096})
+	server, err := scram.SHA256.NewServer(func(username string) (scram.StoredCredentials, error) {
+		is.Equal(username, "user")
+		return stored, nil
+	})
+	is.NoErr(err)
+
+	c := &scramClient{hash: sha256.New}
+	is.NoErr(c.Begin("user", "pencil", ""))
+	serverConversation := server.NewConversation()
+	var challenge string
+	for !c.Done() {
+		response, err := c.Step(challenge)
+		is.NoErr(err)
+		if response == "" {
+			break
+		}
+		challenge, err = serverConversation.Step(response)
+		is.NoErr(err)
+	}
+	is.True(c.Done())
+	is.True(serverConversation.Valid())
+
+	// the wrong password is rejected
+	is.NoErr(c.Begin("user", "wrong", ""))
+	serverConversation = server.NewConversation()
+	clientFirst, err := c.Step("")
+	is.NoErr(err)
+	serverFirst, err := serverConversation.Step(clientFirst)
+	is.NoErr(err)
+	clientFinal, err := c.Step(serverFirst)
+	is.NoErr(err)
+	_, err = serverConversation.Step(clientFinal)
+	is.True(err != nil)
+}
+
+func TestProducerSettings(t *testing.T) {
+	is := is.New(t)
+	settings := producerSettings{
+		Version:      "2.1.0",
+		Compression:  "lz4",
+		Linger:       10 * time.Millisecond,
+		BatchSize:    1024,
+		RequiredAcks: "1",
+	}
+	config := sarama.NewConfig()
+	is.NoErr(settings.apply(config))
+	is.Equal(config.Version, sarama.V2_1_0_0)
+	is.Equal(config.Producer.Compression, sarama.CompressionLZ4)
+	is.Equal(config.Producer.Flush.Frequency, 10*time.Millisecond)
+	is.Equal(config.Producer.Flush.Bytes, 1024)
+	is.Equal(config.Producer.RequiredAcks, sarama.WaitForLocal)
+
+	// empty settings keep the sarama defaults
+	config = sarama.NewConfig()
+	is.NoErr(producerSettings{}.apply(config))
+	defaults := sarama.NewConfig()
+	is.Equal(config.Version, defaults.Version)
+	is.Equal(config.Producer.Compression, defaults.Producer.Compression)
+	is.Equal(config.Producer.Flush, defaults.Producer.Flush)
+	is.Equal(config.Producer.RequiredAcks, defaults.Producer.RequiredAcks)
+
+	config = sarama.NewConfig()
+	is.NoErr(producerSettings{RecordHeaders: true}.apply(config))
+	is.True(config.Version.IsAtLeast(sarama.V0_11_0_0))
+	is.True(producerSettings{Version: "0.10.2", RecordHeaders: true}.apply(sarama.NewConfig()) != nil)
+
+	is.True(producerSettings{Compression: "brotli"}.apply(sarama.NewConfig()) != nil)
+	is.True(producerSettings{RequiredAcks: "2"}.apply(sarama.NewConfig()) != nil)
+	is.True(producerSettings{Version: "banana"}.apply(sarama.NewConfig()) != nil)
+}
+
+func TestRecordHeaders(t *testing.T) {
+	is := is.New(t)
+	engine := NewEngine()
+	engine.Config.Engine.ID = "engine1"
+	engine.Config.Engine.InstanceID = "instance1"
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.producer = outputPipe
+
+	is.Equal(len(engine.recordHeaders("trace1")), 0) // disabled by default
+	engine.Config.Producer.RecordHeaders = true
+
+	consumed := &sarama.ConsumerMessage{
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte(headerTraceID), Value: []byte("trace1")},
+		},
+	}
+	traceID := messageTraceID(consumed, "chunk1")
+	is.Equal(traceID, "trace1")
+	is.Equal(messageTraceID(&sarama.ConsumerMessage{}, "chunk1"), "chunk1")
+
+	err := engine.produceChunkResult([]byte("task1"), traceID, chunkResult{})
+	is.NoErr(err)
+	var outputMsg *sarama.ConsumerMessage
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	headers := make(map[string]string)
+	for _, header := range outputMsg.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	is.Equal(headers[headerEngineID], "engine1")
+	is.Equal(headers[headerInstanceID], "instance1")
+	is.Equal(headers[headerTraceID], "trace1")
+	is.Equal(headers[headerContentType], "application/json")
+	is.True(headers[headerToolkitVersion] != "")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// inputTopic is an input topic and its share of processing.
+type inputTopic struct {
+	Topic string
+	// Weight is the relative share of processing for the topic.
+	// Ignored for strict priority.
+	Weight int
+}
+
+// inputPartition is a consumer for a single partition of a topic,
+// such as a cluster.PartitionConsumer.
+type inputPartition interface {
+	Topic() string
+	Messages() <-chan *sarama.ConsumerMessage
+}
+
+// partitionedConsumer is a consumer that hands out a consumer for
+// each partition it is assigned, such as a cluster.Consumer in
+// cluster.ConsumerModePartitions (see newKafkaPartitionedConsumer).
+// A partition's Messages channel is closed when the partition is
+// taken away, and Partitions is closed when the consumer closes down.
+type partitionedConsumer interface {
+	Partitions() <-chan inputPartition
+	MarkOffset(msg *sarama.ConsumerMessage, metadata string)
+}
+
+// inputLane is the partitions of an input topic.
+type inputLane struct {
+	inputTopic
+	// partitions are the partitions of the topic currently
+	// assigned to this consumer.
+	partitions []inputPartition
+	// pass increases by 1/weight each time a message is released,
+	// and the lane with the lowest pass goes next.
+	pass float64
+	// head is the next message from the lane, if one has been read.
+	head *sarama.ConsumerMessage
+}
+
+// inputLanes consumes from several input topics, releasing messages
+// by strict priority or in proportion to the topic weights.
+// A message is only chosen when the engine is ready to receive one,
+// so messages from a higher priority topic never wait behind ones
+// from a bulk topic that have already been consumed.
+// All of the topics are consumed by one consumer (so one member of the
+// consumer group), whose partitions are split into lanes by topic.
+// It is a processing.Consumer, so it can be used in place of a
+// single topic consumer.
+type inputLanes struct {
+	consumer partitionedConsumer
+	lanes    []*inputLane
+	strict   bool
+	messages chan *sarama.ConsumerMessage
+	// pass is the pass of the last released lane; lanes that
+	// become ready start here.
+	pass float64
+}
+
+// newInputLanes makes inputLanes for the topics (highest priority
+// first), which must be the topics the consumer is subscribed to.
+// Messages are consumed until the context is done or the consumer
+// has closed down.
+func newInputLanes(ctx context.Context, topics []inputTopic, consumer partitionedConsumer, strict bool) *inputLanes {
+	l := &inputLanes{
+		consumer: consumer,
+		strict:   strict,
+		messages: make(chan *sarama.ConsumerMessage),
+	}
+	for _, topic := range topics {
+		if topic.Weight < 1 {
+			topic.Weight = 1
+		}
+		l.lanes = append(l.lanes, &inputLane{inputTopic: topic})
+	}
+	go l.run(ctx)
+	return l
+}
+
+// Messages gets the messages from all of the topics.
+func (l *inputLanes) Messages() <-chan *sarama.ConsumerMessage {
+	return l.messages
+}
+
+// MarkOffset marks the offset with the consumer.
+func (l *inputLanes) MarkOffset(msg *sarama.ConsumerMessage, metadata string) {
+	l.consumer.MarkOffset(msg, metadata)
+}
+
+// run reads the next message from each lane, and offers the best one
+// to Messages until one of them is taken. If another lane gets a
+// message in the meantime, the choice is made again.
+// Partitions are added to the lane for their topic as they are
+// assigned.
+func (l *inputLanes) run(ctx context.Context) {
+	defer close(l.messages)
+	partitions := l.consumer.Partitions()
+	for {
+		// read whatever is already waiting, so the choice is
+		// made between all of the lanes that have messages.
+		for _, lane := range l.lanes {
+			for i := 0; lane.head == nil && i < len(lane.partitions); i++ {
+				select {
+				case msg, ok := <-lane.partitions[i].Messages():
+					if l.receive(lane, i, msg, ok) {
+						i--
+					}
+				default:
+				}
+			}
+		}
+		next := l.choose()
+		// cases are: ctx, then the send (if there is a message to
+		// send), then new partitions (until the consumer has
+		// closed down), then a receive for each partition of the
+		// lanes without a head.
+		cases := []reflect.SelectCase{{
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(ctx.Done()),
+		}}
+		send := -1
+		if next != nil {
+			send = len(cases)
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectSend,
+				Chan: reflect.ValueOf(l.messages),
+				Send: reflect.ValueOf(next.head),
+			})
+		}
+		assign := -1
+		if partitions != nil {
+			assign = len(cases)
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(partitions),
+			})
+		}
+		first := len(cases)
+		type lanePartition struct {
+			lane *inputLane
+			i    int
+		}
+		var receiving []lanePartition
+		for _, lane := range l.lanes {
+			if lane.head != nil {
+				continue
+			}
+			for i, partition := range lane.partitions {
+				receiving = append(receiving, lanePartition{lane: lane, i: i})
+				cases = append(cases, reflect.SelectCase{
+					Dir:  reflect.SelectRecv,
+					Chan: reflect.ValueOf(partition.Messages()),
+				})
+			}
+		}
+		if len(cases) == 1 {
+			// the consumer has closed down, and every partition
+			// has been drained
+			return
+		}
+		chosen, value, ok := reflect.Select(cases)
+		switch {
+		case chosen == 0:
+			return
+		case chosen == send:
+			next.head = nil
+			l.pass = next.pass
+			next.pass += 1 / float64(next.Weight)
+		case chosen == assign:
+			if !ok {
+				partitions = nil
+				continue
+			}
+			partition, _ := value.Interface().(inputPartition)
+			l.assign(partition)
+		default:
+			r := receiving[chosen-first]
+			msg, _ := value.Interface().(*sarama.ConsumerMessage)
+			l.receive(r.lane, r.i, msg, ok)
+		}
+	}
+}
+
+// assign adds a newly assigned partition to the lane for its topic.
+// Partitions of other topics are ignored, since the consumer is only
+// subscribed to the lane topics.
+func (l *inputLanes) assign(partition inputPartition) {
+	for _, lane := range l.lanes {
+		if lane.Topic == partition.Topic() {
+			lane.partitions = append(lane.partitions, partition)
+			return
+		}
+	}
+}
+
+// receive records a message read from partition i of the lane, or
+// that the partition was taken away if !ok.
+// The partition is moved to the back of the lane, so the other
+// partitions are read from first next time.
+// Returns true if the partition was removed from the lane.
+func (l *inputLanes) receive(lane *inputLane, i int, msg *sarama.ConsumerMessage, ok bool) bool {
+	partition := lane.partitions[i]
+	copy(lane.partitions[i:], lane.partitions[i+1:])
+	if !ok {
+		lane.partitions = lane.partitions[:len(lane.partitions)-1]
+		return true
+	}
+	lane.partitions[len(lane.partitions)-1] = partition
+	lane.head = msg
+	if lane.pass < l.pass {
+		// don't let an idle lane build up credit
+		lane.pass = l.pass
+	}
+	return false
+}
+
+// choose gets the lane whose message should go next, or nil if no
+// lane has a message.
+func (l *inputLanes) choose() *inputLane {
+	var next *inputLane
+	for _, lane := range l.lanes {
+		if lane.head == nil {
+			continue
+		}
+		if l.strict {
+			// lanes are in priority order
+			return lane
+		}
+		if next == nil || lane.pass < next.pass {
+			next = lane
+		}
+	}
+	return next
+}
+
+// parseInputTopics parses a comma separated list of topics, each
+// optionally with a weight (topic=weight), highest priority first.
+func parseInputTopics(s string) ([]inputTopic, error) {
+	var topics []inputTopic
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		topic := inputTopic{Topic: field, Weight: 1}
+		if parts := strings.SplitN(field, "=", 2); len(parts) == 2 {
+			weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil {
+				return nil, errors.Wrapf(err, "weight %q", field)
+			}
+			if weight < 1 {
+				return nil, errors.Errorf("weight %q: must be at least 1", field)
+			}
+			topic = inputTopic{Topic: strings.TrimSpace(parts[0]), Weight: weight}
+		}
+		if topic.Topic == "" {
+			return nil, errors.Errorf("%q: missing topic", field)
+		}
+		topics = append(topics, topic)
+	}
+	return topics, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+)
+
+// testPartition is a inputPartition for tests.
+type testPartition struct {
+	topic    string
+	messages chan *sarama.ConsumerMessage
+}
+
+func (p *testPartition) Topic() string                            { return p.topic }
+func (p *testPartition) Messages() <-chan *sarama.ConsumerMessage { return p.messages }
+
+// newTestPartition makes a testPartition with count messages
+// already waiting.
+func newTestPartition(topic string, partition int32, count int) *testPartition {
+	p := &testPartition{topic: topic, messages: make(chan *sarama.ConsumerMessage, 100)}
+	for i := 0; i < count; i++ {
+		p.messages <- &sarama.ConsumerMessage{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    int64(i),
+			Value:     []byte("{}"),
+		}
+	}
+	return p
+}
+
+// testPartitionedConsumer is a partitionedConsumer for tests.
+type testPartitionedConsumer struct {
+	partitions chan inputPartition
+	marked     []*sarama.ConsumerMessage
+}
+
+func (c *testPartitionedConsumer) Partitions() <-chan inputPartition { return c.partitions }
+
+func (c *testPartitionedConsumer) MarkOffset(msg *sarama.ConsumerMessage, metadata string) {
+	c.marked = append(c.marked, msg)
+}
+
+// assign assigns the partitions, and waits for them to be taken.
+func (c *testPartitionedConsumer) assign(partitions ...inputPartition) {
+	for _, partition := range partitions {
+		c.partitions <- partition
+	}
+	for len(c.partitions) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// newTestLanes makes inputLanes for the topics, with a partition
+// for each topic that has count messages already waiting.
+func newTestLanes(t *testing.T, ctx context.Context, topics []inputTopic, strict bool, count int) (*inputLanes, *testPartitionedConsumer) {
+	consumer := &testPartitionedConsumer{partitions: make(chan inputPartition, 10)}
+	lanes := newInputLanes(ctx, topics, consumer, strict)
+	var partitions []inputPartition
+	for _, topic := range topics {
+		partitions = append(partitions, newTestPartition(topic.Topic, 0, count))
+	}
+	consumer.assign(partitions...)
+	return lanes, consumer
+}
+
+// laneTopics reads n messages from the lanes and gets their topics.
+func laneTopics(t *testing.T, l *inputLanes, n int) []string {
+	var topics []string
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-l.Messages():
+			topics = append(topics, msg.Topic)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("timed out")
+		}
+	}
+	return topics
+}
+
+func TestInputLanesStrict(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	topics := []inputTopic{{Topic: "priority", Weight: 1}, {Topic: "bulk", Weight: 1}}
+	lanes, _ := newTestLanes(t, ctx, topics, true, 3)
+	is.Equal(laneTopics(t, lanes, 6), []string{"priority", "priority", "priority", "bulk", "bulk", "bulk"})
+}
+
+func TestInputLanesWeighted(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	topics := []inputTopic{{Topic: "priority", Weight: 2}, {Topic: "bulk", Weight: 1}}
+	lanes, _ := newTestLanes(t, ctx, topics, false, 4)
+	is.Equal(laneTopics(t, lanes, 8), []string{"priority", "bulk", "priority", "priority", "bulk", "priority", "bulk", "bulk"})
+}
+
+func TestInputLanesMarkOffset(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	topics := []inputTopic{{Topic: "priority", Weight: 1}, {Topic: "bulk", Weight: 1}}
+	lanes, consumer := newTestLanes(t, ctx, topics, false, 0)
+	msg := &sarama.ConsumerMessage{Topic: "bulk", Offset: 5}
+	lanes.MarkOffset(msg, "")
+	is.Equal(consumer.marked, []*sarama.ConsumerMessage{msg})
+}
+
+// TestInputLanesPartitions ensures every partition of a topic is
+// consumed by its lane, and partitions that are taken away or
+// belong to other topics are left alone.
+func TestInputLanesPartitions(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	topics := []inputTopic{{Topic: "priority", Weight: 1}, {Topic: "bulk", Weight: 1}}
+	lanes, consumer := newTestLanes(t, ctx, topics, true, 0)
+	revoked := newTestPartition("bulk", 1, 0)
+	other := newTestPartition("other", 0, 1)
+	consumer.assign(newTestPartition("bulk", 2, 2), newTestPartition("priority", 1, 1), revoked, other)
+	close(revoked.messages)
+	is.Equal(laneTopics(t, lanes, 3), []string{"priority", "bulk", "bulk"})
+	select {
+	case msg := <-lanes.Messages():
+		is.Fail() // unexpected message
+		t.Log(msg.Topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+	is.Equal(len(other.messages), 1) // not consumed
+}
+
+// TestInputLanesClosed ensures the lanes close down once the consumer
+// has, after the messages already read have been taken.
+func TestInputLanesClosed(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	topics := []inputTopic{{Topic: "priority", Weight: 1}, {Topic: "bulk", Weight: 1}}
+	consumer := &testPartitionedConsumer{partitions: make(chan inputPartition, 10)}
+	lanes := newInputLanes(ctx, topics, consumer, true)
+	priority := newTestPartition("priority", 0, 1)
+	bulk := newTestPartition("bulk", 0, 1)
+	consumer.assign(priority, bulk)
+	close(consumer.partitions)
+	close(priority.messages)
+	close(bulk.messages)
+	is.Equal(laneTopics(t, lanes, 2), []string{"priority", "bulk"})
+	select {
+	case _, ok := <-lanes.Messages():
+		is.Equal(ok, false) // should be closed
+	case <-time.After(500 * time.Millisecond):
+		is.Fail() // timed out
+	}
+}
+
+func TestParseInputTopics(t *testing.T) {
+	is := is.New(t)
+	topics, err := parseInputTopics("priority=3, bulk")
+	is.NoErr(err)
+	is.Equal(topics, []inputTopic{{Topic: "priority", Weight: 3}, {Topic: "bulk", Weight: 1}})
+	_, err = parseInputTopics("priority=0")
+	is.True(err != nil)
+	_, err = parseInputTopics("=2")
+	is.True(err != nil)
+}
@@ -9,7 +9,6 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/veritone/realtime/modules/engines/toolkit/controller"
-	"github.com/veritone/realtime/modules/engines/toolkit/processing"
 )
 
 // BuildTag is the githash of this build.
@@ -49,15 +48,29 @@ func run(ctx context.Context) error {
 	eng.logDebug("engine: running")
 	defer eng.Terminate()
 
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		return eng.runDeadLetterCommand(ctx, os.Args[2:])
+	}
+
 	skipKafka := false
 	var err error
 	if eng.Config.ControllerConfig.ControllerMode {
+		if eng.Config.KafkaSecurity.enabled() {
+			// the controller makes its own Kafka clients, and has no
+			// way to be given the settings, so it would connect without
+			// them. Checked before the controller is contacted, so
+			// nothing is done with an insecure connection.
+			return errors.New("KAFKA_TLS and KAFKA_SASL_MECHANISM are not supported in controller mode")
+		}
 		// got to do what we got to do .. contact mother ship
 		eng.controller, err = controller.NewControllerUniverse(&eng.Config.ControllerConfig, EngineToolkitVersion, BuildTime, BuildTag)
 		if err != nil {
 			eng.logDebug("FATAL  Err=", err)
 			os.Exit(1)
 		}
+		if len(eng.Config.Inputs.Topics) > 0 {
+			eng.logDebug("WARN", "KAFKA_INPUT_TOPICS is not supported in controller mode")
+		}
 		skipKafka = true
 	}
 	isTraining, err := isTrainingTask()
@@ -80,16 +93,30 @@ func run(ctx context.Context) error {
 	if !skipKafka {
 		eng.logDebug("brokers:", eng.Config.Kafka.Brokers)
 		eng.logDebug("consumer group:", eng.Config.Kafka.ConsumerGroup)
-		eng.logDebug("input topic:", eng.Config.Kafka.InputTopic)
 		eng.logDebug("chunk topic:", eng.Config.Kafka.ChunkTopic)
 		var err error
-		var cleanup func()
-		eng.consumer, cleanup, err = processing.NewKafkaConsumer(eng.Config.Kafka.Brokers, eng.Config.Kafka.ConsumerGroup, eng.Config.Kafka.InputTopic)
-		if err != nil {
-			return errors.Wrap(err, "kafka consumer")
+		if len(eng.Config.Inputs.Topics) > 0 {
+			eng.logDebug("input topics:", eng.Config.Inputs.Topics)
+			var topics []string
+			for _, topic := range eng.Config.Inputs.Topics {
+				topics = append(topics, topic.Topic)
+			}
+			consumer, cleanup, err := newKafkaPartitionedConsumer(ctx, eng.Config, eng.Config.Kafka.ConsumerGroup, topics)
+			if err != nil {
+				return errors.Wrap(err, "kafka consumer")
+			}
+			defer cleanup()
+			eng.consumer = newInputLanes(ctx, eng.Config.Inputs.Topics, consumer, eng.Config.Inputs.Strict)
+		} else {
+			eng.logDebug("input topic:", eng.Config.Kafka.InputTopic)
+			var cleanup func()
+			eng.consumer, cleanup, err = newKafkaConsumer(eng.Config, eng.Config.Kafka.ConsumerGroup, eng.Config.Kafka.InputTopic)
+			if err != nil {
+				return errors.Wrap(err, "kafka consumer")
+			}
+			defer cleanup()
 		}
-		defer cleanup()
-		eng.producer, err = processing.NewKafkaProducer(eng.Config.Kafka.Brokers)
+		eng.producer, err = newKafkaProducer(eng.Config)
 		if err != nil {
 			return errors.Wrap(err, "kafka producer")
 		}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// mediaCacheEntry is a file in the media cache.
+type mediaCacheEntry struct {
+	digest string
+	size   int64
+	// uris are the URIs with this content.
+	uris []string
+}
+
+// mediaFetch is a download in progress.
+type mediaFetch struct {
+	done chan struct{}
+	err  error
+	// waiters is the number of open calls waiting for the download.
+	// When they have all given up, the download is cancelled.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// mediaCache is a local disk cache of chunk media, so media isn't
+// downloaded again when a chunk is retried.
+// Files are stored by the SHA-256 of their content, and the least
+// recently used files are evicted once the cache is larger than
+// maxBytes.
+type mediaCache struct {
+	client *http.Client
+	dir    string
+	// temp is whether dir is a temporary directory, which is
+	// removed when the cache is closed.
+	temp bool
+	// maxBytes is the most media to keep.
+	maxBytes int64
+	// attempts is how many times to try each download.
+	attempts int
+	// backoff is the delay before the first retry, which
+	// doubles for each retry after that.
+	backoff time.Duration
+	// idleTimeout is how long each attempt may go without
+	// receiving any data. Zero means no timeout.
+	idleTimeout time.Duration
+	// ctx is cancelled when the cache is closed, which
+	// cancels any downloads.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	size    int64
+	entries map[string]*list.Element // by digest
+	uris    map[string]string        // URI to digest
+	order   *list.List
+	fetches map[string]*mediaFetch // by URI
+}
+
+// newMediaCache makes a mediaCache in dir, holding up to maxBytes.
+// If dir is empty, a temporary directory is used.
+// The cache only knows which URIs its files came from while it is
+// running, so any media (and partial downloads) left in dir by a
+// previous run is removed.
+func newMediaCache(client *http.Client, dir string, maxBytes int64, attempts int) (*mediaCache, error) {
+	temp := dir == ""
+	if temp {
+		var err error
+		dir, err = ioutil.TempDir("", "engine-media")
+		if err != nil {
+			return nil, errors.Wrap(err, "make media cache dir")
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "make media cache dir")
+	} else if err := removeFiles(dir, isMediaCacheFile); err != nil {
+		return nil, errors.Wrap(err, "clean media cache dir")
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &mediaCache{
+		client:      client,
+		dir:         dir,
+		temp:        temp,
+		maxBytes:    maxBytes,
+		attempts:    attempts,
+		backoff:     500 * time.Millisecond,
+		idleTimeout: 30 * time.Second,
+		ctx:         ctx,
+		cancel:      cancel,
+		entries:     make(map[string]*list.Element),
+		uris:        make(map[string]string),
+		order:       list.New(),
+		fetches:     make(map[string]*mediaFetch),
+	}, nil
+}
+
+// open opens the media at uri, downloading it into the cache if
+// it isn't already there.
+func (c *mediaCache) open(ctx context.Context, uri string) (*os.File, error) {
+	for {
+		c.lock.Lock()
+		if f, ok := c.openCached(uri); ok {
+			c.lock.Unlock()
+			return f, nil
+		}
+		fetch, ok := c.fetches[uri]
+		if !ok {
+			fetchCtx, cancel := context.WithCancel(c.ctx)
+			fetch = &mediaFetch{done: make(chan struct{}), cancel: cancel}
+			c.fetches[uri] = fetch
+			go c.fetch(fetchCtx, uri, fetch)
+		}
+		fetch.waiters++
+		c.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			c.giveUp(uri, fetch)
+			return nil, ctx.Err()
+		case <-fetch.done:
+		}
+		c.giveUp(uri, fetch)
+		if fetch.err != nil {
+			return nil, fetch.err
+		}
+	}
+}
+
+// openCached opens the cached media for uri, if any.
+// The lock must be held.
+func (c *mediaCache) openCached(uri string) (*os.File, bool) {
+	digest, ok := c.uris[uri]
+	if !ok {
+		return nil, false
+	}
+	el := c.entries[digest]
+	f, err := os.Open(c.path(digest))
+	if err != nil {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return f, true
+}
+
+// giveUp stops waiting for the fetch. If nothing else is waiting
+// for it, it is cancelled, and the next open starts a new one.
+func (c *mediaCache) giveUp(uri string, fetch *mediaFetch) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fetch.waiters--
+	if fetch.waiters > 0 {
+		return
+	}
+	fetch.cancel()
+	if c.fetches[uri] == fetch {
+		delete(c.fetches, uri)
+	}
+}
+
+// fetch downloads the media into the cache.
+// It isn't cancelled with the request that started it, since other
+// chunks may be waiting for the same media, but only once nothing is
+// waiting for it (or the cache is closed).
+func (c *mediaCache) fetch(ctx context.Context, uri string, fetch *mediaFetch) {
+	defer close(fetch.done)
+	digest, size, err := c.download(ctx, uri)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.fetches[uri] == fetch {
+		delete(c.fetches, uri)
+	}
+	if err != nil {
+		fetch.err = err
+		return
+	}
+	if el, ok := c.entries[digest]; ok {
+		// already have this content from another URI
+		entry := el.Value.(*mediaCacheEntry)
+		entry.uris = append(entry.uris, uri)
+		c.order.MoveToFront(el)
+	} else {
+		entry := &mediaCacheEntry{digest: digest, size: size, uris: []string{uri}}
+		c.entries[digest] = c.order.PushFront(entry)
+		c.size += size
+	}
+	c.uris[uri] = digest
+	// evict, but always keep the newest entry so it can be opened
+	for c.size > c.maxBytes && c.order.Len() > 1 {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove evicts the entry.
+// The lock must be held.
+func (c *mediaCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*mediaCacheEntry)
+	delete(c.entries, entry.digest)
+	for _, uri := range entry.uris {
+		delete(c.uris, uri)
+	}
+	c.size -= entry.size
+	// files that are open can still be read
+	os.Remove(c.path(entry.digest))
+}
+
+// Close cancels any downloads, and removes the cache directory if it
+// is a temporary one.
+// A nil *mediaCache has nothing to close.
+func (c *mediaCache) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.cancel()
+	if !c.temp {
+		return nil
+	}
+	return os.RemoveAll(c.dir)
+}
+
+// path gets the path of the file with the digest.
+func (c *mediaCache) path(digest string) string {
+	return filepath.Join(c.dir, digest)
+}
+
+// isMediaCacheFile gets whether name is the name of a file written
+// by the media cache: cached media named by its SHA-256 digest, or a
+// download in progress.
+func isMediaCacheFile(name string) bool {
+	if strings.HasPrefix(name, "download-") {
+		return true
+	}
+	return isHexDigest(name, sha256.Size)
+}
+
+// isHexDigest gets whether s is a hex encoded digest of size bytes.
+func isHexDigest(s string, size int) bool {
+	if len(s) != hex.EncodedLen(size) {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// removeFiles removes the files in dir whose names match, leaving
+// anything else in the directory alone.
+func removeFiles(dir string, match func(name string) bool) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !match(file.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// download downloads the media to the cache directory, retrying and
+// resuming partial downloads.
+// The length and checksum are verified if the server provides them.
+// Each attempt is given up on if it receives no data for idleTimeout.
+// Returns the SHA-256 digest and size of the content.
+func (c *mediaCache) download(ctx context.Context, uri string) (string, int64, error) {
+	f, err := ioutil.TempFile(c.dir, "download-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	var d mediaDownload
+	var lastErr error
+	for attempt := 0; attempt < c.attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(c.backoff << uint(attempt-1)):
+			case <-ctx.Done():
+				return "", 0, errors.Wrap(lastErr, "download chunk")
+			}
+		}
+		retry, err := d.get(ctx, c.client, uri, f, c.idleTimeout)
+		if err == nil {
+			err = d.verify(f)
+			if err != nil {
+				// start again from scratch
+				d = mediaDownload{}
+				retry = true
+			}
+		}
+		if err == nil {
+			break
+		}
+		lastErr = err
+		if !retry || attempt == c.attempts-1 || ctx.Err() != nil {
+			return "", 0, errors.Wrap(lastErr, "download chunk")
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", 0, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", 0, err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if err := f.Close(); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(f.Name(), c.path(digest)); err != nil {
+		return "", 0, err
+	}
+	return digest, d.written, nil
+}
+
+// mediaDownload is the state of a download across attempts.
+type mediaDownload struct {
+	written int64
+	// length is the expected length, or -1 if not known.
+	length int64
+	// validator is the ETag (or Last-Modified) of the media, used to
+	// make sure a resumed download is of the same content.
+	validator string
+	// checksum is the expected checksum from the headers (if any).
+	checksum    []byte
+	newChecksum func() hash.Hash
+}
+
+// get requests the rest of the media and appends it to f.
+// The request is cancelled if no data is received for idleTimeout.
+// Returns whether it is worth trying again if it fails.
+func (d *mediaDownload) get(ctx context.Context, client *http.Client, uri string, f *os.File, idleTimeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var idle *time.Timer
+	if idleTimeout > 0 {
+		// this also covers waiting for the response
+		idle = time.AfterFunc(idleTimeout, cancel)
+		defer idle.Stop()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return false, err
+	}
+	if d.written > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(d.written, 10)+"-")
+		if d.validator != "" {
+			req.Header.Set("If-Range", d.validator)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the whole media (maybe because the server can't resume,
+		// or it has changed)
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		*d = mediaDownload{length: resp.ContentLength}
+		d.validator = resp.Header.Get("ETag")
+		if d.validator == "" {
+			d.validator = resp.Header.Get("Last-Modified")
+		}
+		d.checksum, d.newChecksum = responseChecksum(resp.Header)
+	case http.StatusPartialContent:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != d.written {
+			d.written = 0
+			return true, errors.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+		}
+		if total >= 0 {
+			d.length = total
+		}
+	default:
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, errors.Errorf("%s", resp.Status)
+	}
+	var body io.Reader = resp.Body
+	if idle != nil {
+		body = &idleTimeoutReader{r: resp.Body, timer: idle, timeout: idleTimeout}
+	}
+	n, err := io.Copy(f, body)
+	d.written += n
+	if err != nil {
+		return true, errors.Wrapf(err, "after %d bytes", d.written)
+	}
+	if d.length >= 0 && d.written < d.length {
+		return true, errors.Errorf("expected %d bytes but got %d", d.length, d.written)
+	}
+	return false, nil
+}
+
+// idleTimeoutReader resets the timer every time data is read,
+// so it only fires if the reader is idle for the timeout.
+type idleTimeoutReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	return n, err
+}
+
+// verify checks the downloaded media against the expected length
+// and checksum.
+func (d *mediaDownload) verify(f *os.File) error {
+	if d.length >= 0 && d.written != d.length {
+		return errors.Errorf("expected %d bytes but got %d", d.length, d.written)
+	}
+	if d.newChecksum == nil {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	h := d.newChecksum()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), d.checksum) {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// responseChecksum gets the expected checksum of the content from
+// the Content-MD5 or Digest (sha-256 or md5) headers, if any.
+func responseChecksum(header http.Header) ([]byte, func() hash.Hash) {
+	if v := header.Get("Content-MD5"); v != "" {
+		if sum, err := base64.StdEncoding.DecodeString(v); err == nil {
+			return sum, md5.New
+		}
+	}
+	for _, digest := range strings.Split(header.Get("Digest"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(parts[0]) {
+		case "sha-256":
+			return sum, sha256.New
+		case "md5":
+			return sum, md5.New
+		}
+	}
+	return nil, nil
+}
+
+// parseContentRange parses a Content-Range header like
+// "bytes 100-199/200". The total is -1 if it is unknown.
+func parseContentRange(s string) (start, total int64, ok bool) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, false
+	}
+	s = strings.TrimPrefix(s, "bytes ")
+	slash := strings.Index(s, "/")
+	dash := strings.Index(s, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(s[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	total = -1
+	if s[slash+1:] != "*" {
+		total, err = strconv.ParseInt(s[slash+1:], 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, total, true
+}
+
+// sendsChunkMedia gets whether the chunk media is sent to the engine,
+// which is the case if it has inline content, or it can be downloaded
+// from its cache URI.
+func (e *Engine) sendsChunkMedia(chunk processing.MediaChunkMessage) bool {
+	if chunk.CacheURI == "" {
+		return chunk.Content != ""
+	}
+	return !e.Config.Processing.DisableChunkDownload
+}
+
+// openMedia opens the media for the chunk, from the media cache or
+// prefetcher if they are enabled, otherwise by downloading it.
+// Chunks without a cache URI have their inline content instead.
+func (e *Engine) openMedia(ctx context.Context, chunk processing.MediaChunkMessage) (io.ReadCloser, error) {
+	if chunk.CacheURI == "" {
+		return ioutil.NopCloser(strings.NewReader(chunk.Content)), nil
+	}
+	if e.mediaCache != nil {
+		return e.mediaCache.open(ctx, chunk.CacheURI)
+	}
+	if e.prefetcher != nil {
+		return e.prefetcher.open(ctx, chunk)
+	}
+	return downloadMedia(ctx, e.webhookClient, chunk.CacheURI)
+}
+
+// downloadMedia starts downloading the media at uri.
+func downloadMedia(ctx context.Context, client *http.Client, uri string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("download chunk: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
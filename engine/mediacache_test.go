@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+// newTestMediaCache makes a mediaCache in a temporary directory.
+// The returned func cleans up.
+func newTestMediaCache(t *testing.T, maxBytes int64, attempts int) (*mediaCache, func()) {
+	dir, err := ioutil.TempDir("", "media-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := newMediaCache(http.DefaultClient, dir, maxBytes, attempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.backoff = time.Millisecond
+	return c, func() { os.RemoveAll(dir) }
+}
+
+// readCached reads the media at uri through the cache.
+func readCached(t *testing.T, c *mediaCache, uri string) (string, error) {
+	f, err := c.open(context.Background(), uri)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), nil
+}
+
+func TestMediaCache(t *testing.T) {
+	is := is.New(t)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprintf(w, "content of %s", r.URL.Path[1:2])
+	}))
+	defer srv.Close()
+	c, cleanup := newTestMediaCache(t, 30, 1)
+	defer cleanup()
+
+	content, err := readCached(t, c, srv.URL+"/a")
+	is.NoErr(err)
+	is.Equal(content, "content of a")
+	content, err = readCached(t, c, srv.URL+"/a")
+	is.NoErr(err)
+	is.Equal(content, "content of a")
+	is.Equal(atomic.LoadInt32(&requests), int32(1)) // cached
+
+	// the same content from another URI is stored once
+	_, err = readCached(t, c, srv.URL+"/a2")
+	is.NoErr(err)
+	is.Equal(len(c.entries), 1)
+	is.Equal(c.size, int64(12))
+
+	// b and c don't both fit with a, so a is evicted
+	_, err = readCached(t, c, srv.URL+"/b")
+	is.NoErr(err)
+	_, err = readCached(t, c, srv.URL+"/c")
+	is.NoErr(err)
+	is.Equal(len(c.entries), 2)
+	_, ok := c.uris[srv.URL+"/a"]
+	is.Equal(ok, false)
+	files, err := ioutil.ReadDir(c.dir)
+	is.NoErr(err)
+	is.Equal(len(files), 2)
+}
+
+func TestMediaCacheResume(t *testing.T) {
+	is := is.New(t)
+	const content = "0123456789abcdefghij"
+	var ranges []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("Range") == "" {
+			// send half, then fail
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write([]byte(content[:10]))
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		is.Equal(r.Header.Get("If-Range"), `"v1"`)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 10-19/%d", len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[10:]))
+	}))
+	defer srv.Close()
+	c, cleanup := newTestMediaCache(t, 1024, 3)
+	defer cleanup()
+	got, err := readCached(t, c, srv.URL)
+	is.NoErr(err)
+	is.Equal(got, content)
+	is.Equal(ranges, []string{"", "bytes=10-"})
+}
+
+func TestMediaCacheChecksum(t *testing.T) {
+	is := is.New(t)
+	const content = "media content"
+	sum := md5.Sum([]byte(content))
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		if n == 1 || r.URL.Path == "/corrupt" {
+			w.Write([]byte("media c0ntent"))
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+	c, cleanup := newTestMediaCache(t, 1024, 2)
+	defer cleanup()
+	got, err := readCached(t, c, srv.URL)
+	is.NoErr(err)
+	is.Equal(got, content)
+	is.Equal(atomic.LoadInt32(&requests), int32(2)) // first download was corrupt
+
+	_, err = readCached(t, c, srv.URL+"/corrupt")
+	is.True(err != nil) // always corrupt
+	is.Equal(len(c.entries), 1)
+}
+
+func TestMediaCacheNotFound(t *testing.T) {
+	is := is.New(t)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	c, cleanup := newTestMediaCache(t, 1024, 3)
+	defer cleanup()
+	_, err := readCached(t, c, srv.URL)
+	is.True(err != nil)
+	is.Equal(atomic.LoadInt32(&requests), int32(1)) // not retried
+}
+
+func TestMediaCacheIdleTimeout(t *testing.T) {
+	is := is.New(t)
+	const content = "0123456789abcdefghij"
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// send half, then stall
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			w.Write([]byte(content[:10]))
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 10-19/%d", len(content)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(content[10:]))
+	}))
+	defer srv.Close()
+	c, cleanup := newTestMediaCache(t, 1024, 2)
+	defer cleanup()
+	c.idleTimeout = 50 * time.Millisecond
+	got, err := readCached(t, c, srv.URL)
+	is.NoErr(err)
+	is.Equal(got, content)
+	is.Equal(atomic.LoadInt32(&requests), int32(2))
+}
+
+func TestMediaCacheCancelledFetch(t *testing.T) {
+	is := is.New(t)
+	var requests int32
+	stalled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			close(stalled)
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("media content"))
+	}))
+	defer srv.Close()
+	c, cleanup := newTestMediaCache(t, 1024, 1)
+	defer cleanup()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stalled
+		cancel()
+	}()
+	_, err := c.open(ctx, srv.URL)
+	is.Equal(err, context.Canceled)
+	// the next open doesn't join the cancelled download
+	got, err := readCached(t, c, srv.URL)
+	is.NoErr(err)
+	is.Equal(got, "media content")
+	is.Equal(atomic.LoadInt32(&requests), int32(2))
+}
+
+// TestMediaCacheLeftovers ensures files left in a configured cache
+// directory by a previous run are removed, since they aren't counted
+// towards the size of the cache.
+func TestMediaCacheLeftovers(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "media-cache-test")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	leftovers := []string{
+		"download-123456",
+		"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+	}
+	for _, name := range append(leftovers, "notes.txt") {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte("test"), 0644)
+		is.NoErr(err)
+	}
+	c, err := newMediaCache(http.DefaultClient, dir, 30, 1)
+	is.NoErr(err)
+	defer c.Close()
+	is.Equal(c.size, int64(0))
+	for _, name := range leftovers {
+		_, err := os.Stat(filepath.Join(dir, name))
+		is.True(os.IsNotExist(err)) // leftover should be removed
+	}
+	_, err = os.Stat(filepath.Join(dir, "notes.txt"))
+	is.NoErr(err) // other files are left alone
+}
+
+func TestParseContentRange(t *testing.T) {
+	is := is.New(t)
+	start, total, ok := parseContentRange("bytes 100-199/200")
+	is.True(ok)
+	is.Equal(start, int64(100))
+	is.Equal(total, int64(200))
+	start, total, ok = parseContentRange("bytes 100-199/*")
+	is.True(ok)
+	is.Equal(start, int64(100))
+	is.Equal(total, int64(-1))
+	_, _, ok = parseContentRange("bytes */200")
+	is.Equal(ok, false)
+}
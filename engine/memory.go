@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// memoryBudget limits the total size of the chunks in flight.
+// A nil *memoryBudget is valid and has no limit.
+type memoryBudget struct {
+	limit int64
+
+	lock sync.Mutex
+	used int64
+	// changed is closed (and replaced) when memory is released.
+	changed chan struct{}
+}
+
+// newMemoryBudget makes a memoryBudget of limit bytes.
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{
+		limit:   limit,
+		changed: make(chan struct{}),
+	}
+}
+
+// acquire waits until n bytes are available, and takes them.
+// A chunk larger than the whole budget may be acquired when
+// nothing else is in flight, so it isn't stuck forever.
+func (b *memoryBudget) acquire(ctx context.Context, n int64) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	for {
+		b.lock.Lock()
+		if b.used == 0 || b.used+n <= b.limit {
+			b.used += n
+			b.lock.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// grow takes n more bytes without waiting, for memory that is
+// already in use.
+func (b *memoryBudget) grow(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used += n
+}
+
+// release gives back n bytes.
+func (b *memoryBudget) release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used -= n
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// waitForSpace waits until the budget is not used up.
+func (b *memoryBudget) waitForSpace(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.lock.Lock()
+		if b.used < b.limit {
+			b.lock.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.lock.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// space gets whether the budget is not used up, and if it is, a
+// channel that is closed when memory is released.
+func (b *memoryBudget) space() (bool, <-chan struct{}) {
+	if b == nil {
+		return true, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.used < b.limit {
+		return true, nil
+	}
+	return false, b.changed
+}
+
+// memoryHold is the memory held against a memoryBudget for a chunk.
+// It starts at an estimate of the chunk size, and grows if more of the
+// chunk is read than was estimated.
+// A nil *memoryHold is valid and holds nothing.
+type memoryHold struct {
+	budget *memoryBudget
+
+	lock sync.Mutex
+	held int64
+	// measured is the most of the chunk that has been read, or zero
+	// if none of it has.
+	measured int64
+	released bool
+}
+
+// hold waits until n bytes are available, and holds them for a chunk
+// (see acquire).
+func (b *memoryBudget) hold(ctx context.Context, n int64) (*memoryHold, error) {
+	if b == nil {
+		return nil, nil
+	}
+	if err := b.acquire(ctx, n); err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		n = 0
+	}
+	return &memoryHold{budget: b, held: n}, nil
+}
+
+// measure records that n bytes of the chunk have been read, and
+// grows the hold (without waiting) if that is more than is held.
+// Once the hold is released, nothing more is held.
+func (h *memoryHold) measure(n int64) {
+	if h == nil {
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if n > h.measured {
+		h.measured = n
+	}
+	if h.released || n <= h.held {
+		return
+	}
+	h.budget.grow(n - h.held)
+	h.held = n
+}
+
+// reader gets a reader that measures the chunk media read from r.
+func (h *memoryHold) reader(r io.Reader) io.Reader {
+	if h == nil {
+		return r
+	}
+	return &measuringReader{r: r, hold: h}
+}
+
+// release gives back the memory, and gets the measured size of the
+// chunk, or zero if none of it was read.
+func (h *memoryHold) release() int64 {
+	if h == nil {
+		return 0
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.released {
+		h.released = true
+		h.budget.release(h.held)
+	}
+	return h.measured
+}
+
+// measuringReader measures the chunk media as it is read.
+type measuringReader struct {
+	r    io.Reader
+	hold *memoryHold
+	read int64
+}
+
+func (r *measuringReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.read += int64(n)
+		r.hold.measure(r.read)
+	}
+	return n, err
+}
+
+// Used gets the number of bytes in use.
+func (b *memoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.used
+}
+
+// chunkSize estimates the size of the chunk before it is downloaded,
+// from the inline content or the Content-Length of a HEAD request
+// for the media.
+// Returns Memory.DefaultChunkBytes if the size is not known, which
+// includes servers that don't allow HEAD requests (like presigned S3
+// URLs, which are only signed for GET). More is held if more of the
+// chunk than that is read (see memoryHold).
+// Returns zero for chunks whose media isn't downloaded.
+func (e *Engine) chunkSize(ctx context.Context, mediaChunk processing.MediaChunkMessage) int64 {
+	if mediaChunk.Content != "" {
+		return int64(len(mediaChunk.Content))
+	}
+	if mediaChunk.CacheURI == "" || e.Config.Processing.DisableChunkDownload {
+		return 0
+	}
+	unknown := e.Config.Memory.DefaultChunkBytes
+	req, err := http.NewRequest(http.MethodHead, mediaChunk.CacheURI, nil)
+	if err != nil {
+		return unknown
+	}
+	req = req.WithContext(ctx)
+	resp, err := e.webhookClient.Do(req)
+	if err != nil {
+		e.logDebug("WARN", "chunk size:", err)
+		return unknown
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return unknown
+	}
+	return resp.ContentLength
+}
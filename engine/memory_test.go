@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	b := newMemoryBudget(100)
+	is.NoErr(b.acquire(ctx, 60))
+	is.NoErr(b.waitForSpace(ctx))
+
+	acquired := make(chan struct{})
+	go func() {
+		is.NoErr(b.acquire(ctx, 60))
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		is.Fail() // should wait for the first 60 bytes
+	case <-time.After(100 * time.Millisecond):
+	}
+	b.release(60)
+	select {
+	case <-acquired:
+	case <-time.After(500 * time.Millisecond):
+		is.Fail() // timed out
+	}
+
+	// memory already in use is counted straight away
+	b.grow(40)
+	is.Equal(b.Used(), int64(100))
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	is.Equal(b.waitForSpace(shortCtx), context.DeadlineExceeded)
+	b.release(100)
+	is.Equal(b.Used(), int64(0))
+
+	// a chunk larger than the budget may go when nothing else is in flight
+	is.NoErr(b.acquire(ctx, 500))
+	b.release(500)
+
+	var nilBudget *memoryBudget
+	is.NoErr(nilBudget.acquire(ctx, 500))
+	is.NoErr(nilBudget.waitForSpace(ctx))
+	nilBudget.release(500)
+	is.Equal(nilBudget.Used(), int64(0))
+}
+
+func TestMemoryHold(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	b := newMemoryBudget(100)
+	hold, err := b.hold(ctx, 10)
+	is.NoErr(err)
+	is.Equal(b.Used(), int64(10))
+
+	// reading more than the estimate grows the hold
+	r := hold.reader(strings.NewReader(strings.Repeat("a", 30)))
+	buf := make([]byte, 20)
+	_, err = io.ReadFull(r, buf)
+	is.NoErr(err)
+	is.Equal(b.Used(), int64(20))
+	_, err = ioutil.ReadAll(r)
+	is.NoErr(err)
+	is.Equal(b.Used(), int64(30))
+	hold.measure(5) // less than is held
+	is.Equal(b.Used(), int64(30))
+
+	is.Equal(hold.release(), int64(30))
+	is.Equal(b.Used(), int64(0))
+	// nothing is held once released
+	hold.measure(50)
+	is.Equal(hold.release(), int64(50))
+	is.Equal(b.Used(), int64(0))
+
+	var nilBudget *memoryBudget
+	nilHold, err := nilBudget.hold(ctx, 10)
+	is.NoErr(err)
+	nilHold.measure(10)
+	is.Equal(nilHold.release(), int64(0))
+}
+
+func TestChunkSize(t *testing.T) {
+	is := is.New(t)
+	mediaSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.Equal(r.Method, http.MethodHead)
+		w.Header().Set("Content-Length", "12345")
+	}))
+	defer mediaSrv.Close()
+	engine := NewEngine()
+	engine.Config.Processing.DisableChunkDownload = false
+	engine.logDebug = func(args ...interface{}) {}
+	ctx := context.Background()
+
+	is.Equal(engine.chunkSize(ctx, processing.MediaChunkMessage{Content: strings.Repeat("a", 10)}), int64(10))
+	is.Equal(engine.chunkSize(ctx, processing.MediaChunkMessage{CacheURI: mediaSrv.URL}), int64(12345))
+	is.Equal(engine.chunkSize(ctx, processing.MediaChunkMessage{}), int64(0))
+	// the default is held when the size isn't known
+	forbiddenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer forbiddenSrv.Close()
+	engine.Config.Memory.DefaultChunkBytes = 500
+	is.Equal(engine.chunkSize(ctx, processing.MediaChunkMessage{CacheURI: forbiddenSrv.URL}), int64(500))
+	engine.Config.Processing.DisableChunkDownload = true
+	is.Equal(engine.chunkSize(ctx, processing.MediaChunkMessage{CacheURI: mediaSrv.URL}), int64(0))
+}
+
+// TestProcessingChunkMemoryBudgetRetry ensures the chunk size is only
+// estimated once, even if the media server doesn't allow HEAD requests.
+func TestProcessingChunkMemoryBudgetRetry(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Processing.DisableChunkDownload = false
+	engine.Config.Memory.BudgetBytes = 1024
+	engine.Config.Webhooks.Backoff.InitialBackoffDuration = 10 * time.Millisecond
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	var heads int32
+	mediaSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// like a presigned URL, which is only signed for GET
+			atomic.AddInt32(&heads, 1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("media content"))
+	}))
+	defer mediaSrv.Close()
+	var calls int32
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		err := json.NewEncoder(w).Encode(engineOutput{
+			Series: []seriesObject{{Object: object{Label: "something"}}},
+		})
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	inputMessage := processing.MediaChunkMessage{
+		TimestampUTC:  time.Now().Unix(),
+		ChunkUUID:     "123",
+		Type:          processing.MessageTypeMediaChunk,
+		StartOffsetMS: 1000,
+		EndOffsetMS:   2000,
+		JobID:         "job1",
+		TDOID:         "tdo1",
+		TaskID:        "task1",
+		CacheURI:      mediaSrv.URL,
+	}
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder(inputMessage.TaskID),
+		Value:  processing.NewJSONEncoder(inputMessage),
+	})
+	is.NoErr(err)
+
+	var outputMsg *sarama.ConsumerMessage
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(3 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	var result chunkResult
+	err = json.Unmarshal(outputMsg.Value, &result)
+	is.NoErr(err)
+	is.Equal(result.Status, processing.ChunkStatusSuccess)
+	is.Equal(result.Attempts, 2)
+	is.Equal(atomic.LoadInt32(&heads), int32(1))
+	is.Equal(engine.memory.Used(), int64(0))
+}
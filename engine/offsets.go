@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// offsetTracker keeps track of in-flight messages for each partition
+// so that offsets are only committed once a message, and every message
+// before it in the same partition, has been completed.
+// This gives at-least-once delivery: anything not completed when the
+// engine dies will be redelivered.
+type offsetTracker struct {
+	lock       sync.Mutex
+	partitions map[topicPartition]*partitionOffsets
+}
+
+// topicPartition identifies a Kafka partition.
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionOffsets holds the in-flight state of a single partition.
+type partitionOffsets struct {
+	// pending is the ordered list of offsets that have been
+	// consumed but not yet committed.
+	pending []int64
+	// completed holds the messages that have completed but can't
+	// be committed until the offsets before them complete.
+	completed map[int64]*sarama.ConsumerMessage
+}
+
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[topicPartition]*partitionOffsets),
+	}
+}
+
+// track records that msg has been consumed and is now in flight.
+func (t *offsetTracker) track(msg *sarama.ConsumerMessage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p := t.partition(msg)
+	i := sort.Search(len(p.pending), func(i int) bool {
+		return p.pending[i] >= msg.Offset
+	})
+	if i < len(p.pending) && p.pending[i] == msg.Offset {
+		// redelivered while still in flight
+		return
+	}
+	p.pending = append(p.pending, 0)
+	copy(p.pending[i+1:], p.pending[i:])
+	p.pending[i] = msg.Offset
+}
+
+// done records that msg has completed, and returns the message with the
+// highest contiguous completed offset in its partition.
+// The returned message is the one whose offset should be committed, or nil
+// if nothing can be committed yet.
+func (t *offsetTracker) done(msg *sarama.ConsumerMessage) *sarama.ConsumerMessage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	p := t.partition(msg)
+	p.completed[msg.Offset] = msg
+	var commit *sarama.ConsumerMessage
+	for len(p.pending) > 0 {
+		m, ok := p.completed[p.pending[0]]
+		if !ok {
+			break
+		}
+		delete(p.completed, p.pending[0])
+		p.pending = p.pending[1:]
+		commit = m
+	}
+	return commit
+}
+
+// inFlight gets the number of messages that have been tracked
+// but not yet committed.
+func (t *offsetTracker) inFlight() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var n int
+	for _, p := range t.partitions {
+		n += len(p.pending)
+	}
+	return n
+}
+
+// partition gets the partitionOffsets for msg, creating it if needed.
+// Callers must hold the lock.
+func (t *offsetTracker) partition(msg *sarama.ConsumerMessage) *partitionOffsets {
+	key := topicPartition{topic: msg.Topic, partition: msg.Partition}
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionOffsets{
+			completed: make(map[int64]*sarama.ConsumerMessage),
+		}
+		t.partitions[key] = p
+	}
+	return p
+}
+
+// Backoff between attempts to produce a ChunkResult.
+const (
+	minProduceBackoff = 100 * time.Millisecond
+	maxProduceBackoff = 10 * time.Second
+)
+
+// abandonedError is returned when a message was consumed but no ChunkResult
+// was produced for it before shutting down, in which case its offset must
+// not be committed.
+type abandonedError struct {
+	err error
+}
+
+func (a abandonedError) Error() string {
+	return "abandoned: " + a.err.Error()
+}
+
+// isAbandoned gets whether err (or its cause) is an abandonedError.
+func isAbandoned(err error) bool {
+	_, ok := errors.Cause(err).(abandonedError)
+	return ok
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	is := is.New(t)
+	tracker := newOffsetTracker()
+	msg1 := &sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 1}
+	msg2 := &sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 2}
+	msg3 := &sarama.ConsumerMessage{Topic: "topic", Partition: 1, Offset: 3}
+	otherPartition := &sarama.ConsumerMessage{Topic: "topic", Partition: 2, Offset: 10}
+	tracker.track(msg1)
+	tracker.track(msg2)
+	tracker.track(msg3)
+	tracker.track(otherPartition)
+	is.Equal(tracker.inFlight(), 4)
+
+	is.Equal(tracker.done(msg2), nil)                      // msg1 is still in flight
+	is.Equal(tracker.done(otherPartition), otherPartition) // partitions are independent
+	is.Equal(tracker.done(msg1), msg2)                     // highest contiguous offset
+	is.Equal(tracker.inFlight(), 1)
+	is.Equal(tracker.done(msg3), msg3)
+	is.Equal(tracker.inFlight(), 0)
+}
+
+func TestOffsetTrackerRedelivery(t *testing.T) {
+	is := is.New(t)
+	tracker := newOffsetTracker()
+	msg1 := &sarama.ConsumerMessage{Offset: 1}
+	msg2 := &sarama.ConsumerMessage{Offset: 2}
+	tracker.track(msg2)
+	tracker.track(msg1) // redelivered after a rebalance
+	tracker.track(msg2) // duplicate
+	is.Equal(tracker.inFlight(), 2)
+	is.Equal(tracker.done(msg2), nil)
+	is.Equal(tracker.done(msg1), msg2)
+}
+
+func TestIsAbandoned(t *testing.T) {
+	is := is.New(t)
+	is.Equal(isAbandoned(nil), false)
+	is.Equal(isAbandoned(errors.New("nope")), false)
+	err := errors.Wrap(abandonedError{err: errors.New("nope")}, "process media chunk")
+	is.Equal(isAbandoned(err), true)
+}
+
+// TestOffsetsCommittedAfterChunkResult simulates a crash part way through
+// processing a chunk and ensures its offset is never committed, even though
+// a later chunk in the same partition completed.
+func TestOffsetsCommittedAfterChunkResult(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Processing.Concurrency = 2
+	engine.Config.Webhooks.Backoff.MaxRetries = 0
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("startOffsetMS") == "1000" {
+			// the first chunk never finishes
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, err := w.Write([]byte(`{"series":[]}`))
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	for i, chunkUUID := range []string{"chunk1", "chunk2"} {
+		inputMessage := processing.MediaChunkMessage{
+			TimestampUTC:  time.Now().Unix(),
+			ChunkUUID:     chunkUUID,
+			Type:          processing.MessageTypeMediaChunk,
+			StartOffsetMS: (i + 1) * 1000,
+			EndOffsetMS:   (i + 2) * 1000,
+			JobID:         "job1",
+			TDOID:         "tdo1",
+			TaskID:        "task1",
+		}
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: int64(i + 1),
+			Key:    sarama.StringEncoder(inputMessage.TaskID),
+			Value:  processing.NewJSONEncoder(inputMessage),
+		})
+		is.NoErr(err)
+	}
+
+	var outputMsg *sarama.ConsumerMessage
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(1 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	var chunkResult processing.ChunkResult
+	err := json.Unmarshal(outputMsg.Value, &chunkResult)
+	is.NoErr(err)
+	is.Equal(chunkResult.ChunkUUID, "chunk2")
+	is.Equal(chunkResult.Status, processing.ChunkStatusSuccess)
+	time.Sleep(100 * time.Millisecond)
+	is.Equal(inputPipe.Offset, int64(0)) // chunk1 still in flight
+
+	// crash mid-chunk
+	cancel()
+	<-done
+	select {
+	case outputMsg = <-outputPipe.Messages():
+		is.Fail() // no ChunkResult should be produced for chunk1
+	case <-time.After(100 * time.Millisecond):
+	}
+	is.Equal(inputPipe.Offset, int64(0)) // nothing committed
+}
+
+// flakyProducer fails to send the first failures messages.
+type flakyProducer struct {
+	processing.Producer
+	failures int32
+}
+
+func (p *flakyProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	if atomic.AddInt32(&p.failures, -1) >= 0 {
+		return 0, 0, errors.New("kafka unavailable")
+	}
+	return p.Producer.SendMessage(msg)
+}
+
+// TestOffsetsCommittedAfterProduceRetry ensures a ChunkResult that
+// fails to send is retried, rather than leaving its offset uncommitted
+// and holding back the rest of the partition.
+func TestOffsetsCommittedAfterProduceRetry(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = &flakyProducer{Producer: outputPipe, failures: 2}
+	processSrv := newOKServer()
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	for i, chunkUUID := range []string{"chunk1", "chunk2"} {
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: int64(i + 1),
+			Key:    sarama.StringEncoder("task1"),
+			Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+				Type:          processing.MessageTypeMediaChunk,
+				TaskID:        "task1",
+				ChunkUUID:     chunkUUID,
+				StartOffsetMS: i * 1000,
+				EndOffsetMS:   (i + 1) * 1000,
+			}),
+		})
+		is.NoErr(err)
+	}
+	for range []string{"chunk1", "chunk2"} {
+		select {
+		case <-outputPipe.Messages():
+		case <-time.After(2 * time.Second):
+			is.Fail() // timed out
+		}
+	}
+	waitForOffset(t, inputPipe, 2)
+}
+
+// waitForOffset waits for the offset of the pipe to be marked.
+func waitForOffset(t *testing.T, pipe *processing.Pipe, offset int64) {
+	is := is.New(t)
+	deadline := time.Now().Add(1 * time.Second)
+	for pipe.Offset != offset {
+		if time.Now().After(deadline) {
+			is.Equal(pipe.Offset, offset) // timed out waiting for offset
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// outputOrder holds back ChunkResults so that the results for each
+// task are produced in StartOffsetMS order, even when chunks are
+// processed concurrently.
+//
+// Chunks are registered as they start processing. A completed chunk
+// waits until every chunk for the same task with an earlier offset
+// has been produced (and forgotten), so only one result for each task
+// is produced at a time. If it has waited longer than timeout, or more
+// than maxBuffered chunks for the task are waiting, the incomplete
+// chunks holding it up are skipped and their results are produced
+// whenever they are ready.
+// A nil *outputOrder is valid and does not reorder anything.
+type outputOrder struct {
+	timeout     time.Duration
+	maxBuffered int
+	logDebug    func(args ...interface{})
+
+	lock sync.Mutex
+	// tasks holds the chunks still to be produced for each task,
+	// in offset order.
+	tasks map[string][]*orderedChunk
+	// chunks holds every registered chunk by message ID.
+	chunks map[string]*orderedChunk
+}
+
+// orderedChunk is a chunk waiting for its turn to be produced.
+type orderedChunk struct {
+	id            string
+	taskID        string
+	startOffsetMS int
+	// done is true once the result is ready to be produced.
+	done bool
+	// released is true once it is this chunk's turn.
+	released bool
+	// ready is closed when it is this chunk's turn.
+	ready chan struct{}
+}
+
+// newOutputOrder makes a new outputOrder.
+func newOutputOrder(timeout time.Duration, maxBuffered int, logDebug func(args ...interface{})) *outputOrder {
+	return &outputOrder{
+		timeout:     timeout,
+		maxBuffered: maxBuffered,
+		logDebug:    logDebug,
+		tasks:       make(map[string][]*orderedChunk),
+		chunks:      make(map[string]*orderedChunk),
+	}
+}
+
+// register records that the chunk in msg has started processing.
+// Messages that are not media chunks are ignored.
+// Must be called in the order messages are consumed.
+func (o *outputOrder) register(msg *sarama.ConsumerMessage) {
+	if o == nil {
+		return
+	}
+	var mediaChunk processing.MediaChunkMessage
+	if err := json.Unmarshal(msg.Value, &mediaChunk); err != nil {
+		return
+	}
+	if mediaChunk.Type != processing.MessageTypeMediaChunk {
+		return
+	}
+	chunk := &orderedChunk{
+		id:            journalID(msg),
+		taskID:        mediaChunk.TaskID,
+		startOffsetMS: mediaChunk.StartOffsetMS,
+		ready:         make(chan struct{}),
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	pending := o.tasks[chunk.taskID]
+	i := sort.Search(len(pending), func(i int) bool {
+		return pending[i].startOffsetMS > chunk.startOffsetMS
+	})
+	// a chunk whose turn it is can't be overtaken
+	for i < len(pending) && pending[i].released {
+		i++
+	}
+	pending = append(pending, nil)
+	copy(pending[i+1:], pending[i:])
+	pending[i] = chunk
+	o.tasks[chunk.taskID] = pending
+	o.chunks[chunk.id] = chunk
+}
+
+// wait marks the chunk in msg as complete, and blocks until
+// its result may be produced.
+func (o *outputOrder) wait(ctx context.Context, msg *sarama.ConsumerMessage) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	chunk, ok := o.chunks[journalID(msg)]
+	if !ok {
+		o.lock.Unlock()
+		return
+	}
+	chunk.done = true
+	o.release(chunk.taskID)
+	if o.buffered(chunk.taskID) > o.maxBuffered {
+		o.logDebug(fmt.Sprintf("ordered output: too many results waiting for task %s, skipping ahead", chunk.taskID))
+		o.skip(chunk)
+	}
+	o.lock.Unlock()
+	timer := time.NewTimer(o.timeout)
+	defer timer.Stop()
+	select {
+	case <-chunk.ready:
+	case <-timer.C:
+		o.lock.Lock()
+		o.logDebug(fmt.Sprintf("ordered output: chunk at %dms for task %s waited %s, skipping ahead", chunk.startOffsetMS, chunk.taskID, o.timeout))
+		o.skip(chunk)
+		o.lock.Unlock()
+		<-chunk.ready
+	case <-ctx.Done():
+	}
+}
+
+// forget removes the chunk in msg, whether or not its result
+// was produced, so it doesn't hold up later chunks.
+// Must be called once the message is finished with.
+func (o *outputOrder) forget(msg *sarama.ConsumerMessage) {
+	if o == nil {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	chunk, ok := o.chunks[journalID(msg)]
+	if !ok {
+		return
+	}
+	delete(o.chunks, chunk.id)
+	o.remove(chunk)
+	o.release(chunk.taskID)
+}
+
+// release lets the chunk at the front of the task's queue be
+// produced, if it is complete. It stays in the queue until it is
+// forgotten, so the next chunk waits for it to be produced.
+// Callers must hold the lock.
+func (o *outputOrder) release(taskID string) {
+	pending := o.tasks[taskID]
+	if len(pending) > 0 && pending[0].done && !pending[0].released {
+		pending[0].released = true
+		close(pending[0].ready)
+	}
+}
+
+// skip removes the incomplete chunks ahead of chunk so they
+// no longer hold it up.
+// Callers must hold the lock.
+func (o *outputOrder) skip(chunk *orderedChunk) {
+	pending := o.tasks[chunk.taskID]
+	index := -1
+	for i, c := range pending {
+		if c == chunk {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		// already skipped
+		return
+	}
+	var keep []*orderedChunk
+	for _, c := range pending[:index] {
+		if c.done {
+			keep = append(keep, c)
+			continue
+		}
+		// skipped chunks are produced whenever they are ready
+		c.released = true
+		close(c.ready)
+	}
+	keep = append(keep, pending[index:]...)
+	o.setPending(chunk.taskID, keep)
+	o.release(chunk.taskID)
+}
+
+// remove takes chunk out of its task's queue (if it is still there).
+// Callers must hold the lock.
+func (o *outputOrder) remove(chunk *orderedChunk) {
+	pending := o.tasks[chunk.taskID]
+	for i, c := range pending {
+		if c == chunk {
+			pending = append(pending[:i:i], pending[i+1:]...)
+			break
+		}
+	}
+	o.setPending(chunk.taskID, pending)
+}
+
+// buffered gets the number of completed chunks waiting for the task.
+// Callers must hold the lock.
+func (o *outputOrder) buffered(taskID string) int {
+	var n int
+	for _, c := range o.tasks[taskID] {
+		if c.done {
+			n++
+		}
+	}
+	return n
+}
+
+// setPending updates the queue for the task.
+// Callers must hold the lock.
+func (o *outputOrder) setPending(taskID string, pending []*orderedChunk) {
+	if len(pending) == 0 {
+		delete(o.tasks, taskID)
+		return
+	}
+	o.tasks[taskID] = pending
+}
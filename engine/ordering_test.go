@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// orderedTestMessage makes a media chunk message for testing outputOrder.
+func orderedTestMessage(t *testing.T, offset int64, taskID string, startOffsetMS int) *sarama.ConsumerMessage {
+	value, err := json.Marshal(processing.MediaChunkMessage{
+		Type:          processing.MessageTypeMediaChunk,
+		TaskID:        taskID,
+		StartOffsetMS: startOffsetMS,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sarama.ConsumerMessage{Offset: offset, Value: value}
+}
+
+func TestOutputOrder(t *testing.T) {
+	is := is.New(t)
+	o := newOutputOrder(1*time.Second, 10, func(args ...interface{}) {})
+	ctx := context.Background()
+	msg1 := orderedTestMessage(t, 1, "task1", 0)
+	msg2 := orderedTestMessage(t, 2, "task1", 1000)
+	msg3 := orderedTestMessage(t, 3, "task1", 2000)
+	other := orderedTestMessage(t, 4, "task2", 0)
+	o.register(msg1)
+	o.register(msg2)
+	o.register(msg3)
+	o.register(other)
+
+	released := make(chan int64, 4)
+	var wg sync.WaitGroup
+	wg.Add(4)
+	waitAndForget := func(msg *sarama.ConsumerMessage) {
+		defer wg.Done()
+		o.wait(ctx, msg)
+		released <- msg.Offset
+		o.forget(msg)
+	}
+	go waitAndForget(msg3)
+	go waitAndForget(msg2)
+	go waitAndForget(other)
+	// other tasks are not held up
+	select {
+	case offset := <-released:
+		is.Equal(offset, int64(4))
+	case <-time.After(500 * time.Millisecond):
+		is.Fail() // timed out
+	}
+	select {
+	case <-released:
+		is.Fail() // should be waiting for msg1
+	case <-time.After(100 * time.Millisecond):
+	}
+	go waitAndForget(msg1)
+	for _, expected := range []int64{1, 2, 3} {
+		select {
+		case offset := <-released:
+			is.Equal(offset, expected)
+		case <-time.After(500 * time.Millisecond):
+			is.Fail() // timed out
+		}
+	}
+	wg.Wait()
+	is.Equal(len(o.tasks), 0)
+}
+
+func TestOutputOrderTimeout(t *testing.T) {
+	is := is.New(t)
+	o := newOutputOrder(100*time.Millisecond, 10, func(args ...interface{}) {})
+	ctx := context.Background()
+	msg1 := orderedTestMessage(t, 1, "task1", 0)
+	msg2 := orderedTestMessage(t, 2, "task1", 1000)
+	o.register(msg1)
+	o.register(msg2)
+	start := time.Now()
+	o.wait(ctx, msg2) // msg1 never completes
+	is.True(time.Since(start) >= 100*time.Millisecond)
+	o.forget(msg2)
+	// msg1 is produced whenever it is ready
+	o.wait(ctx, msg1)
+	o.forget(msg1)
+	is.Equal(len(o.tasks), 0)
+}
+
+func TestOutputOrderMaxBuffered(t *testing.T) {
+	is := is.New(t)
+	o := newOutputOrder(1*time.Minute, 1, func(args ...interface{}) {})
+	ctx := context.Background()
+	msg1 := orderedTestMessage(t, 1, "task1", 0)
+	msg2 := orderedTestMessage(t, 2, "task1", 1000)
+	msg3 := orderedTestMessage(t, 3, "task1", 2000)
+	o.register(msg1)
+	o.register(msg2)
+	o.register(msg3)
+	released := make(chan int64, 3)
+	go func() {
+		o.wait(ctx, msg2)
+		released <- msg2.Offset
+	}()
+	select {
+	case <-released:
+		is.Fail() // should be waiting for msg1
+	case <-time.After(100 * time.Millisecond):
+	}
+	// a second result waiting is too many
+	go func() {
+		o.wait(ctx, msg3)
+		released <- msg3.Offset
+	}()
+	select {
+	case offset := <-released:
+		is.Equal(offset, int64(2))
+	case <-time.After(500 * time.Millisecond):
+		is.Fail() // timed out
+	}
+	// msg3 still waits for msg2 to be produced
+	select {
+	case <-released:
+		is.Fail() // should be waiting for msg2
+	case <-time.After(100 * time.Millisecond):
+	}
+	o.forget(msg2)
+	select {
+	case offset := <-released:
+		is.Equal(offset, int64(3))
+	case <-time.After(500 * time.Millisecond):
+		is.Fail() // timed out
+	}
+}
+
+func TestProcessingChunkOrderedOutput(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Processing.Concurrency = 3
+	engine.Config.Ordering.Enabled = true
+	engine.Config.Ordering.Timeout = 5 * time.Second
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// earlier chunks take longer
+		startOffsetMS, err := strconv.Atoi(r.FormValue("startOffsetMS"))
+		is.NoErr(err)
+		time.Sleep(time.Duration(3000-startOffsetMS) / 10 * time.Millisecond)
+		err = json.NewEncoder(w).Encode(engineOutput{
+			Series: []seriesObject{{Object: object{Label: "something"}}},
+		})
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	chunkUUIDs := []string{"chunk1", "chunk2", "chunk3"}
+	for i, chunkUUID := range chunkUUIDs {
+		inputMessage := processing.MediaChunkMessage{
+			TimestampUTC:  time.Now().Unix(),
+			ChunkUUID:     chunkUUID,
+			Type:          processing.MessageTypeMediaChunk,
+			StartOffsetMS: 1000 * i,
+			EndOffsetMS:   1000 * (i + 1),
+			JobID:         "job1",
+			TDOID:         "tdo1",
+			TaskID:        "task1",
+		}
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: int64(i),
+			Key:    sarama.StringEncoder(inputMessage.TaskID),
+			Value:  processing.NewJSONEncoder(inputMessage),
+		})
+		is.NoErr(err)
+	}
+	for _, chunkUUID := range chunkUUIDs {
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			var result chunkResult
+			err := json.Unmarshal(outputMsg.Value, &result)
+			is.NoErr(err)
+			is.Equal(result.ChunkUUID, chunkUUID)
+		case <-time.After(3 * time.Second):
+			is.Fail() // timed out
+			return
+		}
+	}
+}
+
+func TestProcessingChunkOrderedOutputReleasesSlot(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Processing.Concurrency = 2
+	engine.Config.Ordering.Enabled = true
+	engine.Config.Ordering.Timeout = 5 * time.Second
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	lastStarted := make(chan struct{})
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("startOffsetMS") {
+		case "0":
+			// the first chunk only finishes once the last has started,
+			// which needs the slot of the second chunk (which is
+			// waiting for the first)
+			select {
+			case <-lastStarted:
+			case <-time.After(2 * time.Second):
+				http.Error(w, "last chunk never started", http.StatusBadRequest)
+				return
+			}
+		case "2000":
+			close(lastStarted)
+		}
+		err := json.NewEncoder(w).Encode(engineOutput{
+			Series: []seriesObject{{Object: object{Label: "something"}}},
+		})
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	chunkUUIDs := []string{"chunk1", "chunk2", "chunk3"}
+	for i, chunkUUID := range chunkUUIDs {
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: int64(i),
+			Key:    sarama.StringEncoder("task1"),
+			Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+				ChunkUUID:     chunkUUID,
+				Type:          processing.MessageTypeMediaChunk,
+				StartOffsetMS: 1000 * i,
+				EndOffsetMS:   1000 * (i + 1),
+				TaskID:        "task1",
+			}),
+		})
+		is.NoErr(err)
+	}
+	for _, chunkUUID := range chunkUUIDs {
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			var result chunkResult
+			err := json.Unmarshal(outputMsg.Value, &result)
+			is.NoErr(err)
+			is.Equal(result.ChunkUUID, chunkUUID)
+			is.Equal(result.Status, processing.ChunkStatusSuccess)
+		case <-time.After(4 * time.Second):
+			is.Fail() // timed out
+			return
+		}
+	}
+}
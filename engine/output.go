@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+	"github.com/veritone/realtime/modules/engines/toolkit/vericlient"
+)
+
+// outputAssetContentType is the content type of engine output
+// stored as an asset.
+const outputAssetContentType = "application/json"
+
+// outputAssetRef is the content sent in place of engine output that
+// was too large to send through Kafka.
+type outputAssetRef struct {
+	OutputAsset struct {
+		AssetID     string `json:"assetId"`
+		ContentType string `json:"contentType"`
+		// SizeBytes is the size of the original output.
+		SizeBytes int `json:"sizeBytes"`
+	} `json:"outputAsset"`
+}
+
+// isOutputTooLarge gets whether the engine output content is too
+// large to be sent in the engine output message.
+func (e *Engine) isOutputTooLarge(content string) bool {
+	return e.Config.Output.MaxContentBytes > 0 && len(content) > e.Config.Output.MaxContentBytes
+}
+
+// offloadOutput stores engine output that is too large to send through
+// Kafka as an asset on the chunk's TDO, and returns the content
+// referring to it.
+// If offloading is disabled or fails, an output_too_large error
+// is returned.
+func (e *Engine) offloadOutput(ctx context.Context, mediaChunk processing.MediaChunkMessage, content string) (string, error) {
+	tooLarge := errors.Errorf("engine output is %d bytes (maximum is %d)", len(content), e.Config.Output.MaxContentBytes)
+	if !e.Config.Output.Offload {
+		return "", newChunkError(failureReasonOutputTooLarge, tooLarge)
+	}
+	payload, err := mediaChunk.UnmarshalPayload()
+	if err != nil {
+		return "", newChunkError(failureReasonOutputTooLarge, errors.Wrapf(tooLarge, "unmarshal payload: %v", err))
+	}
+	assetCreate := processing.AssetCreate{
+		AssetType:      "vtn-standard",
+		ContainerTDOID: mediaChunk.TDOID,
+		ContentType:    outputAssetContentType,
+		Name:           mediaChunk.ChunkUUID + ".json",
+		Body:           strings.NewReader(content),
+	}
+	client := vericlient.NewClient(e.graphQLHTTPClient, payload.Token, payload.VeritoneAPIBaseURL+"/v3/graphql")
+	createdAsset, err := assetCreate.Do(ctx, client)
+	if err != nil {
+		return "", newChunkError(failureReasonOutputTooLarge, errors.Wrapf(tooLarge, "create asset: %v", err))
+	}
+	var ref outputAssetRef
+	ref.OutputAsset.AssetID = createdAsset.ID
+	ref.OutputAsset.ContentType = outputAssetContentType
+	ref.OutputAsset.SizeBytes = len(content)
+	b, err := json.Marshal(ref)
+	if err != nil {
+		return "", newChunkError(failureReasonInternalError, errors.Wrap(err, "encode output asset reference"))
+	}
+	e.logDebug("engine output stored as asset", createdAsset.ID, "for chunk", mediaChunk.ChunkUUID)
+	return string(b), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestProcessingChunkOutputTooLarge(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		offload bool
+	}{
+		{name: "offload", offload: true},
+		{name: "fail", offload: false},
+	} {
+		offload := tc.offload
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			engine := NewEngine()
+			engine.Config.Subprocess.Arguments = []string{} // no subprocess
+			engine.Config.Kafka.ChunkTopic = "chunk-topic"
+			engine.Config.Events.PeriodicUpdateDuration = 0
+			engine.Config.Output.MaxContentBytes = 100
+			engine.Config.Output.Offload = offload
+			engine.logDebug = func(args ...interface{}) {}
+			inputPipe := processing.NewPipe()
+			defer inputPipe.Close()
+			outputPipe := processing.NewPipe()
+			defer outputPipe.Close()
+			engine.consumer = inputPipe
+			engine.producer = outputPipe
+			readySrv := newOKServer()
+			defer readySrv.Close()
+			engine.Config.Webhooks.Ready.URL = readySrv.URL
+			processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				err := json.NewEncoder(w).Encode(engineOutput{
+					Series: []seriesObject{{Object: object{Label: strings.Repeat("x", 200)}}},
+				})
+				is.NoErr(err)
+			}))
+			defer processSrv.Close()
+			engine.Config.Webhooks.Process.URL = processSrv.URL
+
+			ctx := context.Background()
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			go func() {
+				err := engine.Run(ctx)
+				is.NoErr(err)
+			}()
+			inputMessage := processing.MediaChunkMessage{
+				TimestampUTC:  time.Now().Unix(),
+				ChunkUUID:     "123",
+				Type:          processing.MessageTypeMediaChunk,
+				StartOffsetMS: 1000,
+				EndOffsetMS:   2000,
+				JobID:         "job1",
+				TDOID:         "tdo1",
+				TaskID:        "task1",
+			}
+			_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+				Offset: 1,
+				Key:    sarama.StringEncoder(inputMessage.TaskID),
+				Value:  processing.NewJSONEncoder(inputMessage),
+			})
+			is.NoErr(err)
+
+			var outputMsg *sarama.ConsumerMessage
+			select {
+			case outputMsg = <-outputPipe.Messages():
+			case <-time.After(1 * time.Second):
+				is.Fail() // timed out
+				return
+			}
+			var result chunkResult
+			err = json.Unmarshal(outputMsg.Value, &result)
+			is.NoErr(err)
+			if !offload {
+				is.Equal(result.Status, processing.ChunkStatusError)
+				is.Equal(result.FailureReason, failureReasonOutputTooLarge)
+				is.True(strings.Contains(result.FailureMsg, "maximum is 100"))
+				return
+			}
+			is.Equal(result.Status, processing.ChunkStatusSuccess)
+			is.True(result.EngineOutput != nil)
+			var ref outputAssetRef
+			err = json.Unmarshal([]byte(result.EngineOutput.Content), &ref)
+			is.NoErr(err)
+			is.True(ref.OutputAsset.AssetID != "")
+			is.Equal(ref.OutputAsset.ContentType, outputAssetContentType)
+			is.True(ref.OutputAsset.SizeBytes > 200)
+		})
+	}
+}
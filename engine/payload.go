@@ -71,3 +71,29 @@ func envPayloadJSON(payloadJSON string) (*Payload, error) {
 // ErrNoPayload is returned by EnvPayload when there is no payload
 // file.
 var ErrNoPayload = errors.New("missing environment variables PAYLOAD_FILE or PAYLOAD_JSON")
+
+// taskOptions are the engine toolkit options that may be set
+// per task in the task payload.
+type taskOptions struct {
+	// ChunkTimeout overrides the maximum time allowed to process
+	// each chunk (e.g. "90s").
+	ChunkTimeout string `json:"chunkTimeout"`
+	// TaskWeight is the relative share of processing for the task
+	// when task fairness is enabled. Defaults to 1.
+	TaskWeight int `json:"taskWeight"`
+}
+
+// taskOptionsFromMessage reads the taskOptions from the task payload
+// of a media chunk message.
+func taskOptionsFromMessage(value []byte) (taskOptions, error) {
+	var msg struct {
+		TaskPayload *taskOptions `json:"taskPayload"`
+	}
+	if err := json.Unmarshal(value, &msg); err != nil {
+		return taskOptions{}, err
+	}
+	if msg.TaskPayload == nil {
+		return taskOptions{}, nil
+	}
+	return *msg.TaskPayload, nil
+}
@@ -78,3 +78,18 @@ func TestNoPayload(t *testing.T) {
 	_, err := EnvPayload()
 	is.Equal(err, ErrNoPayload)
 }
+
+func TestTaskOptionsFromMessage(t *testing.T) {
+	is := is.New(t)
+
+	options, err := taskOptionsFromMessage([]byte(`{"taskPayload":{"chunkTimeout":"90s","other":true}}`))
+	is.NoErr(err)
+	is.Equal(options.ChunkTimeout, "90s")
+
+	options, err = taskOptionsFromMessage([]byte(`{"chunkUUID":"123"}`))
+	is.NoErr(err)
+	is.Equal(options.ChunkTimeout, "")
+
+	_, err = taskOptionsFromMessage([]byte(`not JSON`))
+	is.True(err != nil)
+}
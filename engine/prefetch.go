@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// errPrefetchFull is returned when a chunk is too big to fit in
+// the prefetch cache.
+var errPrefetchFull = errors.New("prefetch cache is full")
+
+// prefetchEntry is a chunk being (or that has been) downloaded.
+type prefetchEntry struct {
+	// done is closed when the download has finished.
+	done chan struct{}
+	path string
+	size int64
+	err  error
+}
+
+// chunkPrefetcher downloads the media for upcoming chunks to local
+// disk while earlier chunks are being processed.
+// The total size of the downloaded media is limited to maxBytes;
+// chunks that don't fit are downloaded when they are processed
+// instead.
+type chunkPrefetcher struct {
+	client *http.Client
+	dir    string
+	// temp is whether dir is a temporary directory, which is
+	// removed when the prefetcher is closed.
+	temp     bool
+	count    int
+	maxBytes int64
+	logDebug func(args ...interface{})
+	// cache is the media cache. If set, media is prefetched
+	// into it instead.
+	cache *mediaCache
+
+	lock    sync.Mutex
+	used    int64
+	entries map[string]*prefetchEntry
+}
+
+// newChunkPrefetcher makes a chunkPrefetcher that reads ahead count
+// messages, and keeps up to maxBytes of media in dir.
+// If dir is empty, a temporary directory is used.
+// Media left in dir by a previous run is removed, since it isn't
+// counted towards maxBytes.
+func newChunkPrefetcher(client *http.Client, count int, dir string, maxBytes int64, logDebug func(args ...interface{})) (*chunkPrefetcher, error) {
+	temp := dir == ""
+	if temp {
+		var err error
+		dir, err = ioutil.TempDir("", "engine-prefetch")
+		if err != nil {
+			return nil, errors.Wrap(err, "make prefetch dir")
+		}
+	} else if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "make prefetch dir")
+	} else if err := removeFiles(dir, isPrefetchFile); err != nil {
+		return nil, errors.Wrap(err, "clean prefetch dir")
+	}
+	return &chunkPrefetcher{
+		client:   client,
+		dir:      dir,
+		temp:     temp,
+		count:    count,
+		maxBytes: maxBytes,
+		logDebug: logDebug,
+		entries:  make(map[string]*prefetchEntry),
+	}, nil
+}
+
+// prefetchKey gets the key for the chunk media.
+func prefetchKey(chunk processing.MediaChunkMessage) string {
+	sum := sha1.Sum([]byte(chunk.ChunkUUID + "\n" + chunk.CacheURI))
+	return hex.EncodeToString(sum[:])
+}
+
+// isPrefetchFile gets whether name is the name of a file written by
+// the prefetcher (see prefetchKey).
+func isPrefetchFile(name string) bool {
+	return isHexDigest(name, sha1.Size)
+}
+
+// readAhead reads up to count messages ahead of in, starting to
+// download the media for each chunk as it goes.
+// The returned channel is closed when in is closed.
+func (p *chunkPrefetcher) readAhead(ctx context.Context, in <-chan *sarama.ConsumerMessage) <-chan *sarama.ConsumerMessage {
+	out := make(chan *sarama.ConsumerMessage, p.count)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-in:
+				if !ok {
+					return
+				}
+				var chunk processing.MediaChunkMessage
+				if err := json.Unmarshal(msg.Value, &chunk); err == nil && chunk.Type == processing.MessageTypeMediaChunk {
+					p.start(ctx, chunk)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case out <- msg:
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// start starts downloading the chunk media in the background.
+func (p *chunkPrefetcher) start(ctx context.Context, chunk processing.MediaChunkMessage) {
+	if chunk.CacheURI == "" {
+		return
+	}
+	if p.cache != nil {
+		go func() {
+			f, err := p.cache.open(ctx, chunk.CacheURI)
+			if err != nil {
+				p.logDebug("WARN", "prefetch:", err)
+				return
+			}
+			f.Close()
+		}()
+		return
+	}
+	key := prefetchKey(chunk)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.entries[key]; ok {
+		return
+	}
+	entry := &prefetchEntry{
+		done: make(chan struct{}),
+		path: filepath.Join(p.dir, key),
+	}
+	p.entries[key] = entry
+	go func() {
+		defer close(entry.done)
+		entry.err = p.download(ctx, chunk.CacheURI, entry)
+		if entry.err != nil && entry.err != errPrefetchFull {
+			p.logDebug("WARN", "prefetch:", entry.err)
+		}
+	}()
+}
+
+// download downloads the media to entry.path, reserving space
+// as it goes.
+func (p *chunkPrefetcher) download(ctx context.Context, uri string, entry *prefetchEntry) error {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("download chunk: %s", resp.Status)
+	}
+	if resp.ContentLength > 0 && !p.reserve(entry, resp.ContentLength) {
+		return errPrefetchFull
+	}
+	f, err := os.Create(entry.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if written+int64(n) > entry.size && !p.reserve(entry, written+int64(n)) {
+				os.Remove(entry.path)
+				return errPrefetchFull
+			}
+			if _, err := f.Write(buf[:n]); err != nil {
+				os.Remove(entry.path)
+				return err
+			}
+			written += int64(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			os.Remove(entry.path)
+			return errors.Wrap(readErr, "download chunk")
+		}
+	}
+	return f.Close()
+}
+
+// reserve grows the space reserved for the entry to size bytes.
+// Returns false if there isn't enough space.
+func (p *chunkPrefetcher) reserve(entry *prefetchEntry, size int64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.maxBytes > 0 && p.used-entry.size+size > p.maxBytes {
+		return false
+	}
+	p.used += size - entry.size
+	entry.size = size
+	return true
+}
+
+// open gets the media for the chunk, from the prefetch cache if it
+// has been prefetched, otherwise by downloading it.
+func (p *chunkPrefetcher) open(ctx context.Context, chunk processing.MediaChunkMessage) (io.ReadCloser, error) {
+	p.lock.Lock()
+	entry := p.entries[prefetchKey(chunk)]
+	p.lock.Unlock()
+	if entry != nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-entry.done:
+		}
+		if entry.err == nil {
+			return os.Open(entry.path)
+		}
+	}
+	return downloadMedia(ctx, p.client, chunk.CacheURI)
+}
+
+// remove deletes the prefetched media for the chunk (if any).
+// The chunk should not be opened again.
+// A nil *chunkPrefetcher has nothing to remove.
+func (p *chunkPrefetcher) remove(chunk processing.MediaChunkMessage) {
+	if p == nil {
+		return
+	}
+	key := prefetchKey(chunk)
+	p.lock.Lock()
+	entry := p.entries[key]
+	delete(p.entries, key)
+	p.lock.Unlock()
+	if entry == nil {
+		return
+	}
+	go func() {
+		// wait for the download to stop before cleaning up
+		<-entry.done
+		os.Remove(entry.path)
+		p.lock.Lock()
+		p.used -= entry.size
+		p.lock.Unlock()
+	}()
+}
+
+// Close removes the prefetch directory if it is a temporary one.
+// A nil *chunkPrefetcher has nothing to close.
+func (p *chunkPrefetcher) Close() error {
+	if p == nil || !p.temp {
+		return nil
+	}
+	return os.RemoveAll(p.dir)
+}
+
+// formField is a field in a multipart form.
+type formField struct {
+	name, value string
+}
+
+// chunkFields gets the fields describing the chunk that are sent to
+// the Process webhook.
+// They are taken from the form built by
+// processing.NewRequestFromMediaChunk (without downloading the media),
+// so they are always the same as the fields of an ordinary request.
+// The media itself is left out, for the caller to send.
+func (e *Engine) chunkFields(chunk processing.MediaChunkMessage) ([]formField, error) {
+	req, err := processing.NewRequestFromMediaChunk(e.webhookClient, e.Config.Webhooks.Process.URL,
+		chunk, true, "", "", "", 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "new request")
+	}
+	defer req.Body.Close()
+	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, errors.Wrap(err, "parse request content type")
+	}
+	var fields []formField
+	r := multipart.NewReader(req.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read request form")
+		}
+		if part.FileName() != "" {
+			// the media
+			continue
+		}
+		value, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, errors.Wrap(err, "read request form")
+		}
+		fields = append(fields, formField{part.FormName(), string(value)})
+	}
+}
+
+// taskPayloadString gets a string field from the task payload of
+// the chunk, or "" if it is missing.
+func taskPayloadString(chunk processing.MediaChunkMessage, key string) string {
+	s, _ := chunk.TaskPayload[key].(string)
+	return s
+}
+
+// newStreamingRequest makes a request to the Process webhook for the
+// chunk. The media is streamed into the request body rather than
+// buffered in memory, and measured against hold as it goes.
+func (e *Engine) newStreamingRequest(ctx context.Context, chunk processing.MediaChunkMessage, hold *memoryHold) (*http.Request, error) {
+	fields, err := e.chunkFields(chunk)
+	if err != nil {
+		return nil, newChunkError(failureReasonInternalError, err)
+	}
+	var media io.ReadCloser
+	if e.sendsChunkMedia(chunk) {
+		media, err = e.openMedia(ctx, chunk)
+		if err != nil {
+			return nil, newChunkError(failureReasonDownloadFailed, errors.Wrap(err, "download chunk"))
+		}
+	}
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+	go func() {
+		if media != nil {
+			defer media.Close()
+		}
+		for _, field := range fields {
+			if err := w.WriteField(field.name, field.value); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if media != nil {
+			part, err := w.CreateFormFile("chunk", chunk.ChunkUUID)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.Copy(part, hold.reader(media)); err != nil {
+				pw.CloseWithError(errors.Wrap(err, "stream chunk"))
+				return
+			}
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	req, err := http.NewRequest(http.MethodPost, e.Config.Webhooks.Process.URL, pr)
+	if err != nil {
+		pr.Close()
+		return nil, newChunkError(failureReasonInternalError, errors.Wrap(err, "new request"))
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// newMediaServer makes a server that serves content, and counts
+// the requests.
+func newMediaServer(content string, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.Write([]byte(content))
+	}))
+}
+
+func TestChunkPrefetcher(t *testing.T) {
+	is := is.New(t)
+	var requests int32
+	mediaSrv := newMediaServer("media content", &requests)
+	defer mediaSrv.Close()
+	dir, err := ioutil.TempDir("", "prefetch-test")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	p, err := newChunkPrefetcher(http.DefaultClient, 2, dir, 0, func(args ...interface{}) {})
+	is.NoErr(err)
+	ctx := context.Background()
+	chunk := processing.MediaChunkMessage{ChunkUUID: "chunk1", CacheURI: mediaSrv.URL}
+	p.start(ctx, chunk)
+	p.start(ctx, chunk) // only downloaded once
+
+	media, err := p.open(ctx, chunk)
+	is.NoErr(err)
+	b, err := ioutil.ReadAll(media)
+	is.NoErr(err)
+	media.Close()
+	is.Equal(string(b), "media content")
+	// a retry reads the same file
+	media, err = p.open(ctx, chunk)
+	is.NoErr(err)
+	media.Close()
+	is.Equal(atomic.LoadInt32(&requests), int32(1))
+	files, err := ioutil.ReadDir(dir)
+	is.NoErr(err)
+	is.Equal(len(files), 1)
+
+	p.remove(chunk)
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		files, err := ioutil.ReadDir(dir)
+		is.NoErr(err)
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			is.Fail() // file was not removed
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChunkPrefetcherFull(t *testing.T) {
+	is := is.New(t)
+	var requests int32
+	mediaSrv := newMediaServer("media content", &requests)
+	defer mediaSrv.Close()
+	dir, err := ioutil.TempDir("", "prefetch-test")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	p, err := newChunkPrefetcher(http.DefaultClient, 2, dir, 5, func(args ...interface{}) {})
+	is.NoErr(err)
+	ctx := context.Background()
+	chunk := processing.MediaChunkMessage{ChunkUUID: "chunk1", CacheURI: mediaSrv.URL}
+	p.start(ctx, chunk)
+	// too big to prefetch, so it is downloaded again
+	media, err := p.open(ctx, chunk)
+	is.NoErr(err)
+	b, err := ioutil.ReadAll(media)
+	is.NoErr(err)
+	media.Close()
+	is.Equal(string(b), "media content")
+	is.Equal(atomic.LoadInt32(&requests), int32(2))
+	p.remove(chunk)
+}
+
+func TestProcessingChunkPrefetch(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Processing.DisableChunkDownload = false
+	engine.Config.Prefetch.Count = 2
+	dir, err := ioutil.TempDir("", "prefetch-test")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	engine.Config.Prefetch.Dir = dir
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	var requests int32
+	mediaSrv := newMediaServer("media content", &requests)
+	defer mediaSrv.Close()
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.Equal(r.FormValue("chunkUUID"), "chunk1")
+		f, _, err := r.FormFile("chunk")
+		is.NoErr(err)
+		defer f.Close()
+		b, err := ioutil.ReadAll(f)
+		is.NoErr(err)
+		err = json.NewEncoder(w).Encode(engineOutput{
+			Series: []seriesObject{{Object: object{Label: string(b)}}},
+		})
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	_, _, err = inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder("task1"),
+		Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+			Type:      processing.MessageTypeMediaChunk,
+			TaskID:    "task1",
+			ChunkUUID: "chunk1",
+			CacheURI:  mediaSrv.URL,
+		}),
+	})
+	is.NoErr(err)
+	select {
+	case outputMsg := <-outputPipe.Messages():
+		var result chunkResult
+		err := json.Unmarshal(outputMsg.Value, &result)
+		is.NoErr(err)
+		is.Equal(result.Status, processing.ChunkStatusSuccess)
+		var output engineOutput
+		err = json.Unmarshal([]byte(result.EngineOutput.Content), &output)
+		is.NoErr(err)
+		is.Equal(output.Series[0].Object.Label, "media content")
+	case <-time.After(2 * time.Second):
+		is.Fail() // timed out
+	}
+	is.Equal(atomic.LoadInt32(&requests), int32(1))
+}
+
+func TestChunkPrefetcherClose(t *testing.T) {
+	is := is.New(t)
+	p, err := newChunkPrefetcher(http.DefaultClient, 2, "", 0, func(args ...interface{}) {})
+	is.NoErr(err)
+	_, err = os.Stat(p.dir)
+	is.NoErr(err)
+	is.NoErr(p.Close())
+	_, err = os.Stat(p.dir)
+	is.True(os.IsNotExist(err)) // temporary dir was removed
+}
+
+// TestChunkPrefetcherLeftovers ensures media left in a configured
+// prefetch directory by a previous run is removed.
+func TestChunkPrefetcherLeftovers(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "prefetch-test")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	leftover := prefetchKey(processing.MediaChunkMessage{ChunkUUID: "chunk1"})
+	for _, name := range []string{leftover, "notes.txt"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte("test"), 0644)
+		is.NoErr(err)
+	}
+	p, err := newChunkPrefetcher(http.DefaultClient, 2, dir, 0, func(args ...interface{}) {})
+	is.NoErr(err)
+	defer p.Close()
+	_, err = os.Stat(filepath.Join(dir, leftover))
+	is.True(os.IsNotExist(err)) // leftover should be removed
+	_, err = os.Stat(filepath.Join(dir, "notes.txt"))
+	is.NoErr(err) // other files are left alone
+}
+
+// TestStreamingRequestFields ensures streaming requests describe the
+// chunk in the same way as ordinary requests.
+func TestStreamingRequestFields(t *testing.T) {
+	is := is.New(t)
+	engine := NewEngine()
+	engine.Config.Webhooks.Process.URL = "http://localhost/process"
+	chunk := processing.MediaChunkMessage{
+		Type:          processing.MessageTypeMediaChunk,
+		TaskID:        "task1",
+		ChunkUUID:     "chunk1",
+		MIMEType:      "image/png",
+		StartOffsetMS: 1000,
+		EndOffsetMS:   2000,
+		Width:         640,
+		Height:        480,
+		TaskPayload:   map[string]interface{}{"libraryId": "library1", "token": "token1"},
+	}
+	want, err := processing.NewRequestFromMediaChunk(http.DefaultClient, engine.Config.Webhooks.Process.URL, chunk, true, "", "", "", 0)
+	is.NoErr(err)
+	is.NoErr(want.ParseMultipartForm(1 << 20))
+	req, err := engine.newStreamingRequest(context.Background(), chunk, nil)
+	is.NoErr(err)
+	is.NoErr(req.ParseMultipartForm(1 << 20))
+	is.Equal(req.MultipartForm.Value, want.MultipartForm.Value)
+	is.Equal(req.FormValue("libraryId"), "library1")
+}
+
+func TestStreamingRequestInlineContent(t *testing.T) {
+	is := is.New(t)
+	engine := NewEngine()
+	engine.Config.Webhooks.Process.URL = "http://localhost/process"
+	chunk := processing.MediaChunkMessage{
+		Type:      processing.MessageTypeMediaChunk,
+		TaskID:    "task1",
+		ChunkUUID: "chunk1",
+		Content:   "inline content",
+	}
+	req, err := engine.newStreamingRequest(context.Background(), chunk, nil)
+	is.NoErr(err)
+	is.NoErr(req.ParseMultipartForm(1 << 20))
+	is.Equal(req.FormValue("chunkUUID"), "chunk1")
+	f, _, err := req.FormFile("chunk")
+	is.NoErr(err)
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	is.NoErr(err)
+	is.Equal(string(b), "inline content")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// retryPolicy decides if and when a failed Process webhook call
+// for a single chunk is retried.
+//
+// Responses with a throttle status code (429 and 503) respect the
+// Retry-After header and are counted against a separate budget to
+// other failures, which use a double-time backoff.
+type retryPolicy struct {
+	// backoff is the delay before the next ordinary retry.
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	retries    int
+	maxRetries int
+
+	throttles    int
+	maxThrottles int
+	maxThrottle  time.Duration
+
+	retryable    map[int]bool
+	nonRetryable map[int]bool
+}
+
+// newRetryPolicy makes a retryPolicy for a chunk from the configuration.
+func (e *Engine) newRetryPolicy() *retryPolicy {
+	p := &retryPolicy{
+		backoff:      e.Config.Webhooks.Backoff.InitialBackoffDuration,
+		maxBackoff:   e.Config.Webhooks.Backoff.MaxBackoffDuration,
+		maxRetries:   e.Config.Webhooks.Backoff.MaxRetries,
+		maxThrottles: e.Config.Retry.MaxThrottledRetries,
+		maxThrottle:  e.Config.Retry.MaxThrottleDuration,
+		retryable:    make(map[int]bool),
+		nonRetryable: make(map[int]bool),
+	}
+	for _, code := range e.Config.Retry.RetryableStatusCodes {
+		p.retryable[code] = true
+	}
+	for _, code := range e.Config.Retry.NonRetryableStatusCodes {
+		p.nonRetryable[code] = true
+	}
+	return p
+}
+
+// next gets how long to wait before retrying after err, and whether
+// to retry at all. throttled is true if the engine asked the toolkit to
+// back off.
+func (p *retryPolicy) next(err error) (delay time.Duration, throttled, retry bool) {
+	var statusCode int
+	var retryAfter string
+	if ce, ok := causeChunkError(err); ok {
+		if ce.reason == failureReasonTimeout || ce.reason == failureReasonOutputTooLarge {
+			return 0, false, false
+		}
+		statusCode, retryAfter = ce.statusCode, ce.retryAfter
+	}
+	if isThrottleStatus(statusCode) && !p.nonRetryable[statusCode] {
+		if p.throttles >= p.maxThrottles {
+			return 0, true, false
+		}
+		p.throttles++
+		delay = parseRetryAfter(retryAfter, time.Now())
+		if delay <= 0 {
+			delay = p.nextBackoff()
+		}
+		if p.maxThrottle > 0 && delay > p.maxThrottle {
+			delay = p.maxThrottle
+		}
+		return delay, true, true
+	}
+	if statusCode != 0 {
+		if p.nonRetryable[statusCode] {
+			return 0, false, false
+		}
+		if len(p.retryable) > 0 && !p.retryable[statusCode] {
+			return 0, false, false
+		}
+	}
+	if p.retries >= p.maxRetries {
+		return 0, false, false
+	}
+	p.retries++
+	return p.nextBackoff(), false, true
+}
+
+// nextBackoff gets the current backoff and doubles it for next time.
+func (p *retryPolicy) nextBackoff() time.Duration {
+	d := p.backoff
+	p.backoff *= 2
+	if p.backoff > p.maxBackoff {
+		p.backoff = p.maxBackoff
+	}
+	return d
+}
+
+// isThrottleStatus gets whether the status code means the engine
+// is busy and wants the toolkit to back off.
+func isThrottleStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which
+// is either a number of seconds or an HTTP date.
+// Returns zero if the value is missing or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0
+	}
+	if d := t.Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// parseStatusCodes parses a comma separated list of HTTP status codes.
+func parseStatusCodes(s string) ([]int, error) {
+	var codes []int
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, errors.Wrapf(err, "status code %q", field)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// throttle temporarily lowers the effective concurrency for d.
+// With adaptive concurrency the limit is lowered (see backOff), otherwise
+// half of the processing semaphore slots are held until d has passed
+// or ctx is cancelled.
+// Only one throttle is in effect at a time.
+func (e *Engine) throttle(ctx context.Context, d time.Duration) {
+	if e.concurrency != nil {
+		e.concurrency.backOff(d)
+		return
+	}
+	if e.processingSemaphore == nil {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&e.throttling, 0, 1) {
+		return
+	}
+	e.logDebug("engine asked to back off, lowering concurrency for", d)
+	go func() {
+		defer atomic.StoreInt32(&e.throttling, 0)
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		var held int
+		defer func() {
+			for ; held > 0; held-- {
+				<-e.processingSemaphore
+			}
+		}()
+		for held < cap(e.processingSemaphore)/2 {
+			select {
+			case e.processingSemaphore <- struct{}{}:
+				held++
+			case <-timer.C:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2019, 1, 1, 12, 0, 0, 0, time.UTC)
+	is.Equal(parseRetryAfter("", now), time.Duration(0))
+	is.Equal(parseRetryAfter("3", now), 3*time.Second)
+	is.Equal(parseRetryAfter(" 10 ", now), 10*time.Second)
+	is.Equal(parseRetryAfter("-1", now), time.Duration(0))
+	is.Equal(parseRetryAfter("soon", now), time.Duration(0))
+	is.Equal(parseRetryAfter("Tue, 01 Jan 2019 12:00:30 GMT", now), 30*time.Second)
+	is.Equal(parseRetryAfter("Tue, 01 Jan 2019 11:00:00 GMT", now), time.Duration(0))
+}
+
+func TestParseStatusCodes(t *testing.T) {
+	is := is.New(t)
+	codes, err := parseStatusCodes("400, 422,,500")
+	is.NoErr(err)
+	is.Equal(codes, []int{400, 422, 500})
+	_, err = parseStatusCodes("400,bad")
+	is.True(err != nil)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	is := is.New(t)
+	engine := NewEngine()
+	engine.Config.Webhooks.Backoff.InitialBackoffDuration = 100 * time.Millisecond
+	engine.Config.Webhooks.Backoff.MaxBackoffDuration = 300 * time.Millisecond
+	engine.Config.Webhooks.Backoff.MaxRetries = 3
+	engine.Config.Retry.RetryableStatusCodes = nil
+	engine.Config.Retry.NonRetryableStatusCodes = []int{400}
+	engine.Config.Retry.MaxThrottledRetries = 2
+	engine.Config.Retry.MaxThrottleDuration = 5 * time.Second
+	webhookError := func(statusCode int, retryAfter string) error {
+		header := make(http.Header)
+		header.Set("Retry-After", retryAfter)
+		return errors.Wrap(newWebhookError(statusCode, header, nil), "process")
+	}
+
+	p := engine.newRetryPolicy()
+	delay, throttled, retry := p.next(webhookError(http.StatusBadRequest, ""))
+	is.Equal(retry, false) // 400 is not retried
+	is.Equal(throttled, false)
+
+	p = engine.newRetryPolicy()
+	delay, throttled, retry = p.next(webhookError(http.StatusTooManyRequests, "2"))
+	is.True(retry)
+	is.True(throttled)
+	is.Equal(delay, 2*time.Second)
+	delay, _, retry = p.next(webhookError(http.StatusServiceUnavailable, "60"))
+	is.True(retry)
+	is.Equal(delay, 5*time.Second) // capped at MaxThrottleDuration
+	_, _, retry = p.next(webhookError(http.StatusTooManyRequests, "1"))
+	is.Equal(retry, false) // throttle budget exhausted
+	// throttles do not use up the ordinary retries
+	delay, throttled, retry = p.next(webhookError(http.StatusInternalServerError, ""))
+	is.True(retry)
+	is.Equal(throttled, false)
+	is.Equal(delay, 100*time.Millisecond)
+	delay, _, _ = p.next(webhookError(http.StatusInternalServerError, ""))
+	is.Equal(delay, 200*time.Millisecond)
+	delay, _, _ = p.next(webhookError(http.StatusInternalServerError, ""))
+	is.Equal(delay, 300*time.Millisecond) // capped at MaxBackoffDuration
+	_, _, retry = p.next(webhookError(http.StatusInternalServerError, ""))
+	is.Equal(retry, false) // retries exhausted
+
+	engine.Config.Retry.RetryableStatusCodes = []int{502}
+	p = engine.newRetryPolicy()
+	_, _, retry = p.next(webhookError(http.StatusInternalServerError, ""))
+	is.Equal(retry, false) // not in the retryable list
+	_, _, retry = p.next(webhookError(http.StatusBadGateway, ""))
+	is.True(retry)
+	_, _, retry = p.next(errors.New("connection refused"))
+	is.True(retry) // errors without a response are always retryable
+
+	p = engine.newRetryPolicy()
+	_, _, retry = p.next(newChunkError(failureReasonTimeout, context.DeadlineExceeded))
+	is.Equal(retry, false) // timeouts are never retried
+}
+
+// TestProcessingChunkThrottled ensures a 429 response is retried after
+// the Retry-After duration without using up the ordinary retries.
+// TestThrottleCancelled ensures the slots held while throttling are
+// given back when the engine shuts down.
+func TestThrottleCancelled(t *testing.T) {
+	is := is.New(t)
+	engine := NewEngine()
+	engine.logDebug = func(args ...interface{}) {}
+	engine.processingSemaphore = make(chan struct{}, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	engine.throttle(ctx, time.Hour)
+	for len(engine.processingSemaphore) < 2 {
+		time.Sleep(10 * time.Millisecond) // wait for the slots to be held
+	}
+	cancel()
+	deadline := time.Now().Add(1 * time.Second)
+	for len(engine.processingSemaphore) > 0 || atomic.LoadInt32(&engine.throttling) != 0 {
+		if time.Now().After(deadline) {
+			is.Fail() // timed out waiting for slots to be released
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcessingChunkThrottled(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Webhooks.Backoff.MaxRetries = 0
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	var calls int32
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "busy", http.StatusTooManyRequests)
+			return
+		}
+		err := json.NewEncoder(w).Encode(engineOutput{
+			Series: []seriesObject{{Object: object{Label: "something"}}},
+		})
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	inputMessage := processing.MediaChunkMessage{
+		TimestampUTC:  time.Now().Unix(),
+		ChunkUUID:     "123",
+		Type:          processing.MessageTypeMediaChunk,
+		StartOffsetMS: 1000,
+		EndOffsetMS:   2000,
+		JobID:         "job1",
+		TDOID:         "tdo1",
+		TaskID:        "task1",
+	}
+	start := time.Now()
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder(inputMessage.TaskID),
+		Value:  processing.NewJSONEncoder(inputMessage),
+	})
+	is.NoErr(err)
+
+	var outputMsg *sarama.ConsumerMessage
+	select {
+	case outputMsg = <-outputPipe.Messages():
+	case <-time.After(3 * time.Second):
+		is.Fail() // timed out
+		return
+	}
+	is.True(time.Since(start) >= 1*time.Second) // waited for Retry-After
+	var result chunkResult
+	err = json.Unmarshal(outputMsg.Value, &result)
+	is.NoErr(err)
+	is.Equal(result.Status, processing.ChunkStatusSuccess)
+	is.Equal(result.Attempts, 2)
+	is.Equal(atomic.LoadInt32(&calls), int32(2))
+}
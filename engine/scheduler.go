@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// taskScheduler queues consumed messages and releases them to be
+// processed fairly between tasks, so one large task cannot starve
+// the others.
+// Tasks get a share of the processing slots in proportion to their
+// weight (stride scheduling), which is the taskWeight in the task
+// payload, and each task may be capped to a maximum number of chunks
+// in flight.
+// Within a task, messages are released in the order they were
+// consumed.
+type taskScheduler struct {
+	// maxPerTask is the maximum number of messages in flight for
+	// each task. Zero means no limit.
+	maxPerTask int
+	// space limits the number of queued messages.
+	space chan struct{}
+	// ready is signalled when a message may be able to be released.
+	ready chan struct{}
+
+	lock sync.Mutex
+	// tasks holds the queue for each task with queued or
+	// in-flight messages.
+	tasks map[string]*taskQueue
+	// pass is the pass of the last released task; new tasks
+	// start here.
+	pass float64
+	// seq breaks ties between tasks with the same pass, in
+	// favour of the task seen first.
+	seq    int
+	closed bool
+}
+
+// taskQueue is the queue of messages for a task.
+type taskQueue struct {
+	msgs     []*sarama.ConsumerMessage
+	inFlight int
+	// pass increases by 1/weight each time a message is released,
+	// and the task with the lowest pass goes next.
+	pass   float64
+	stride float64
+	seq    int
+}
+
+// newTaskScheduler makes a new taskScheduler that holds at most
+// maxQueued messages.
+func newTaskScheduler(maxPerTask, maxQueued int) *taskScheduler {
+	if maxQueued < 1 {
+		maxQueued = 1
+	}
+	return &taskScheduler{
+		maxPerTask: maxPerTask,
+		space:      make(chan struct{}, maxQueued),
+		ready:      make(chan struct{}, 1),
+		tasks:      make(map[string]*taskQueue),
+	}
+}
+
+// push queues the message, blocking while the queue is full.
+func (s *taskScheduler) push(ctx context.Context, msg *sarama.ConsumerMessage) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s.space <- struct{}{}:
+	}
+	var typeCheck struct {
+		TaskID      string       `json:"taskId"`
+		TaskPayload *taskOptions `json:"taskPayload"`
+	}
+	// messages that can't be parsed are queued with the empty TaskID,
+	// and processMessage reports the error.
+	_ = json.Unmarshal(msg.Value, &typeCheck)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.tasks[typeCheck.TaskID]
+	if q == nil {
+		// the weight is taken from the first chunk of the task
+		weight := 1
+		if typeCheck.TaskPayload != nil && typeCheck.TaskPayload.TaskWeight > 0 {
+			weight = typeCheck.TaskPayload.TaskWeight
+		}
+		s.seq++
+		q = &taskQueue{
+			pass:   s.pass,
+			stride: 1 / float64(weight),
+			seq:    s.seq,
+		}
+		s.tasks[typeCheck.TaskID] = q
+	}
+	q.msgs = append(q.msgs, msg)
+	s.signal()
+	return nil
+}
+
+// next waits for the next message to process.
+// Returns false if the context is done, or the scheduler is
+// closed and empty.
+// The returned func must be called when the message has been
+// processed.
+func (s *taskScheduler) next(ctx context.Context) (*sarama.ConsumerMessage, func(), bool) {
+	for {
+		msg, done, ok, closed := s.take()
+		if ok {
+			<-s.space
+			return msg, done, true
+		}
+		if closed {
+			return nil, nil, false
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, false
+		case <-s.ready:
+		}
+	}
+}
+
+// take removes the next message that may be released, if any.
+func (s *taskScheduler) take() (msg *sarama.ConsumerMessage, done func(), ok, closed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var next *taskQueue
+	var taskID string
+	for id, q := range s.tasks {
+		if len(q.msgs) == 0 {
+			continue
+		}
+		if s.maxPerTask > 0 && q.inFlight >= s.maxPerTask {
+			continue
+		}
+		if next == nil || q.pass < next.pass || (q.pass == next.pass && q.seq < next.seq) {
+			next, taskID = q, id
+		}
+	}
+	if next == nil {
+		return nil, nil, false, s.closed && s.queued() == 0
+	}
+	msg = next.msgs[0]
+	next.msgs = next.msgs[1:]
+	next.inFlight++
+	s.pass = next.pass
+	next.pass += next.stride
+	return msg, func() { s.done(taskID) }, true, false
+}
+
+// done is called when a message of the task has been processed.
+func (s *taskScheduler) done(taskID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	q := s.tasks[taskID]
+	if q == nil {
+		return
+	}
+	q.inFlight--
+	if q.inFlight <= 0 && len(q.msgs) == 0 {
+		delete(s.tasks, taskID)
+	}
+	s.signal()
+}
+
+// close stops accepting messages. next returns false once the
+// queued messages have been released.
+// A nil *taskScheduler may be closed.
+func (s *taskScheduler) close() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	s.signal()
+}
+
+// queueDepths gets the number of queued messages for each task.
+// A nil *taskScheduler has no queues.
+func (s *taskScheduler) queueDepths() map[string]int {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	depths := make(map[string]int)
+	for id, q := range s.tasks {
+		if len(q.msgs) > 0 {
+			depths[id] = len(q.msgs)
+		}
+	}
+	return depths
+}
+
+// queued gets the total number of queued messages.
+// The lock must be held.
+func (s *taskScheduler) queued() int {
+	n := 0
+	for _, q := range s.tasks {
+		n += len(q.msgs)
+	}
+	return n
+}
+
+// signal wakes up next without blocking.
+func (s *taskScheduler) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
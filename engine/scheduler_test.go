@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// nextTaskID gets the TaskID of the next message from the scheduler.
+func nextTaskID(t *testing.T, s *taskScheduler) (string, func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	msg, done, ok := s.next(ctx)
+	if !ok {
+		t.Fatal("no message")
+	}
+	var mediaChunk processing.MediaChunkMessage
+	if err := json.Unmarshal(msg.Value, &mediaChunk); err != nil {
+		t.Fatal(err)
+	}
+	return mediaChunk.TaskID, done
+}
+
+func TestTaskScheduler(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	s := newTaskScheduler(0, 10)
+	for i := 0; i < 4; i++ {
+		is.NoErr(s.push(ctx, orderedTestMessage(t, int64(i), "big", i*1000)))
+	}
+	is.NoErr(s.push(ctx, orderedTestMessage(t, 4, "small", 0)))
+	is.NoErr(s.push(ctx, orderedTestMessage(t, 5, "small", 1000)))
+	is.Equal(s.queueDepths(), map[string]int{"big": 4, "small": 2})
+	var order []string
+	for i := 0; i < 6; i++ {
+		taskID, done := nextTaskID(t, s)
+		order = append(order, taskID)
+		done()
+	}
+	is.Equal(order, []string{"big", "small", "big", "small", "big", "big"})
+	is.Equal(len(s.tasks), 0)
+}
+
+func TestTaskSchedulerMaxPerTask(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	s := newTaskScheduler(1, 10)
+	is.NoErr(s.push(ctx, orderedTestMessage(t, 1, "task1", 0)))
+	is.NoErr(s.push(ctx, orderedTestMessage(t, 2, "task1", 1000)))
+	taskID, done := nextTaskID(t, s)
+	is.Equal(taskID, "task1")
+	// the second chunk waits for the first
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, _, ok := s.next(shortCtx)
+	is.Equal(ok, false)
+	done()
+	taskID, done = nextTaskID(t, s)
+	is.Equal(taskID, "task1")
+	done()
+}
+
+func TestTaskSchedulerWeights(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	s := newTaskScheduler(0, 10)
+	for i := 0; i < 3; i++ {
+		is.NoErr(s.push(ctx, orderedTestMessage(t, int64(i), "light", i*1000)))
+	}
+	for i := 0; i < 4; i++ {
+		value, err := json.Marshal(map[string]interface{}{
+			"type":        processing.MessageTypeMediaChunk,
+			"taskId":      "heavy",
+			"taskPayload": map[string]interface{}{"taskWeight": 2},
+		})
+		is.NoErr(err)
+		is.NoErr(s.push(ctx, &sarama.ConsumerMessage{Offset: int64(3 + i), Value: value}))
+	}
+	var order []string
+	for i := 0; i < 6; i++ {
+		taskID, done := nextTaskID(t, s)
+		order = append(order, taskID)
+		defer done()
+	}
+	is.Equal(order, []string{"light", "heavy", "heavy", "light", "heavy", "heavy"})
+}
+
+func TestTaskSchedulerClose(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	s := newTaskScheduler(0, 10)
+	is.NoErr(s.push(ctx, orderedTestMessage(t, 1, "task1", 0)))
+	s.close()
+	// queued messages are still released
+	msg, done, ok := s.next(ctx)
+	is.True(ok)
+	is.Equal(msg.Offset, int64(1))
+	done()
+	// closed and empty
+	_, _, ok = s.next(ctx)
+	is.Equal(ok, false)
+}
+
+func TestTaskSchedulerMaxQueued(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+	s := newTaskScheduler(0, 1)
+	is.NoErr(s.push(ctx, orderedTestMessage(t, 1, "task1", 0)))
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	err := s.push(shortCtx, orderedTestMessage(t, 2, "task1", 1000))
+	is.Equal(err, context.DeadlineExceeded) // queue is full
+}
+
+func TestProcessingChunkFairness(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Processing.Concurrency = 1
+	engine.Config.Fairness.Enabled = true
+	engine.Config.Fairness.MaxQueued = 10
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	// the first request waits until everything has been consumed
+	unblock := make(chan struct{})
+	processed := make(chan string, 10)
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		startOffsetMS := r.FormValue("startOffsetMS")
+		if startOffsetMS == "0" {
+			<-unblock
+		}
+		processed <- startOffsetMS
+		err := json.NewEncoder(w).Encode(engineOutput{})
+		is.NoErr(err)
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	// chunks are identified by their offset
+	chunks := []struct {
+		taskID        string
+		startOffsetMS int
+	}{
+		{"big", 0},
+		{"big", 1000},
+		{"big", 2000},
+		{"small", 5000},
+	}
+	for i, chunk := range chunks {
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: int64(i),
+			Key:    sarama.StringEncoder(chunk.taskID),
+			Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+				Type:          processing.MessageTypeMediaChunk,
+				TaskID:        chunk.taskID,
+				ChunkUUID:     strconv.Itoa(i),
+				StartOffsetMS: chunk.startOffsetMS,
+				EndOffsetMS:   chunk.startOffsetMS + 1000,
+			}),
+		})
+		is.NoErr(err)
+	}
+	// wait for everything to be queued
+	deadline := time.Now().Add(1 * time.Second)
+	for engine.scheduler.queueDepths()["small"] == 0 {
+		if time.Now().After(deadline) {
+			is.Fail() // timed out
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(unblock)
+	var order []string
+	for range chunks {
+		select {
+		case startOffsetMS := <-processed:
+			order = append(order, startOffsetMS)
+		case <-time.After(2 * time.Second):
+			is.Fail() // timed out
+			return
+		}
+	}
+	// the small task doesn't wait for the whole big task
+	is.Equal(order, []string{"0", "5000", "1000", "2000"})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/xdg/scram"
+)
+
+// scramClient adapts an xdg/scram client conversation to the
+// sarama.SCRAMClient interface, for SASL/SCRAM (RFC 5802).
+type scramClient struct {
+	hash scram.HashGeneratorFcn
+
+	conversation *scram.ClientConversation
+}
+
+// Begin starts a new conversation.
+func (c *scramClient) Begin(username, password, authzID string) error {
+	client, err := c.hash.NewClient(username, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.conversation = client.NewConversation()
+	return nil
+}
+
+// Step gets the response to the server challenge.
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.conversation.Step(challenge)
+}
+
+// Done gets whether the conversation is complete.
+func (c *scramClient) Done() bool {
+	return c.conversation.Done()
+}
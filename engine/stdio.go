@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os/exec"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/veritone/engine-toolkit/engine/enginepb"
+)
+
+// Request types for the stdio protocol.
+const (
+	stdioRequestReady    = "ready"
+	stdioRequestProcess  = "process"
+	stdioRequestFinalize = "finalize"
+)
+
+// errStdioClosed is returned when the subprocess closes its stdout,
+// usually because it has exited.
+var errStdioClosed = errors.New("subprocess closed stdout")
+
+// stdioRequest is a request written to the subprocess's stdin as a
+// single line of JSON.
+// The fields for process and finalize requests are only included
+// for those types.
+type stdioRequest struct {
+	Type string `json:"type"`
+	// ID is repeated in the response.
+	ID int64 `json:"id"`
+	*stdioProcessRequest
+	*stdioFinalizeRequest
+}
+
+// stdioProcessRequest holds the fields of a process request, which
+// are named like the Process webhook form fields.
+type stdioProcessRequest struct {
+	ChunkUUID            string          `json:"chunkUUID"`
+	ChunkMimeType        string          `json:"chunkMimeType"`
+	StartOffsetMS        int32           `json:"startOffsetMS"`
+	EndOffsetMS          int32           `json:"endOffsetMS"`
+	Width                int32           `json:"width"`
+	Height               int32           `json:"height"`
+	LibraryID            string          `json:"libraryId"`
+	LibraryEngineModelID string          `json:"libraryEngineModelId"`
+	CacheURI             string          `json:"cacheURI"`
+	VeritoneAPIBaseURL   string          `json:"veritoneApiBaseUrl"`
+	Token                string          `json:"token"`
+	Payload              json.RawMessage `json:"payload,omitempty"`
+	// Chunk is the chunk media, which is base64 encoded.
+	Chunk []byte `json:"chunk,omitempty"`
+}
+
+// stdioFinalizeRequest holds the fields of a finalize request, which
+// are named like the Finalize webhook form fields.
+type stdioFinalizeRequest struct {
+	TaskID string `json:"taskId"`
+	JobID  string `json:"jobId"`
+	TDOID  string `json:"tdoId"`
+}
+
+// stdioResponse is a response the subprocess writes to stdout as a
+// single line of JSON.
+type stdioResponse struct {
+	// ID is the ID of the request.
+	ID int64 `json:"id"`
+	// Ready is whether the engine is ready, for ready requests.
+	Ready bool `json:"ready"`
+	// Ignored is whether the engine ignored the chunk, for process
+	// requests.
+	Ignored bool `json:"ignored"`
+	// Output is the engine output.
+	Output json.RawMessage `json:"output"`
+	// Error is the error message if the request failed.
+	Error string `json:"error"`
+	// StatusCode is the equivalent HTTP status code for the error,
+	// which decides whether it is retried. Defaults to 500.
+	StatusCode int `json:"statusCode"`
+}
+
+// stdioEngine calls the engine over the subprocess's stdin and
+// stdout instead of the webhooks.
+// Requests are sent in the order they are made, but responses may
+// come back in any order.
+type stdioEngine struct {
+	cmd *exec.Cmd
+	// logs is where lines the subprocess writes to stdout that
+	// aren't responses go.
+	logs io.Writer
+	// done is closed when the subprocess closes stdout.
+	done chan struct{}
+
+	writeLock sync.Mutex
+	stdin     io.WriteCloser
+
+	lock    sync.Mutex
+	lastID  int64
+	pending map[int64]chan stdioResponse
+}
+
+// startStdioEngine starts the subprocess with args, with stdin and
+// stdout used for the stdio protocol. Other output from the subprocess
+// goes to logs and stderr.
+// The subprocess is killed when the context is done.
+func startStdioEngine(ctx context.Context, args []string, logs, stderr io.Writer) (*stdioEngine, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	s := &stdioEngine{
+		cmd:     cmd,
+		logs:    logs,
+		done:    make(chan struct{}),
+		stdin:   stdin,
+		pending: make(map[int64]chan stdioResponse),
+	}
+	go s.read(stdout)
+	return s, nil
+}
+
+// wait waits for the subprocess to exit.
+func (s *stdioEngine) wait() error {
+	// all output must be read before calling Wait
+	<-s.done
+	return s.cmd.Wait()
+}
+
+// read reads responses from stdout until it is closed.
+func (s *stdioEngine) read(stdout io.Reader) {
+	defer close(s.done)
+	r := bufio.NewReader(stdout)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			s.handleLine(line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleLine passes a response to the request waiting for it.
+// Anything that isn't a response is written to the logs.
+func (s *stdioEngine) handleLine(line []byte) {
+	var resp stdioResponse
+	if !bytes.HasPrefix(bytes.TrimSpace(line), []byte("{")) || json.Unmarshal(line, &resp) != nil {
+		s.logs.Write(line)
+		return
+	}
+	s.lock.Lock()
+	ch, ok := s.pending[resp.ID]
+	delete(s.pending, resp.ID)
+	s.lock.Unlock()
+	if !ok {
+		// not a response, or the request has already been given up on
+		s.logs.Write(line)
+		return
+	}
+	ch <- resp
+}
+
+// call sends the request and waits for the response.
+func (s *stdioEngine) call(ctx context.Context, req stdioRequest) (stdioResponse, error) {
+	ch := make(chan stdioResponse, 1)
+	s.lock.Lock()
+	s.lastID++
+	req.ID = s.lastID
+	s.pending[req.ID] = ch
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.pending, req.ID)
+		s.lock.Unlock()
+	}()
+	b, err := json.Marshal(req)
+	if err != nil {
+		return stdioResponse{}, errors.Wrap(err, "encode request")
+	}
+	b = append(b, '\n')
+	// the write blocks if the subprocess stops reading stdin, so it
+	// is given up on like the response
+	written := make(chan error, 1)
+	go func() {
+		written <- s.write(ctx, b)
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			return stdioResponse{}, errors.Wrap(err, "write request")
+		}
+	case <-s.done:
+		return stdioResponse{}, errStdioClosed
+	case <-ctx.Done():
+		return stdioResponse{}, ctx.Err()
+	}
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-s.done:
+		return stdioResponse{}, errStdioClosed
+	case <-ctx.Done():
+		return stdioResponse{}, ctx.Err()
+	}
+}
+
+// write writes a request line to stdin, one at a time.
+// The request isn't written if the context is done before it gets
+// its turn. Once started, a write always finishes, so a request
+// is never cut off part way through the line.
+func (s *stdioEngine) write(ctx context.Context, line []byte) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err := s.stdin.Write(line)
+	return err
+}
+
+// ready returns an error unless the engine is ready.
+func (s *stdioEngine) ready(ctx context.Context) error {
+	resp, err := s.call(ctx, stdioRequest{Type: stdioRequestReady})
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if !resp.Ready {
+		return errors.New("not ready")
+	}
+	return nil
+}
+
+// process sends a process request for the chunk.
+// Errors are chunkErrors with the status code from the response.
+func (s *stdioEngine) process(ctx context.Context, req *enginepb.ProcessRequest) (*enginepb.ProcessResponse, error) {
+	processReq := &stdioProcessRequest{
+		ChunkUUID:            req.ChunkUuid,
+		ChunkMimeType:        req.ChunkMimeType,
+		StartOffsetMS:        req.StartOffsetMs,
+		EndOffsetMS:          req.EndOffsetMs,
+		Width:                req.Width,
+		Height:               req.Height,
+		LibraryID:            req.LibraryId,
+		LibraryEngineModelID: req.LibraryEngineModelId,
+		CacheURI:             req.CacheUri,
+		VeritoneAPIBaseURL:   req.VeritoneApiBaseUrl,
+		Token:                req.Token,
+		Chunk:                req.Chunk,
+	}
+	if json.Valid([]byte(req.Payload)) {
+		processReq.Payload = json.RawMessage(req.Payload)
+	}
+	resp, err := s.call(ctx, stdioRequest{
+		Type:                stdioRequestProcess,
+		stdioProcessRequest: processReq,
+	})
+	if err != nil {
+		return nil, newChunkError(failureReasonEngineUnavailable, err)
+	}
+	if resp.Error != "" {
+		return nil, stdioError(resp)
+	}
+	output := bytes.TrimSpace(resp.Output)
+	if resp.Ignored || len(output) == 0 || bytes.Equal(output, []byte("null")) {
+		return &enginepb.ProcessResponse{Ignored: true}, nil
+	}
+	return &enginepb.ProcessResponse{Content: string(output)}, nil
+}
+
+// finalize sends a finalize request for the task, and gets any
+// output.
+// Engines that respond with a 501 status code have no output.
+func (s *stdioEngine) finalize(ctx context.Context, control controlMessage) (string, error) {
+	resp, err := s.call(ctx, stdioRequest{
+		Type: stdioRequestFinalize,
+		stdioFinalizeRequest: &stdioFinalizeRequest{
+			TaskID: control.TaskID,
+			JobID:  control.JobID,
+			TDOID:  control.TDOID,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusNotImplemented {
+		return "", nil
+	}
+	if resp.Error != "" {
+		return "", stdioError(resp)
+	}
+	output := bytes.TrimSpace(resp.Output)
+	if bytes.Equal(output, []byte("null")) {
+		return "", nil
+	}
+	return string(output), nil
+}
+
+// stdioError makes a chunkError from a failed response, treating it
+// like a webhook response with the status code.
+func stdioError(resp stdioResponse) error {
+	statusCode := resp.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusInternalServerError
+	}
+	return newWebhookError(statusCode, http.Header{}, []byte(resp.Error))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/engine-toolkit/engine/enginepb"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestStdioEngine(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var logs bytes.Buffer
+	s, err := startStdioEngine(ctx, []string{"./testdata/subprocesses/stdio.sh"}, &logs, ioutil.Discard)
+	is.NoErr(err)
+
+	is.NoErr(s.ready(ctx))
+	is.Equal(logs.String(), "starting up\n")
+
+	resp, err := s.process(ctx, &enginepb.ProcessRequest{
+		ChunkUuid: "chunk1",
+		Payload:   `{"token":"secret"}`,
+		Chunk:     []byte("media content"),
+	})
+	is.NoErr(err)
+	is.Equal(resp.Ignored, false)
+	is.Equal(resp.Content, `{"chunk":"bWVkaWEgY29udGVudA=="}`)
+
+	resp, err = s.process(ctx, &enginepb.ProcessRequest{StartOffsetMs: 1000})
+	is.NoErr(err)
+	is.Equal(resp.Ignored, true)
+
+	_, err = s.process(ctx, &enginepb.ProcessRequest{StartOffsetMs: 2000})
+	reason, msg := failureDetails(err)
+	is.Equal(reason, failureReasonBadInput)
+	is.Equal(msg, "400: unsupported chunk")
+
+	// the script doesn't implement finalize
+	content, err := s.finalize(ctx, controlMessage{TaskID: "task1"})
+	is.NoErr(err)
+	is.Equal(content, "")
+
+	// the subprocess exits when stdin is closed
+	is.NoErr(s.stdin.Close())
+	is.NoErr(s.wait())
+	_, err = s.process(ctx, &enginepb.ProcessRequest{})
+	reason, _ = failureDetails(err)
+	is.Equal(reason, failureReasonEngineUnavailable)
+}
+
+func TestStdioEngineNotReading(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the subprocess never reads stdin, so the pipe fills up
+	s, err := startStdioEngine(ctx, []string{"sleep", "10"}, ioutil.Discard, ioutil.Discard)
+	is.NoErr(err)
+
+	callCtx, callCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer callCancel()
+	start := time.Now()
+	_, err = s.process(callCtx, &enginepb.ProcessRequest{
+		Chunk: make([]byte, 1024*1024),
+	})
+	is.True(err != nil)
+	is.True(time.Since(start) < 5*time.Second)
+	reason, _ := failureDetails(err)
+	is.Equal(reason, failureReasonEngineUnavailable)
+}
+
+func TestProcessingChunkOverStdio(t *testing.T) {
+	is := is.New(t)
+	var mediaRequests int32
+	mediaSrv := newMediaServer("media content", &mediaRequests)
+	defer mediaSrv.Close()
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{"./testdata/subprocesses/stdio.sh"}
+	engine.Config.Stdio.Enabled = true
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Processing.DisableChunkDownload = false
+	engine.Config.Webhooks.Backoff.MaxRetries = 0
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		engine.Run(ctx)
+	}()
+	receive := func() chunkResult {
+		var result chunkResult
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			is.Equal(outputMsg.Topic, engine.Config.Kafka.ChunkTopic)
+			err := json.Unmarshal(outputMsg.Value, &result)
+			is.NoErr(err)
+		case <-time.After(2 * time.Second):
+			is.Fail() // timed out
+		}
+		return result
+	}
+	send := func(offset int64, chunkUUID string, startOffsetMS int) {
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: offset,
+			Key:    sarama.StringEncoder("task1"),
+			Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+				Type:          processing.MessageTypeMediaChunk,
+				TaskID:        "task1",
+				ChunkUUID:     chunkUUID,
+				StartOffsetMS: startOffsetMS,
+				EndOffsetMS:   startOffsetMS + 1000,
+				MIMEType:      "image/png",
+				CacheURI:      mediaSrv.URL,
+			}),
+		})
+		is.NoErr(err)
+	}
+
+	send(1, "chunk1", 0)
+	result := receive()
+	is.Equal(result.ChunkUUID, "chunk1")
+	is.Equal(result.Status, processing.ChunkStatusSuccess)
+	is.Equal(result.EngineOutput.Content, `{"chunk":"bWVkaWEgY29udGVudA=="}`)
+
+	send(2, "chunk2", 1000)
+	result = receive()
+	is.Equal(result.ChunkUUID, "chunk2")
+	is.Equal(result.Status, processing.ChunkStatusIgnored)
+
+	send(3, "chunk3", 2000)
+	result = receive()
+	is.Equal(result.ChunkUUID, "chunk3")
+	is.Equal(result.Status, processing.ChunkStatusError)
+	is.Equal(result.FailureReason, failureReasonBadInput)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// ndjsonContentType is the content type of Process webhook responses
+// that stream series items, one JSON object per line.
+const ndjsonContentType = "application/x-ndjson"
+
+// seriesOutput makes engine output content from series items.
+func seriesOutput(items [][]byte) string {
+	var buf bytes.Buffer
+	buf.WriteString(`{"series":[`)
+	buf.Write(bytes.Join(items, []byte(",")))
+	buf.WriteString(`]}`)
+	return buf.String()
+}
+
+// readStreamedOutput reads the series items from a streamed Process
+// webhook response as they arrive, and gets the engine output with
+// all of them.
+// If interim outputs are enabled, new items are sent periodically
+// while the response is read.
+func (e *Engine) readStreamedOutput(key []byte, traceID string, mediaChunk processing.MediaChunkMessage, body io.Reader) (string, error) {
+	max := int64(e.Config.Output.MaxStreamedBytes)
+	if max > 0 {
+		// a single line can't be larger than the limit
+		body = io.LimitReader(body, max+1)
+	}
+	r := bufio.NewReader(body)
+	var items, interim [][]byte
+	var size int64
+	lastInterim := time.Now()
+	for {
+		line, err := r.ReadBytes('\n')
+		size += int64(len(line))
+		if max > 0 && size > max {
+			return "", newChunkError(failureReasonOutputTooLarge, errors.Errorf("streamed engine output is over %d bytes", max))
+		}
+		if item := bytes.TrimSpace(line); len(item) > 0 {
+			if !json.Valid(item) {
+				return "", newChunkError(failureReasonEngineError, errors.Errorf("invalid series item: %q", item))
+			}
+			items = append(items, item)
+			interim = append(interim, item)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", newChunkError(failureReasonEngineError, errors.Wrap(err, "read response body"))
+		}
+		if interval := e.Config.Output.InterimInterval; interval > 0 && len(interim) > 0 && time.Since(lastInterim) >= interval {
+			if err := e.produceInterimOutput(key, traceID, mediaChunk, seriesOutput(interim)); err != nil {
+				e.logDebug("WARN", "failed to send interim output:", err)
+			}
+			interim = nil
+			lastInterim = time.Now()
+		}
+	}
+	return seriesOutput(items), nil
+}
+
+// produceInterimOutput sends an engine output message with the content
+// to the chunk topic, before the chunk has finished.
+func (e *Engine) produceInterimOutput(key []byte, traceID string, mediaChunk processing.MediaChunkMessage, content string) error {
+	_, _, err := e.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: e.Config.Kafka.ChunkTopic,
+		Key:   sarama.ByteEncoder(key),
+		Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+			Type:          processing.MessageTypeEngineOutput,
+			TaskID:        mediaChunk.TaskID,
+			JobID:         mediaChunk.JobID,
+			ChunkUUID:     mediaChunk.ChunkUUID,
+			StartOffsetMS: mediaChunk.StartOffsetMS,
+			EndOffsetMS:   mediaChunk.EndOffsetMS,
+			TimestampUTC:  time.Now().Unix(),
+			Content:       content,
+		}),
+		Headers: e.recordHeaders(traceID),
+	})
+	return err
+}
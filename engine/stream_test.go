@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestProcessingChunkStreamedOutput(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.Config.Output.InterimInterval = 1 * time.Nanosecond
+	engine.Config.Output.MaxStreamedBytes = 100
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	var calls int32
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if r.FormValue("startOffsetMS") == "3000" {
+			for i := 0; i < 20; i++ {
+				io.WriteString(w, `{"label":"xxxxxxxx"}`+"\n")
+			}
+			return
+		}
+		for _, item := range []string{`{"label":"a"}`, `{"label":"b"}`} {
+			io.WriteString(w, item+"\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	send := func(offset int64, chunkUUID string, startOffsetMS int) {
+		_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+			Offset: offset,
+			Key:    sarama.StringEncoder("task1"),
+			Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+				Type:          processing.MessageTypeMediaChunk,
+				TaskID:        "task1",
+				ChunkUUID:     chunkUUID,
+				StartOffsetMS: startOffsetMS,
+				EndOffsetMS:   startOffsetMS + 1000,
+			}),
+		})
+		is.NoErr(err)
+	}
+	receive := func() []byte {
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			return outputMsg.Value
+		case <-time.After(1 * time.Second):
+			is.Fail() // timed out
+		}
+		return nil
+	}
+
+	send(1, "chunk1", 1000)
+	for _, content := range []string{`{"series":[{"label":"a"}]}`, `{"series":[{"label":"b"}]}`} {
+		var interim processing.MediaChunkMessage
+		is.NoErr(json.Unmarshal(receive(), &interim))
+		is.Equal(interim.Type, processing.MessageTypeEngineOutput)
+		is.Equal(interim.ChunkUUID, "chunk1")
+		is.Equal(interim.Content, content)
+	}
+	var result chunkResult
+	is.NoErr(json.Unmarshal(receive(), &result))
+	is.Equal(result.Type, processing.MessageTypeChunkResult)
+	is.Equal(result.Status, processing.ChunkStatusSuccess)
+	is.Equal(result.EngineOutput.Content, `{"series":[{"label":"a"},{"label":"b"}]}`)
+
+	atomic.StoreInt32(&calls, 0)
+	send(2, "large", 3000)
+	for {
+		// skip interim outputs sent before the limit was reached
+		is.NoErr(json.Unmarshal(receive(), &result))
+		if result.Type == processing.MessageTypeChunkResult {
+			break
+		}
+	}
+	is.Equal(result.ChunkUUID, "large")
+	is.Equal(result.Status, processing.ChunkStatusError)
+	is.Equal(result.FailureReason, failureReasonOutputTooLarge)
+	is.Equal(atomic.LoadInt32(&calls), int32(1)) // not retried
+}
@@ -5,13 +5,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
+	"github.com/veritone/engine-toolkit/engine/enginepb"
 )
 
 // runTestConsole runs the test console that allows developers
@@ -23,8 +27,14 @@ func (e *Engine) runTestConsole(context.Context) {
 	The Engine Toolkit Test Console is now running.
 
 	Go to: http://localhost:9090/`)
-	processWebhookProxy := reverseProxy(os.Getenv("VERITONE_WEBHOOK_PROCESS"))
-	readyWebhookProxy := reverseProxy(os.Getenv("VERITONE_WEBHOOK_READY"))
+	var processWebhookProxy, readyWebhookProxy http.Handler
+	if e.rpc != nil {
+		processWebhookProxy = http.HandlerFunc(e.handleRPCProcess)
+		readyWebhookProxy = http.HandlerFunc(e.handleRPCReady)
+	} else {
+		processWebhookProxy = reverseProxy(os.Getenv("VERITONE_WEBHOOK_PROCESS"), e.webhookClient.Transport)
+		readyWebhookProxy = reverseProxy(os.Getenv("VERITONE_WEBHOOK_READY"), e.webhookClient.Transport)
+	}
 	handleManifest := e.handleManifest("/var/manifest.json")
 	if err := http.ListenAndServe("0.0.0.0:9090", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
@@ -80,6 +90,10 @@ func (e *Engine) handleManifest(file string) http.HandlerFunc {
 }
 
 func (e *Engine) handleEnvVars(w http.ResponseWriter, r *http.Request) {
+	if e.rpc != nil {
+		// the webhooks aren't used
+		return
+	}
 	if err := validURL(e.Config.Webhooks.Process.URL); err != nil {
 		http.Error(w, "VERITONE_WEBHOOK_PROCESS: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -90,6 +104,66 @@ func (e *Engine) handleEnvVars(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleRPCReady asks the engine if it is ready over gRPC or stdio,
+// and responds like the Ready webhook.
+func (e *Engine) handleRPCReady(w http.ResponseWriter, r *http.Request) {
+	if err := e.rpc.ready(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+}
+
+// handleRPCProcess turns the Process webhook form from the console
+// into a gRPC or stdio Process call, and responds like the Process
+// webhook.
+func (e *Engine) handleRPCProcess(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	formInt := func(key string) int32 {
+		n, _ := strconv.Atoi(r.FormValue(key))
+		return int32(n)
+	}
+	req := &enginepb.ProcessRequest{
+		ChunkUuid:            r.FormValue("chunkUUID"),
+		ChunkMimeType:        r.FormValue("chunkMimeType"),
+		StartOffsetMs:        formInt("startOffsetMS"),
+		EndOffsetMs:          formInt("endOffsetMS"),
+		Width:                formInt("width"),
+		Height:               formInt("height"),
+		LibraryId:            r.FormValue("libraryID"),
+		LibraryEngineModelId: r.FormValue("libraryEngineModelId"),
+		CacheUri:             r.FormValue("cacheURI"),
+		VeritoneApiBaseUrl:   r.FormValue("veritoneApiBaseUrl"),
+		Token:                r.FormValue("token"),
+		Payload:              r.FormValue("payload"),
+	}
+	if f, _, err := r.FormFile("chunk"); err == nil {
+		req.Chunk, err = ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	resp, err := e.rpc.process(r.Context(), req)
+	if err != nil {
+		statusCode := http.StatusBadGateway
+		if ce, ok := causeChunkError(err); ok && ce.statusCode != 0 {
+			statusCode = ce.statusCode
+		}
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+	if resp.Ignored {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	io.WriteString(w, resp.Content)
+}
+
 func validURL(u string) error {
 	if u == "" {
 		return errors.New("missing URL")
@@ -102,12 +176,19 @@ func validURL(u string) error {
 		return errors.New("should be absolute URL")
 	}
 	if uu.Scheme == "" {
-		return errors.New("missing protocol (use http:// or https://)")
+		return errors.New("missing protocol (use http://, https:// or unix://)")
+	}
+	if uu.Scheme == unixScheme {
+		if socket, _ := splitUnixURL(uu); uu.Host != "" || !strings.HasPrefix(socket, "/") || !strings.HasSuffix(socket, unixSocketSuffix) {
+			return errors.New("unix socket URL should have an absolute path to a .sock file (like unix:///var/run/engine.sock:/process)")
+		}
 	}
 	return nil
 }
 
-func reverseProxy(target string) *httputil.ReverseProxy {
+// reverseProxy makes a proxy to the target URL, using transport to
+// make the requests.
+func reverseProxy(target string, transport http.RoundTripper) *httputil.ReverseProxy {
 	u, err := url.Parse(target)
 	if err != nil {
 		panic(err)
@@ -118,6 +199,7 @@ func reverseProxy(target string) *httputil.ReverseProxy {
 			r.URL.Host = u.Host
 			r.URL.Path = u.Path
 		},
+		Transport: transport,
 	}
 }
 
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 
 	"github.com/matryer/is"
+	"github.com/veritone/engine-toolkit/engine/enginepb"
 )
 
 func TestManifest(t *testing.T) {
@@ -26,3 +29,46 @@ func TestManifest(t *testing.T) {
 	is.Equal(w.Code, http.StatusInternalServerError)
 	is.Equal(strings.TrimSpace(w.Body.String()), `manifest.json: engineMode: should be "chunk" not "nope"`)
 }
+
+func TestGRPCConsole(t *testing.T) {
+	is := is.New(t)
+	grpcEngine := &testGRPCEngine{requests: make(chan *enginepb.ProcessRequest, 2)}
+	addr, stop := newTestGRPCServer(t, grpcEngine)
+	defer stop()
+	eng := Engine{}
+	client, err := dialGRPCEngine(addr)
+	is.NoErr(err)
+	defer client.Close()
+	eng.rpc = client
+
+	w := httptest.NewRecorder()
+	eng.handleRPCReady(w, httptest.NewRequest(http.MethodGet, "/api/engine/ready", nil))
+	is.Equal(w.Code, http.StatusOK)
+
+	process := func(startOffsetMS string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("chunkMimeType", "image/png")
+		mw.WriteField("startOffsetMS", startOffsetMS)
+		fw, err := mw.CreateFormFile("chunk", "chunk.png")
+		is.NoErr(err)
+		fw.Write([]byte("media content"))
+		is.NoErr(mw.Close())
+		req := httptest.NewRequest(http.MethodPost, "/api/engine/process", &buf)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		eng.handleRPCProcess(w, req)
+		return w
+	}
+	w = process("0")
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(w.Body.String(), `{"series":[]}`)
+	req := <-grpcEngine.requests
+	is.Equal(req.ChunkMimeType, "image/png")
+	is.Equal(string(req.Chunk), "media content")
+
+	w = process("2000")
+	is.Equal(w.Code, http.StatusBadRequest) // InvalidArgument
+	req = <-grpcEngine.requests
+	is.Equal(req.StartOffsetMs, int32(2000))
+}
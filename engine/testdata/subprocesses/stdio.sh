@@ -0,0 +1,20 @@
+#!/bin/bash
+
+# an engine that uses the stdio protocol, which outputs the chunk
+echo "starting up"
+while read -r line; do
+	id=$(echo "$line" | sed -E 's/^\{"type":"[a-z]+","id":([0-9]+).*/\1/')
+	case "$line" in
+	*'"type":"ready"'*)
+		echo "{\"id\":$id,\"ready\":true}" ;;
+	*'"startOffsetMS":1000,'*)
+		echo "{\"id\":$id,\"ignored\":true}" ;;
+	*'"startOffsetMS":2000,'*)
+		echo "{\"id\":$id,\"error\":\"unsupported chunk\",\"statusCode\":400}" ;;
+	*'"type":"process"'*)
+		chunk=$(echo "$line" | sed -E 's/.*"chunk":"([^"]*)".*/\1/')
+		echo "{\"id\":$id,\"output\":{\"chunk\":\"$chunk\"}}" ;;
+	*)
+		echo "{\"id\":$id,\"error\":\"not implemented\",\"statusCode\":501}" ;;
+	esac
+done
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unixScheme is the URL scheme for webhooks served on a unix domain
+// socket. The HTTP path follows the socket path after a colon, for
+// example unix:///var/run/engine.sock:/process.
+const unixScheme = "unix"
+
+// unixSocketSuffix ends the socket path in a unix socket URL, so the
+// socket path can contain colons too.
+const unixSocketSuffix = ".sock"
+
+// splitUnixURL gets the socket path and the HTTP path from a unix
+// socket URL. The socket path ends at the first ".sock" that is
+// followed by a colon and the HTTP path, or by nothing at all.
+// The HTTP path is "/" if there isn't one.
+// If there is no such ".sock", the whole path is the socket path
+// (see validURL).
+func splitUnixURL(u *url.URL) (socket, path string) {
+	p := u.Path
+	for i := 0; ; {
+		j := strings.Index(p[i:], unixSocketSuffix)
+		if j < 0 {
+			return p, "/"
+		}
+		end := i + j + len(unixSocketSuffix)
+		switch rest := p[end:]; {
+		case rest == "" || rest == ":":
+			return p[:end], "/"
+		case strings.HasPrefix(rest, ":/"):
+			return p[:end], rest[1:]
+		}
+		i = end
+	}
+}
+
+// webhookTransport is the http.RoundTripper for the webhook client.
+// Requests for unix socket URLs are sent over the socket, and all
+// other requests go to next.
+type webhookTransport struct {
+	next http.RoundTripper
+
+	lock sync.Mutex
+	// sockets holds a transport for each socket, so connections
+	// are reused.
+	sockets map[string]*http.Transport
+}
+
+// newWebhookTransport makes a webhookTransport that sends requests
+// other than to unix sockets with the default transport.
+func newWebhookTransport() *webhookTransport {
+	return &webhookTransport{
+		next:    http.DefaultTransport,
+		sockets: make(map[string]*http.Transport),
+	}
+}
+
+// RoundTrip sends the request.
+func (t *webhookTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != unixScheme {
+		return t.next.RoundTrip(req)
+	}
+	socket, path := splitUnixURL(req.URL)
+	// the socket transport speaks plain HTTP, with the path from
+	// the unix URL.
+	u := *req.URL
+	u.Scheme = "http"
+	u.Host = "localhost"
+	u.Path = path
+	u.RawPath = ""
+	r := new(http.Request)
+	*r = *req
+	r.URL = &u
+	return t.socketTransport(socket).RoundTrip(r)
+}
+
+// socketTransport gets the transport for the socket.
+func (t *webhookTransport) socketTransport(socket string) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	transport, ok := t.sockets[socket]
+	if !ok {
+		dialer := &net.Dialer{Timeout: 30 * time.Second}
+		transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+			// every request is to the same engine
+			MaxIdleConnsPerHost: 100,
+			IdleConnTimeout:     90 * time.Second,
+		}
+		t.sockets[socket] = transport
+	}
+	return transport
+}
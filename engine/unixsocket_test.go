@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestSplitUnixURL(t *testing.T) {
+	is := is.New(t)
+	u, err := url.Parse("unix:///var/run/engine.sock:/process")
+	is.NoErr(err)
+	socket, path := splitUnixURL(u)
+	is.Equal(socket, "/var/run/engine.sock")
+	is.Equal(path, "/process")
+	u, err = url.Parse("unix:///var/run/engine.sock")
+	is.NoErr(err)
+	socket, path = splitUnixURL(u)
+	is.Equal(socket, "/var/run/engine.sock")
+	is.Equal(path, "/")
+
+	// colons in the socket path
+	u, err = url.Parse("unix:///var/run/engine:1/x.sock:y/engine.sock:/process:1")
+	is.NoErr(err)
+	socket, path = splitUnixURL(u)
+	is.Equal(socket, "/var/run/engine:1/x.sock:y/engine.sock")
+	is.Equal(path, "/process:1")
+	u, err = url.Parse("unix:///var/run/engine:1.sock")
+	is.NoErr(err)
+	socket, path = splitUnixURL(u)
+	is.Equal(socket, "/var/run/engine:1.sock")
+	is.Equal(path, "/")
+}
+
+func TestWebhookTransportUnixSocket(t *testing.T) {
+	is := is.New(t)
+	dir, err := ioutil.TempDir("", "engine-toolkit")
+	is.NoErr(err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "engine.sock")
+	lis, err := net.Listen("unix", socket)
+	is.NoErr(err)
+	defer lis.Close()
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Method + " " + r.URL.Path))
+		}),
+	}
+	go srv.Serve(lis)
+	defer srv.Close()
+	tcpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tcp " + r.URL.Path))
+	}))
+	defer tcpSrv.Close()
+
+	client := &http.Client{Transport: newWebhookTransport()}
+	get := func(u string) string {
+		resp, err := client.Get(u)
+		is.NoErr(err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		is.NoErr(err)
+		return string(b)
+	}
+	is.Equal(get("unix://"+socket+":/readyz"), "GET /readyz")
+	is.Equal(get("unix://"+socket), "GET /")
+
+	// a socket in a directory with a colon in its name
+	colonDir := filepath.Join(dir, "engine:1")
+	is.NoErr(os.Mkdir(colonDir, 0755))
+	colonSocket := filepath.Join(colonDir, "engine.sock")
+	colonLis, err := net.Listen("unix", colonSocket)
+	is.NoErr(err)
+	defer colonLis.Close()
+	colonSrv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("colon " + r.URL.Path))
+		}),
+	}
+	go colonSrv.Serve(colonLis)
+	defer colonSrv.Close()
+	is.Equal(get("unix://"+colonSocket+":/readyz"), "colon /readyz")
+	is.Equal(get(tcpSrv.URL+"/readyz"), "tcp /readyz")
+}
+
+func TestValidUnixURL(t *testing.T) {
+	is := is.New(t)
+	is.NoErr(validURL("unix:///var/run/engine.sock:/process"))
+	is.True(validURL("unix://engine.sock:/process") != nil)
+	is.NoErr(validURL("unix:///var/run/engine:1/engine.sock:/process"))
+	is.True(validURL("unix:///var/run/engine:/process") != nil) // no .sock
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+// validationError describes everything wrong with a message.
+type validationError struct {
+	problems []string
+}
+
+func (v *validationError) Error() string {
+	return "invalid message: " + strings.Join(v.problems, "; ")
+}
+
+// add adds a problem with the field.
+func (v *validationError) add(field, format string, args ...interface{}) {
+	v.problems = append(v.problems, field+": "+fmt.Sprintf(format, args...))
+}
+
+// validateMediaChunk parses and validates a media chunk message.
+// The returned message contains whatever could be parsed, even if
+// it is invalid, so the error can be reported against the chunk.
+// The error is a chunkError with the invalid_message failure reason.
+func validateMediaChunk(value []byte) (processing.MediaChunkMessage, error) {
+	var mediaChunk processing.MediaChunkMessage
+	invalid := &validationError{}
+	if err := json.Unmarshal(value, &mediaChunk); err != nil {
+		switch err := err.(type) {
+		case *json.SyntaxError:
+			invalid.add("message", "malformed JSON at offset %d: %v", err.Offset, err)
+			return mediaChunk, newChunkError(failureReasonInvalidMessage, invalid)
+		case *json.UnmarshalTypeError:
+			// the rest of the message is still parsed
+			invalid.add(err.Field, "expected %s but got %s", err.Type, err.Value)
+		default:
+			invalid.add("message", "%v", err)
+			return mediaChunk, newChunkError(failureReasonInvalidMessage, invalid)
+		}
+	}
+	if mediaChunk.Type != processing.MessageTypeMediaChunk {
+		invalid.add("type", "expected %q but got %q", processing.MessageTypeMediaChunk, mediaChunk.Type)
+	}
+	if mediaChunk.TaskID == "" {
+		invalid.add("taskId", "required")
+	}
+	if mediaChunk.ChunkUUID == "" {
+		invalid.add("chunkUUID", "required")
+	}
+	if mediaChunk.StartOffsetMS < 0 {
+		invalid.add("startOffsetMs", "must not be negative (got %d)", mediaChunk.StartOffsetMS)
+	}
+	if mediaChunk.EndOffsetMS < mediaChunk.StartOffsetMS {
+		invalid.add("endOffsetMs", "must not be before startOffsetMs (got %d < %d)", mediaChunk.EndOffsetMS, mediaChunk.StartOffsetMS)
+	}
+	if mediaChunk.Width < 0 || mediaChunk.Height < 0 {
+		invalid.add("width/height", "must not be negative (got %dx%d)", mediaChunk.Width, mediaChunk.Height)
+	}
+	if mediaChunk.CacheURI != "" {
+		u, err := url.Parse(mediaChunk.CacheURI)
+		if err != nil {
+			invalid.add("cacheURI", "%v", err)
+		} else if !u.IsAbs() || u.Host == "" {
+			invalid.add("cacheURI", "must be an absolute URL (got %q)", mediaChunk.CacheURI)
+		}
+	}
+	if err := validateTaskOptions(value); err != nil {
+		invalid.add("taskPayload", "%v", err)
+	}
+	if len(invalid.problems) > 0 {
+		return mediaChunk, newChunkError(failureReasonInvalidMessage, invalid)
+	}
+	return mediaChunk, nil
+}
+
+// validateTaskOptions checks the toolkit options in the task payload.
+func validateTaskOptions(value []byte) error {
+	options, err := taskOptionsFromMessage(value)
+	if err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Field == "taskPayload" {
+			// not an object, which is reported already
+			return nil
+		}
+		return err
+	}
+	if options.ChunkTimeout != "" {
+		if _, err := time.ParseDuration(options.ChunkTimeout); err != nil {
+			return errors.Wrap(err, "chunkTimeout")
+		}
+	}
+	if options.TaskWeight < 0 {
+		return errors.Errorf("taskWeight: must not be negative (got %d)", options.TaskWeight)
+	}
+	return nil
+}
+
+// processInvalidMessage reports a media chunk message that failed
+// validation. Chunks that can be identified get an error ChunkResult,
+// others are sent to the dead-letter topic.
+func (e *Engine) processInvalidMessage(ctx context.Context, msg *sarama.ConsumerMessage, mediaChunk processing.MediaChunkMessage, err error) error {
+	e.logDebug("WARN", fmt.Sprintf("offset %d (partition %d): %v", msg.Offset, msg.Partition, err))
+	if mediaChunk.TaskID == "" || mediaChunk.ChunkUUID == "" {
+		e.sendDeadLetter(msg, nil, err)
+		return nil
+	}
+	reason, failureMsg := failureDetails(err)
+	result := chunkResult{
+		ChunkResult: processing.ChunkResult{
+			Type:          processing.MessageTypeChunkResult,
+			TaskID:        mediaChunk.TaskID,
+			ChunkUUID:     mediaChunk.ChunkUUID,
+			Status:        processing.ChunkStatusError,
+			ErrorMsg:      err.Error(),
+			FailureReason: reason,
+			FailureMsg:    failureMsg,
+		},
+	}
+	if err := e.sendChunkResult(ctx, msg.Key, messageTraceID(msg, mediaChunk.ChunkUUID), result); err != nil {
+		return abandonedError{err: errors.Wrap(err, "send final chunk update")}
+	}
+	return nil
+}
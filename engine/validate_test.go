@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matryer/is"
+	"github.com/veritone/realtime/modules/engines/toolkit/processing"
+)
+
+func TestValidateMediaChunk(t *testing.T) {
+	const valid = `{"type":"media_chunk","taskId":"task1","chunkUUID":"chunk1","startOffsetMs":1000,"endOffsetMs":2000,"cacheURI":"https://example.com/chunk1","taskPayload":{"chunkTimeout":"30s"}}`
+	tests := []struct {
+		name    string
+		value   string
+		problem string
+	}{
+		{"valid", valid, ""},
+		{"malformed JSON", `{"type":"media_chunk",`, "message: malformed JSON"},
+		{"missing task ID", strings.Replace(valid, `"taskId":"task1",`, "", 1), "taskId: required"},
+		{"missing chunk UUID", strings.Replace(valid, `"chunkUUID":"chunk1",`, "", 1), "chunkUUID: required"},
+		{"end before start", strings.Replace(valid, `"endOffsetMs":2000`, `"endOffsetMs":500`, 1), "endOffsetMs: must not be before startOffsetMs (got 500 < 1000)"},
+		{"negative start", strings.Replace(valid, `"startOffsetMs":1000`, `"startOffsetMs":-1`, 1), "startOffsetMs: must not be negative"},
+		{"wrong field type", strings.Replace(valid, `"startOffsetMs":1000`, `"startOffsetMs":"1000"`, 1), "startOffsetMs: expected int but got string"},
+		{"relative cache URI", strings.Replace(valid, `https://example.com/chunk1`, `/chunk1`, 1), "cacheURI: must be an absolute URL"},
+		{"payload not an object", strings.Replace(valid, `{"chunkTimeout":"30s"}`, `"payload"`, 1), "taskPayload: expected map[string]interface {} but got string"},
+		{"bad chunk timeout", strings.Replace(valid, `"30s"`, `"soon"`, 1), "taskPayload: chunkTimeout"},
+		{"negative task weight", strings.Replace(valid, `"30s"`, `"30s","taskWeight":-1`, 1), "taskPayload: taskWeight: must not be negative"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			is := is.New(t)
+			_, err := validateMediaChunk([]byte(test.value))
+			if test.problem == "" {
+				is.NoErr(err)
+				return
+			}
+			is.True(err != nil)
+			is.True(strings.Contains(err.Error(), test.problem)) // error should describe the problem
+			reason, _ := failureDetails(err)
+			is.Equal(reason, failureReasonInvalidMessage)
+		})
+	}
+}
+
+func TestProcessingInvalidChunk(t *testing.T) {
+	is := is.New(t)
+
+	engine := NewEngine()
+	engine.Config.Subprocess.Arguments = []string{} // no subprocess
+	engine.Config.Kafka.ChunkTopic = "chunk-topic"
+	engine.Config.DeadLetter.Topic = "dlq-topic"
+	engine.Config.Events.PeriodicUpdateDuration = 0
+	engine.logDebug = func(args ...interface{}) {}
+	inputPipe := processing.NewPipe()
+	defer inputPipe.Close()
+	outputPipe := processing.NewPipe()
+	defer outputPipe.Close()
+	engine.consumer = inputPipe
+	engine.producer = outputPipe
+	readySrv := newOKServer()
+	defer readySrv.Close()
+	engine.Config.Webhooks.Ready.URL = readySrv.URL
+	processSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		is.Fail() // invalid chunks should not be sent to the webhook
+	}))
+	defer processSrv.Close()
+	engine.Config.Webhooks.Process.URL = processSrv.URL
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := engine.Run(ctx)
+		is.NoErr(err)
+	}()
+	receive := func() *sarama.ConsumerMessage {
+		select {
+		case outputMsg := <-outputPipe.Messages():
+			return outputMsg
+		case <-time.After(1 * time.Second):
+			is.Fail() // timed out
+			return nil
+		}
+	}
+
+	// a chunk that can be identified gets an error result
+	_, _, err := inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 1,
+		Key:    sarama.StringEncoder("task1"),
+		Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+			Type:          processing.MessageTypeMediaChunk,
+			TaskID:        "task1",
+			ChunkUUID:     "chunk1",
+			StartOffsetMS: 2000,
+			EndOffsetMS:   1000,
+		}),
+	})
+	is.NoErr(err)
+	outputMsg := receive()
+	is.Equal(outputMsg.Topic, engine.Config.Kafka.ChunkTopic)
+	var result chunkResult
+	err = json.Unmarshal(outputMsg.Value, &result)
+	is.NoErr(err)
+	is.Equal(result.ChunkUUID, "chunk1")
+	is.Equal(result.Status, processing.ChunkStatusError)
+	is.Equal(result.FailureReason, failureReasonInvalidMessage)
+	is.True(strings.Contains(result.FailureMsg, "endOffsetMs"))
+
+	// a chunk that can't be identified is a dead letter
+	_, _, err = inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 2,
+		Key:    sarama.StringEncoder("task1"),
+		Value: processing.NewJSONEncoder(processing.MediaChunkMessage{
+			Type:   processing.MessageTypeMediaChunk,
+			TaskID: "task1",
+		}),
+	})
+	is.NoErr(err)
+	outputMsg = receive()
+	is.Equal(outputMsg.Topic, "dlq-topic")
+	var letter deadLetter
+	err = json.Unmarshal(outputMsg.Value, &letter)
+	is.NoErr(err)
+	is.Equal(letter.FailureReason, failureReasonInvalidMessage)
+	is.True(strings.Contains(letter.Error, "chunkUUID: required"))
+
+	// so is a message that isn't JSON
+	_, _, err = inputPipe.SendMessage(&sarama.ProducerMessage{
+		Offset: 3,
+		Key:    sarama.StringEncoder("task1"),
+		Value:  sarama.StringEncoder("not json"),
+	})
+	is.NoErr(err)
+	outputMsg = receive()
+	is.Equal(outputMsg.Topic, "dlq-topic")
+	err = json.Unmarshal(outputMsg.Value, &letter)
+	is.NoErr(err)
+	var message string
+	err = json.Unmarshal(letter.Message, &message)
+	is.NoErr(err)
+	is.Equal(message, "not json")
+}